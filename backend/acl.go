@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/yixinin/puup/config"
+)
+
+func portSet(ports []uint16) map[uint16]struct{} {
+	var set = make(map[uint16]struct{}, len(ports))
+	for _, v := range ports {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+type aclRule struct {
+	client       string
+	ports        map[uint16]struct{}
+	udpPorts     map[uint16]struct{}
+	reversePorts map[uint16]struct{}
+	allow        *AllowList
+}
+
+// ACL decides what the frontends may reach through the proxy.
+// a destination must be allowed by proxy_back, and if rules are given,
+// also by a rule of the frontend client id or "*".
+type ACL struct {
+	global *aclRule
+	rules  []*aclRule
+}
+
+func newAclRule(client string, ports, udpPorts, reversePorts []uint16, allow []string) (*aclRule, error) {
+	list, err := NewAllowList(allow)
+	if err != nil {
+		return nil, err
+	}
+	return &aclRule{
+		client:       client,
+		ports:        portSet(ports),
+		udpPorts:     portSet(udpPorts),
+		reversePorts: portSet(reversePorts),
+		allow:        list,
+	}, nil
+}
+
+func NewACL(cfg *config.ProxyBack) (*ACL, error) {
+	global, err := newAclRule("*", cfg.Ports, cfg.UdpPorts, cfg.ReversePorts, cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	var acl = &ACL{global: global}
+	for _, r := range cfg.Rules {
+		rule, err := newAclRule(r.Client, r.Ports, r.UdpPorts, r.ReversePorts, r.Allow)
+		if err != nil {
+			return nil, err
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return acl, nil
+}
+
+// check passes if the global rule and, when rules are given, one rule of client pass.
+func (a *ACL) check(client string, pass func(r *aclRule) bool) bool {
+	if !pass(a.global) {
+		return false
+	}
+	if len(a.rules) == 0 {
+		return true
+	}
+	for _, r := range a.rules {
+		if (r.client == "*" || r.client == client) && pass(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) CheckPort(client string, port uint16) error {
+	if !a.check(client, func(r *aclRule) bool { _, ok := r.ports[port]; return ok }) {
+		return fmt.Errorf("%w: port %d for %s", ErrNotAllowed, port, client)
+	}
+	return nil
+}
+
+func (a *ACL) CheckUdpPort(client string, port uint16) error {
+	if !a.check(client, func(r *aclRule) bool { _, ok := r.udpPorts[port]; return ok }) {
+		return fmt.Errorf("%w: udp port %d for %s", ErrNotAllowed, port, client)
+	}
+	return nil
+}
+
+func (a *ACL) CheckReversePort(client string, port uint16) error {
+	if !a.check(client, func(r *aclRule) bool { _, ok := r.reversePorts[port]; return ok }) {
+		return fmt.Errorf("%w: reverse port %d for %s", ErrNotAllowed, port, client)
+	}
+	return nil
+}
+
+// Resolve returns the address to dial for host:port if client may reach it,
+// the name is resolved once and the ip dialed is the one the rules passed.
+func (a *ACL) Resolve(ctx context.Context, client, host string, port uint16) (string, error) {
+	var dest = net.JoinHostPort(host, fmt.Sprint(port))
+	if !a.global.allow.allowsPort(port) {
+		return "", fmt.Errorf("%w: %s for %s", ErrNotAllowed, dest, client)
+	}
+	name, ips, err := lookup(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s for %s", err, dest, client)
+	}
+	for _, ip := range ips {
+		if a.check(client, func(r *aclRule) bool { return r.allow.allows(name, ip, port) }) {
+			return net.JoinHostPort(ip.String(), fmt.Sprint(port)), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s for %s", ErrNotAllowed, dest, client)
+}
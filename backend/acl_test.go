@@ -0,0 +1,50 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/yixinin/puup/config"
+)
+
+func TestACLResolve(t *testing.T) {
+	acl, err := NewACL(&config.ProxyBack{
+		Allow: []string{"localhost:80", "10.0.0.0/8:*"},
+		Rules: []config.ProxyRule{
+			{Client: "loopback", Allow: []string{"127.0.0.0/8:80"}},
+			{Client: "lan", Allow: []string{"10.0.0.0/8:*"}},
+			{Client: "named", Allow: []string{"*.example.com:*"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx = context.Background()
+	for _, c := range []struct {
+		client, host string
+		port         uint16
+		want         string
+	}{
+		// the name rule passes the name, the cidr the address it resolved to, which is dialed
+		{"loopback", "localhost", 80, "127.0.0.1:80"},
+		{"lan", "localhost", 80, ""},
+		{"loopback", "localhost", 81, ""},
+		{"lan", "10.1.2.3", 22, "10.1.2.3:22"},
+		{"loopback", "10.1.2.3", 80, ""},
+		// an ip never passes a name rule
+		{"named", "10.1.2.3", 443, ""},
+		{"other", "localhost", 80, ""},
+	} {
+		addr, err := acl.Resolve(ctx, c.client, c.host, c.port)
+		if c.want == "" {
+			if !errors.Is(err, ErrNotAllowed) {
+				t.Fatalf("%s to %s:%d got %q %v, want not allowed", c.client, c.host, c.port, addr, err)
+			}
+			continue
+		}
+		if err != nil || addr != c.want {
+			t.Fatalf("%s to %s:%d got %q %v, want %s", c.client, c.host, c.port, addr, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/yixinin/puup/stderr"
+)
+
+// allowRule matches a destination, host is "*", an ip, a cidr, a domain or "*.domain",
+// port is "*", a port or a "min-max" range.
+type allowRule struct {
+	host     string
+	cidr     *net.IPNet
+	min, max uint16
+}
+
+func parseAllowRule(s string) (*allowRule, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	var r = &allowRule{host: strings.ToLower(host), max: 65535}
+	if _, cidr, err := net.ParseCIDR(host); err == nil {
+		r.cidr = cidr
+	}
+	if port != "*" {
+		lo, hi, isRange := strings.Cut(port, "-")
+		min, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, stderr.New("invalid allow port " + port)
+		}
+		max := min
+		if isRange {
+			if max, err = strconv.ParseUint(hi, 10, 16); err != nil || max < min {
+				return nil, stderr.New("invalid allow port " + port)
+			}
+		}
+		r.min, r.max = uint16(min), uint16(max)
+	}
+	return r, nil
+}
+
+func (r *allowRule) matchPort(port uint16) bool {
+	return port >= r.min && port <= r.max
+}
+
+func (r *allowRule) matchName(host string) bool {
+	switch {
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	return r.host == host
+}
+
+func (r *allowRule) matchIP(ip net.IP) bool {
+	if r.cidr != nil {
+		return r.cidr.Contains(ip)
+	}
+	if rip := net.ParseIP(r.host); rip != nil {
+		return rip.Equal(ip)
+	}
+	return r.host == "*"
+}
+
+// AllowList decides which host:port the frontends may reach through the backend.
+type AllowList struct {
+	rules []*allowRule
+}
+
+func NewAllowList(rules []string) (*AllowList, error) {
+	var l = &AllowList{}
+	for _, s := range rules {
+		r, err := parseAllowRule(s)
+		if err != nil {
+			return nil, err
+		}
+		l.rules = append(l.rules, r)
+	}
+	return l, nil
+}
+
+func (l *AllowList) allowsPort(port uint16) bool {
+	for _, r := range l.rules {
+		if r.matchPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether a rule passes the destination, name rules match the host name
+// and ip rules the address it resolved to, name is empty if the host was an ip.
+func (l *AllowList) allows(name string, ip net.IP, port uint16) bool {
+	for _, r := range l.rules {
+		if !r.matchPort(port) {
+			continue
+		}
+		if r.matchIP(ip) || name != "" && r.cidr == nil && r.matchName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup resolves host once, the rules are all checked against its addresses
+// and one of them is dialed, so a second answer of the name cannot change the ip.
+func lookup(ctx context.Context, host string) (string, []net.IP, error) {
+	var name = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(name); ip != nil {
+		return "", []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return "", nil, err
+	}
+	var ips = make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return name, ips, nil
+}
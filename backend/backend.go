@@ -6,7 +6,11 @@ import (
 
 	// This is required to use H264 video encoder
 	_ "github.com/pion/mediadevices/pkg/driver/camera" // This is required to register camera adapter
+	"github.com/sirupsen/logrus"
 	"github.com/yixinin/puup/config"
+	"github.com/yixinin/puup/ice"
+	"github.com/yixinin/puup/identity"
+	"github.com/yixinin/puup/metrics"
 	pnet "github.com/yixinin/puup/net"
 	"github.com/yixinin/puup/net/conn"
 )
@@ -17,6 +21,8 @@ type Backend struct {
 	file  *FileServer
 	proxy *ProxyServer
 	close chan struct{}
+
+	metrics string
 }
 
 func NewBackend(filename string) (*Backend, error) {
@@ -24,17 +30,53 @@ func NewBackend(filename string) (*Backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	b := &Backend{}
+	b := &Backend{metrics: cfg.Metrics}
+
+	cert, err := identity.LoadCertificate(cfg.Identity)
+	if err != nil {
+		return nil, err
+	}
+	fp, err := identity.Fingerprint(cert)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("backend %s fingerprint: %s", cfg.ServerName, fp)
 
-	lis := pnet.NewListener(cfg.SigAddr, cfg.ServerName)
-	b.proxy = NewProxy(cfg, lis)
+	iceCfg, err := ice.NewConfiguration(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ice.SetConfig(iceCfg)
+	if cfg.ReconnectGrace != 0 {
+		conn.ReconnectGrace = cfg.ReconnectGrace
+	}
+	if cfg.KeepaliveInterval > 0 {
+		conn.KeepaliveInterval = cfg.KeepaliveInterval
+	}
+	if cfg.KeepaliveMaxMissed != 0 {
+		conn.KeepaliveMaxMissed = cfg.KeepaliveMaxMissed
+	}
+	if fc := cfg.FlowControl; fc != nil {
+		conn.SetFlowControl(fc.SendHighWater, fc.SendLowWater, fc.RecvWindow)
+	}
+	lis := pnet.NewListener(cfg.SigAddr, cfg.ServerName, cfg.Token, cert)
+	if b.proxy, err = NewProxy(cfg, lis); err != nil {
+		return nil, err
+	}
 	b.web = NewWebServer(cfg, lis)
-	b.file = NewFileServer(cfg, lis)
+	if b.file, err = NewFileServer(cfg, lis); err != nil {
+		return nil, err
+	}
 	b.ssh = NewSshServer(cfg, lis)
 	return b, nil
 }
 
 func (b *Backend) Run(ctx context.Context) error {
+	if b.metrics != "" {
+		conn.GoFunc(ctx, func(ctx context.Context) error {
+			return metrics.Serve(b.metrics)
+		})
+	}
 	var wg sync.WaitGroup
 	wg.Add(4)
 	conn.GoFunc(ctx, func(ctx context.Context) error {
@@ -3,162 +3,498 @@ package backend
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/sirupsen/logrus"
 	"github.com/yixinin/puup/config"
+	"github.com/yixinin/puup/db"
 	"github.com/yixinin/puup/db/file"
+	"github.com/yixinin/puup/delta"
 	pnet "github.com/yixinin/puup/net"
+	"github.com/yixinin/puup/net/conn"
 	"github.com/yixinin/puup/preview"
+	"github.com/yixinin/puup/proto"
 	"github.com/yixinin/puup/stderr"
 )
 
+var (
+	// UploadExpire is how long an unfinished upload can be resumed.
+	UploadExpire = 24 * time.Hour
+	// UploadSweep is how often the expired partial files are removed.
+	UploadSweep = time.Hour
+)
+
 type FileServer struct {
 	lis *pnet.Listener
-}
-
-func NewFileServer(cfg *config.Config, lis *pnet.Listener) *FileServer {
-	return &FileServer{lis: lis}
-}
+	dir string
 
-type UploadReq struct {
-	Path     string        `json:"path"`
-	Size     uint64        `json:"size"`
-	Etag     string        `json:"etag"`
-	FileType file.FileType `json:"type"`
-	StartAt  uint64        `json:"start"`
+	mu        sync.Mutex
+	uploading map[string]bool
+	released  map[string]file.UserFile // contents released while locked, collected on unlock
 }
 
-type UploadAck struct {
-	Code int    `json:"code,omitempty"`
-	Path string `json:"path,omitempty"`
-	Etag string `json:"etag,omitempty"`
-}
-
-type DownloadReq struct {
-}
-type DownloadAck struct {
-	Etag string
-	Size string
+func NewFileServer(cfg *config.Config, lis *pnet.Listener) (*FileServer, error) {
+	s := &FileServer{lis: lis, dir: cfg.Files, uploading: make(map[string]bool), released: make(map[string]file.UserFile)}
+	if s.dir == "" {
+		return s, nil
+	}
+	for _, sub := range []string{"files", "previews", "partial"} {
+		if err := os.MkdirAll(filepath.Join(s.dir, sub), 0755); err != nil {
+			return nil, stderr.Wrap(err)
+		}
+	}
+	if err := db.Init(filepath.Join(s.dir, "db")); err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	return s, nil
 }
 
 func (s *FileServer) Run(ctx context.Context) error {
+	if s.dir != "" {
+		conn.GoFunc(ctx, s.sweep)
+	}
 	for {
-		conn, err := s.lis.AcceptFile()
-		if err != nil {
-			return err
-		}
-		err = s.ServeConn(ctx, conn)
+		rconn, err := s.lis.AcceptFile()
 		if err != nil {
 			return err
 		}
+		go func() {
+			defer rconn.(*pnet.Conn).Release()
+			s.ServeConn(ctx, rconn)
+		}()
 	}
 }
 
-func (s *FileServer) ServeConn(ctx context.Context, rconn net.Conn) error {
-	defer func() {
-		rconn.(*pnet.Conn).Release()
-	}()
-	var req UploadReq
-	data, _, err := bufio.NewReader(rconn).ReadLine()
-	if err != nil {
-		return err
+func (s *FileServer) ServeConn(ctx context.Context, rconn net.Conn) {
+	var req proto.FileReq
+	if err := proto.ReadFrame(rconn, &req); err != nil {
+		logrus.Errorf("read file request error:%v", err)
+		return
 	}
-	err = json.Unmarshal(data, &req)
-	if err != nil {
-		return err
+	req.Path = strings.Trim(path.Clean("/"+req.Path), "/")
+	switch req.Op {
+	case "", proto.FileUpload:
+	case proto.FileDownload:
+		if err := s.download(ctx, rconn, req); err != nil {
+			logrus.Errorf("download %s failed:%v", req.Path, err)
+		}
+		return
+	case proto.FileList:
+		if err := s.list(ctx, rconn, req); err != nil {
+			logrus.Errorf("list %s failed:%v", req.Path, err)
+		}
+		return
+	case proto.FileDelete:
+		if err := s.delete(ctx, rconn, req); err != nil {
+			logrus.Errorf("delete %s failed:%v", req.Path, err)
+		}
+		return
+	default:
+		proto.WriteFrame(rconn, proto.UploadAck{Code: proto.FileBadRequest, Msg: "unknown op"})
+		return
 	}
-
 	ack, err := s.upload(ctx, rconn, req)
 	if err != nil {
-		logrus.Error("upload failed:%v", err)
+		logrus.Errorf("upload %s failed:%v", req.Path, err)
+	}
+	if err := proto.WriteFrame(rconn, ack); err != nil {
+		logrus.Errorf("write upload ack error:%v", err)
 	}
-	data, _ = json.Marshal(ack)
-	_, err = rconn.Write(data)
-	return err
 }
 
-func (f *FileServer) upload(ctx context.Context, r net.Conn, req UploadReq) (UploadAck, error) {
-	var ack = UploadAck{}
-	// check
-	realFile, err := file.GetStorage().GetFile(ctx, req.Etag, req.Size)
-	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
-		return ack, err
+// upload sends the offset the partial file has reached, appends the rest of the content
+// and stores the file once its sha-256 matches the etag.
+func (s *FileServer) upload(ctx context.Context, rw io.ReadWriter, req proto.FileReq) (proto.UploadAck, error) {
+	req.Etag = strings.ToLower(req.Etag)
+	var ack = proto.UploadAck{Path: req.Path, Etag: req.Etag}
+	switch {
+	case s.dir == "":
+		ack.Code, ack.Msg = proto.FileDisabled, "file server disabled"
+		return ack, nil
+	case req.Path == "" || !validEtag(req.Etag):
+		ack.Code, ack.Msg = proto.FileBadRequest, "bad path or etag"
+		return ack, nil
 	}
-	var fs *os.File
-	var previewPath, filename = file.GetFileName(req.Etag, req.Size, filepath.Ext(req.Path))
-	if req.StartAt == 0 {
-		// exists, copy file
-		if err == nil {
-			uf := file.CopyFile(realFile, req.Path)
-			err = file.GetStorage().InsertUserFile(ctx, uf)
-			if err != nil {
-				return ack, err
-			}
-			ack.Etag = req.Etag
-			ack.Path = req.Path
-			return ack, nil
-		}
+	var key = file.GetFileKey(req.Etag, req.Size)
+	if !s.lock(key) {
+		ack.Code, ack.Msg = proto.FileBusy, "uploading by another channel"
+		return ack, nil
+	}
+	defer s.unlock(key)
 
-		// new file
-		realFile = file.File{
-			Etag: req.Etag,
-			Type: req.FileType,
-			Size: req.Size,
-			Path: filename,
-		}
-		if req.FileType == file.TypeImage || req.FileType == file.TypeVideo {
-			realFile.PreviewPath = previewPath
-		}
-		err = file.GetStorage().InsertFile(ctx, realFile)
-		if err != nil {
+	var typ = file.FileType(req.Type)
+	if typ == 0 {
+		typ = file.TypeOf(req.Path)
+	}
+	// the same content is stored already
+	realFile, err := file.GetStorage().GetFile(ctx, req.Etag, req.Size)
+	if err == nil {
+		ack.Offset = req.Size
+		if err := proto.WriteFrame(rw, ack); err != nil {
 			return ack, err
 		}
-		fs, err = os.Create(filename)
-	} else {
-		if err != nil {
-			return ack, stderr.Wrap(err)
-		}
-		fs, err = os.Open(filename)
-		if err != nil {
-			return ack, stderr.Wrap(err)
-		}
-		_, err = fs.Seek(int64(req.StartAt), io.SeekStart)
+		return s.addUserFile(ctx, ack, req, realFile)
 	}
-	if err != nil {
-		return ack, stderr.Wrap(err)
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return internalError(ack, err)
 	}
 
+	var partial = file.GetPartialName(s.dir, req.Etag, req.Size)
+	fs, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return internalError(ack, err)
+	}
 	defer fs.Close()
-	_, err = io.Copy(fs, r)
+	info, err := fs.Stat()
+	if err != nil {
+		return internalError(ack, err)
+	}
+	if uint64(info.Size()) > req.Size {
+		if err := fs.Truncate(0); err != nil {
+			return internalError(ack, err)
+		}
+	} else {
+		ack.Offset = uint64(info.Size())
+	}
+	err = file.GetStorage().SetUpload(ctx, file.Upload{
+		Etag:       req.Etag,
+		Size:       req.Size,
+		Path:       req.Path,
+		Type:       typ,
+		UpdateTime: time.Now().Unix(),
+	}, UploadExpire)
 	if err != nil {
+		return internalError(ack, err)
+	}
+	// the hash of the bytes already written, the file is left at the offset
+	var hash = sha256.New()
+	if _, err := io.CopyN(hash, fs, int64(ack.Offset)); err != nil {
+		return internalError(ack, err)
+	}
+	// a new upload replacing a file may be sent as a delta to it
+	var base *os.File
+	var sig *delta.Signature
+	if req.Delta && ack.Offset == 0 {
+		if base, sig = s.deltaBase(ctx, req.Path); base != nil {
+			defer base.Close()
+			ack.Delta = true
+		}
+	}
+	if err := proto.WriteFrame(rw, ack); err != nil {
 		return ack, err
 	}
-	if err := fs.Close(); err != nil {
+	if ack.Delta {
+		if _, err = sig.WriteTo(rw); err == nil {
+			err = delta.Patch(io.MultiWriter(fs, hash), base, sig.BlockSize, rw)
+		}
+	} else {
+		_, err = io.CopyN(io.MultiWriter(fs, hash), rw, int64(req.Size-ack.Offset))
+	}
+	if err != nil {
+		ack.Code, ack.Msg = proto.FileError, "upload interrupted"
 		return ack, stderr.Wrap(err)
 	}
+	if err := fs.Close(); err != nil {
+		return internalError(ack, err)
+	}
 
-	switch req.FileType {
+	file.GetStorage().DeleteUpload(ctx, req.Etag, req.Size)
+	if hex.EncodeToString(hash.Sum(nil)) != req.Etag {
+		os.Remove(partial)
+		ack.Code, ack.Msg = proto.FileMismatch, "content does not match etag"
+		return ack, nil
+	}
+	filename, previewPath := file.GetFileName(s.dir, req.Etag, req.Size, filepath.Ext(req.Path))
+	if err := os.Rename(partial, filename); err != nil {
+		return internalError(ack, err)
+	}
+	realFile = file.File{
+		Etag: req.Etag,
+		Type: typ,
+		Size: req.Size,
+		Path: filename,
+	}
+	switch typ {
 	case file.TypeImage:
 		err = preview.SaveImagePreview(filename, previewPath)
 	case file.TypeVideo:
 		err = preview.SaveVideoPreview(filename, previewPath, 60)
 	}
 	if err != nil {
-		return ack, err
+		logrus.Errorf("save preview of %s error:%v", req.Path, err)
+	} else if typ == file.TypeImage || typ == file.TypeVideo {
+		realFile.PreviewPath = previewPath
+	}
+	if err := file.GetStorage().InsertFile(ctx, realFile); err != nil {
+		return internalError(ack, err)
 	}
+	return s.addUserFile(ctx, ack, req, realFile)
+}
 
-	err = file.GetStorage().InsertUserFile(ctx, file.CopyFile(realFile, req.Path))
+// download sends the content of req.Path from req.Offset,
+// or from the start if it is not the content req.Etag any more.
+func (s *FileServer) download(ctx context.Context, rw io.ReadWriter, req proto.FileReq) error {
+	var ack proto.DownloadAck
+	// the signature is sent with the request, it is read before any ack
+	var sig *delta.Signature
+	if req.Delta {
+		var err error
+		if sig, err = delta.ReadSignature(rw); err != nil {
+			return err
+		}
+	}
+	if s.dir == "" {
+		ack.Code, ack.Msg = proto.FileDisabled, "file server disabled"
+		return proto.WriteFrame(rw, ack)
+	}
+	uf, err := file.GetStorage().GetUserFile(ctx, req.Path)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		ack.Code, ack.Msg = proto.FileNotFound, "file not found"
+		return proto.WriteFrame(rw, ack)
+	}
 	if err != nil {
-		return ack, err
+		return downloadError(rw, err)
+	}
+	ack.Size, ack.Etag, ack.Mode, ack.ModTime = uf.Size, uf.Etag, uf.Mode, uf.ModTime
+	if strings.EqualFold(req.Etag, uf.Etag) {
+		ack.Offset = req.Offset
+	}
+	if ack.Offset > ack.Size {
+		ack.Code, ack.Msg = proto.FileBadRequest, "offset out of range"
+		return proto.WriteFrame(rw, ack)
+	}
+	fs, err := os.Open(uf.RealPath)
+	if err != nil {
+		return downloadError(rw, err)
+	}
+	defer fs.Close()
+	if _, err := fs.Seek(int64(ack.Offset), io.SeekStart); err != nil {
+		return downloadError(rw, err)
+	}
+	ack.Delta = sig != nil && ack.Offset == 0
+	if err := proto.WriteFrame(rw, ack); err != nil {
+		return err
+	}
+	if ack.Delta {
+		stats, err := delta.Encode(rw, sig, fs)
+		logrus.Debugf("download %s as delta, literal:%d copied:%d", req.Path, stats.Literal, stats.Copied)
+		return err
+	}
+	_, err = io.CopyN(rw, fs, int64(ack.Size-ack.Offset))
+	return err
+}
+
+// deltaBase opens and signs the content of path, nil if there is none.
+func (s *FileServer) deltaBase(ctx context.Context, path string) (*os.File, *delta.Signature) {
+	uf, err := file.GetStorage().GetUserFile(ctx, path)
+	if err != nil {
+		return nil, nil
+	}
+	f, err := os.Open(uf.RealPath)
+	if err != nil {
+		logrus.Errorf("open delta base %s error:%v", path, err)
+		return nil, nil
+	}
+	sig, err := delta.Sign(bufio.NewReader(f), delta.BlockSize(int64(uf.Size)))
+	if err != nil {
+		f.Close()
+		logrus.Errorf("sign delta base %s error:%v", path, err)
+		return nil, nil
+	}
+	return f, sig
+}
+
+// addUserFile points ack.Path to realFile, the content it pointed to is released.
+func (s *FileServer) addUserFile(ctx context.Context, ack proto.UploadAck, req proto.FileReq, realFile file.File) (proto.UploadAck, error) {
+	var uf = file.CopyFile(realFile, ack.Path)
+	uf.Mode, uf.ModTime = req.Mode, req.ModTime
+	old, err := file.GetStorage().GetUserFile(ctx, ack.Path)
+	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
+		return internalError(ack, err)
+	}
+	var found = err == nil
+	var replaced = found && (old.Etag != uf.Etag || old.Size != uf.Size)
+	if found && !replaced {
+		uf.CreateTime = old.CreateTime
+	} else if _, err := file.GetStorage().IncrReference(ctx, realFile.Etag, realFile.Size, 1); err != nil {
+		return internalError(ack, err)
+	}
+	if err := file.GetStorage().InsertUserFile(ctx, uf); err != nil {
+		return internalError(ack, err)
+	}
+	if replaced {
+		s.release(ctx, old)
 	}
-	ack.Etag = req.Etag
-	ack.Path = req.Path
 	return ack, nil
 }
+
+// release removes the content of uf once no user file points to it.
+func (s *FileServer) release(ctx context.Context, uf file.UserFile) {
+	ref, err := file.GetStorage().IncrReference(ctx, uf.Etag, uf.Size, -1)
+	if err != nil {
+		logrus.Errorf("release %s error:%v", uf.Path, err)
+		return
+	}
+	if ref > 0 {
+		return
+	}
+	s.collect(ctx, uf)
+}
+
+// collect deletes the content of uf if it has no reference,
+// content being uploaded again is collected when the upload unlocks it.
+func (s *FileServer) collect(ctx context.Context, uf file.UserFile) {
+	var key = file.GetFileKey(uf.Etag, uf.Size)
+	s.mu.Lock()
+	if s.uploading[key] {
+		s.released[key] = uf
+		s.mu.Unlock()
+		return
+	}
+	s.uploading[key] = true
+	s.mu.Unlock()
+	defer s.unlock(key)
+	f, err := file.GetStorage().GetFile(ctx, uf.Etag, uf.Size)
+	if errors.Is(err, badger.ErrKeyNotFound) || err == nil && f.Reference > 0 {
+		return
+	}
+	if err == nil {
+		err = file.GetStorage().DeleteFile(ctx, uf.Etag, uf.Size)
+	}
+	if err != nil {
+		logrus.Errorf("delete file %s error:%v", key, err)
+		return
+	}
+	os.Remove(uf.RealPath)
+	if uf.PreviewPath != "" {
+		os.Remove(uf.PreviewPath)
+	}
+}
+
+// list sends the user files under req.Path with their paths relative to it.
+func (s *FileServer) list(ctx context.Context, w io.Writer, req proto.FileReq) error {
+	if s.dir == "" {
+		return proto.WriteFrame(w, proto.ListAck{Code: proto.FileDisabled, Msg: "file server disabled"})
+	}
+	ufs, err := file.GetStorage().ListUserFiles(ctx, req.Path)
+	if err != nil {
+		proto.WriteFrame(w, proto.ListAck{Code: proto.FileError, Msg: "internal error"})
+		return err
+	}
+	if err := proto.WriteFrame(w, proto.ListAck{Count: len(ufs)}); err != nil {
+		return err
+	}
+	var dir = strings.Trim(req.Path, "/")
+	for _, uf := range ufs {
+		var rel = strings.TrimPrefix(strings.TrimPrefix(uf.Path, dir), "/")
+		err := proto.WriteFrame(w, proto.FileInfo{
+			Path:    rel,
+			Size:    uf.Size,
+			Etag:    uf.Etag,
+			Mode:    uf.Mode,
+			ModTime: uf.ModTime,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileServer) delete(ctx context.Context, w io.Writer, req proto.FileReq) error {
+	if s.dir == "" {
+		return proto.WriteFrame(w, proto.FileAck{Code: proto.FileDisabled, Msg: "file server disabled"})
+	}
+	uf, err := file.GetStorage().GetUserFile(ctx, req.Path)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return proto.WriteFrame(w, proto.FileAck{Code: proto.FileNotFound, Msg: "file not found"})
+	}
+	if err == nil {
+		err = file.GetStorage().DeleteUserFile(ctx, req.Path)
+	}
+	if err != nil {
+		proto.WriteFrame(w, proto.FileAck{Code: proto.FileError, Msg: "internal error"})
+		return err
+	}
+	s.release(ctx, uf)
+	return proto.WriteFrame(w, proto.FileAck{})
+}
+
+func (s *FileServer) lock(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploading[key] {
+		return false
+	}
+	s.uploading[key] = true
+	return true
+}
+
+func (s *FileServer) unlock(key string) {
+	s.mu.Lock()
+	delete(s.uploading, key)
+	uf, released := s.released[key]
+	delete(s.released, key)
+	s.mu.Unlock()
+	if released {
+		s.collect(context.Background(), uf)
+	}
+}
+
+// sweep removes the partial files whose upload has expired.
+func (s *FileServer) sweep(ctx context.Context) error {
+	var tk = time.NewTicker(UploadSweep)
+	defer tk.Stop()
+	for {
+		entries, err := os.ReadDir(filepath.Join(s.dir, "partial"))
+		if err != nil {
+			return stderr.Wrap(err)
+		}
+		for _, e := range entries {
+			etag, sizeStr, _ := strings.Cut(e.Name(), "_")
+			size, err := strconv.ParseUint(sizeStr, 10, 64)
+			if err != nil || !s.lock(file.GetFileKey(etag, size)) {
+				continue
+			}
+			_, err = file.GetStorage().GetUpload(ctx, etag, size)
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				logrus.Infof("remove expired upload %s", e.Name())
+				os.Remove(filepath.Join(s.dir, "partial", e.Name()))
+			}
+			s.unlock(file.GetFileKey(etag, size))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tk.C:
+		}
+	}
+}
+
+func validEtag(etag string) bool {
+	b, err := hex.DecodeString(etag)
+	return err == nil && len(b) == sha256.Size
+}
+
+// internalError hides err from the client, it has the local paths and stack.
+func internalError(ack proto.UploadAck, err error) (proto.UploadAck, error) {
+	ack.Code, ack.Msg = proto.FileError, "internal error"
+	return ack, stderr.Wrap(err)
+}
+
+func downloadError(w io.Writer, err error) error {
+	proto.WriteFrame(w, proto.DownloadAck{Code: proto.FileError, Msg: "internal error"})
+	return stderr.Wrap(err)
+}
@@ -0,0 +1,331 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yixinin/puup/config"
+	"github.com/yixinin/puup/db/file"
+	"github.com/yixinin/puup/delta"
+	"github.com/yixinin/puup/proto"
+)
+
+func TestUploadResume(t *testing.T) {
+	s, err := NewFileServer(&config.Config{Files: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx = context.Background()
+	var content = bytes.Repeat([]byte("puup"), 10000)
+	var sum = sha256.Sum256(content)
+	var req = proto.FileReq{Path: "a/b.bin", Size: uint64(len(content)), Etag: hex.EncodeToString(sum[:])}
+
+	// send half of the content and drop the connection
+	client, server := net.Pipe()
+	var done = make(chan struct{})
+	go func() {
+		s.ServeConn(ctx, server)
+		close(done)
+	}()
+	if ack := startUpload(t, client, req); ack.Offset != 0 {
+		t.Fatalf("offset %d of a new upload", ack.Offset)
+	}
+	client.Write(content[:len(content)/2])
+	client.Close()
+	<-done
+
+	client, server = net.Pipe()
+	go s.ServeConn(ctx, server)
+	ack := startUpload(t, client, req)
+	if ack.Offset != uint64(len(content)/2) {
+		t.Fatalf("resumed at %d, want %d", ack.Offset, len(content)/2)
+	}
+	client.Write(content[ack.Offset:])
+	if err := proto.ReadFrame(client, &ack); err != nil || ack.Code != proto.FileOk {
+		t.Fatalf("upload ack %+v error %v", ack, err)
+	}
+	uf, err := file.GetStorage().GetUserFile(ctx, req.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(uf.RealPath); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("stored content differs, error %v", err)
+	}
+
+	// the stored content is not sent again
+	req.Path = "c.bin"
+	client, server = net.Pipe()
+	go s.ServeConn(ctx, server)
+	if ack := startUpload(t, client, req); ack.Offset != req.Size {
+		t.Fatalf("offset %d of stored content", ack.Offset)
+	}
+	if err := proto.ReadFrame(client, &ack); err != nil || ack.Code != proto.FileOk {
+		t.Fatalf("copy ack %+v error %v", ack, err)
+	}
+
+	// content not matching the etag is refused
+	sum = sha256.Sum256([]byte("other"))
+	req = proto.FileReq{Path: "d.bin", Size: uint64(len(content)), Etag: hex.EncodeToString(sum[:])}
+	client, server = net.Pipe()
+	go s.ServeConn(ctx, server)
+	startUpload(t, client, req)
+	client.Write(content)
+	if err := proto.ReadFrame(client, &ack); err != nil || ack.Code != proto.FileMismatch {
+		t.Fatalf("mismatch ack %+v error %v", ack, err)
+	}
+	if _, err := os.Stat(file.GetPartialName(s.dir, req.Etag, req.Size)); !os.IsNotExist(err) {
+		t.Fatalf("partial file kept, error %v", err)
+	}
+}
+
+func startUpload(t *testing.T, rw io.ReadWriter, req proto.FileReq) proto.UploadAck {
+	if err := proto.WriteFrame(rw, req); err != nil {
+		t.Fatal(err)
+	}
+	var ack proto.UploadAck
+	if err := proto.ReadFrame(rw, &ack); err != nil || ack.Code != proto.FileOk {
+		t.Fatalf("offset ack %+v error %v", ack, err)
+	}
+	return ack
+}
+
+func TestDownload(t *testing.T) {
+	s, err := NewFileServer(&config.Config{Files: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx = context.Background()
+	var content = bytes.Repeat([]byte("0123456789"), 1000)
+	var sum = sha256.Sum256(content)
+	var etag = hex.EncodeToString(sum[:])
+	client, server := net.Pipe()
+	go s.ServeConn(ctx, server)
+	startUpload(t, client, proto.FileReq{Path: "x.txt", Size: uint64(len(content)), Etag: etag})
+	client.Write(content)
+	var uack proto.UploadAck
+	if err := proto.ReadFrame(client, &uack); err != nil || uack.Code != proto.FileOk {
+		t.Fatalf("upload ack %+v error %v", uack, err)
+	}
+
+	for _, c := range []struct {
+		req  proto.FileReq
+		code int
+		from uint64
+	}{
+		{proto.FileReq{Path: "x.txt"}, proto.FileOk, 0},
+		{proto.FileReq{Path: "x.txt", Etag: etag, Offset: 4000}, proto.FileOk, 4000},
+		{proto.FileReq{Path: "x.txt", Etag: "changed", Offset: 4000}, proto.FileOk, 0},
+		{proto.FileReq{Path: "x.txt", Etag: etag, Offset: 20000}, proto.FileBadRequest, 0},
+		{proto.FileReq{Path: "y.txt"}, proto.FileNotFound, 0},
+	} {
+		c.req.Op = proto.FileDownload
+		client, server := net.Pipe()
+		go s.ServeConn(ctx, server)
+		proto.WriteFrame(client, c.req)
+		var ack proto.DownloadAck
+		if err := proto.ReadFrame(client, &ack); err != nil || ack.Code != c.code {
+			t.Fatalf("%+v: ack %+v error %v", c.req, ack, err)
+		}
+		if ack.Code != proto.FileOk {
+			continue
+		}
+		if ack.Offset != c.from || ack.Etag != etag || ack.Size != uint64(len(content)) {
+			t.Fatalf("%+v: ack %+v", c.req, ack)
+		}
+		var data = make([]byte, ack.Size-ack.Offset)
+		if _, err := io.ReadFull(client, data); err != nil || !bytes.Equal(data, content[c.from:]) {
+			t.Fatalf("%+v: got %d bytes error %v", c.req, len(data), err)
+		}
+	}
+
+	e := gin.New()
+	initFile(e)
+	for _, c := range []struct {
+		header map[string]string
+		status int
+		body   string
+	}{
+		{nil, http.StatusOK, string(content)},
+		{map[string]string{"Range": "bytes=10-14"}, http.StatusPartialContent, "01234"},
+		{map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "789"},
+		{map[string]string{"Range": "bytes=0-1,5-6", "If-Range": `"` + etag + `"`}, http.StatusPartialContent, ""},
+		{map[string]string{"Range": "bytes=10-14", "If-Range": `"stale"`}, http.StatusOK, string(content)},
+		{map[string]string{"Range": "bytes=20000-"}, http.StatusRequestedRangeNotSatisfiable, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/file/x.txt", nil)
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%v: status %d", c.header, w.Code)
+		}
+		if c.body != "" && w.Body.String() != c.body {
+			t.Fatalf("%v: body %q", c.header, w.Body.String())
+		}
+		if strings.Contains(c.header["Range"], ",") && !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") {
+			t.Fatalf("%v: content type %s", c.header, w.Header().Get("Content-Type"))
+		}
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/file/x.txt", nil))
+	if w.Header().Get("ETag") != `"`+etag+`"` || w.Header().Get("Digest") != "sha-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("head headers %v", w.Header())
+	}
+}
+
+func TestListDelete(t *testing.T) {
+	s, err := NewFileServer(&config.Config{Files: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx = context.Background()
+	storeContent(t, s, proto.FileReq{Path: "d/a.txt", Mode: 0600, ModTime: 42}, "shared")
+	storeContent(t, s, proto.FileReq{Path: "/d//b.txt"}, "shared")
+	storeContent(t, s, proto.FileReq{Path: "d/c.txt"}, "first")
+	first, err := file.GetStorage().GetUserFile(ctx, "d/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the replaced content has no user file left
+	storeContent(t, s, proto.FileReq{Path: "d/c.txt"}, "second")
+	if _, err := os.Stat(first.RealPath); !os.IsNotExist(err) {
+		t.Fatalf("replaced content kept, error %v", err)
+	}
+
+	client, server := net.Pipe()
+	go s.ServeConn(ctx, server)
+	proto.WriteFrame(client, proto.FileReq{Op: proto.FileList, Path: "d/"})
+	var ack proto.ListAck
+	if err := proto.ReadFrame(client, &ack); err != nil || ack.Code != proto.FileOk || ack.Count != 3 {
+		t.Fatalf("list ack %+v error %v", ack, err)
+	}
+	var infos = make(map[string]proto.FileInfo)
+	for i := 0; i < ack.Count; i++ {
+		var info proto.FileInfo
+		if err := proto.ReadFrame(client, &info); err != nil {
+			t.Fatal(err)
+		}
+		infos[info.Path] = info
+	}
+	if a := infos["a.txt"]; a.Mode != 0600 || a.ModTime != 42 || a.Size != 6 || infos["b.txt"].Etag != a.Etag || infos["c.txt"].Size != 6 {
+		t.Fatalf("listed %+v", infos)
+	}
+
+	shared, _ := file.GetStorage().GetUserFile(ctx, "d/a.txt")
+	for _, name := range []string{"d/a.txt", "d/b.txt"} {
+		if _, err := os.Stat(shared.RealPath); err != nil {
+			t.Fatalf("content removed before %s is deleted", name)
+		}
+		client, server := net.Pipe()
+		go s.ServeConn(ctx, server)
+		proto.WriteFrame(client, proto.FileReq{Op: proto.FileDelete, Path: name})
+		var ack proto.FileAck
+		if err := proto.ReadFrame(client, &ack); err != nil || ack.Code != proto.FileOk {
+			t.Fatalf("delete ack %+v error %v", ack, err)
+		}
+	}
+	if _, err := os.Stat(shared.RealPath); !os.IsNotExist(err) {
+		t.Fatalf("deleted content kept, error %v", err)
+	}
+
+	// content released during an upload of it is removed when the upload ends
+	storeContent(t, s, proto.FileReq{Path: "d/e.txt"}, "uploading")
+	uploading, _ := file.GetStorage().GetUserFile(ctx, "d/e.txt")
+	var key = file.GetFileKey(uploading.Etag, uploading.Size)
+	s.lock(key)
+	client, server = net.Pipe()
+	go s.ServeConn(ctx, server)
+	proto.WriteFrame(client, proto.FileReq{Op: proto.FileDelete, Path: "d/e.txt"})
+	var deleteAck proto.FileAck
+	if err := proto.ReadFrame(client, &deleteAck); err != nil || deleteAck.Code != proto.FileOk {
+		t.Fatalf("delete ack %+v error %v", deleteAck, err)
+	}
+	if _, err := os.Stat(uploading.RealPath); err != nil {
+		t.Fatal("content removed while locked")
+	}
+	s.unlock(key)
+	if _, err := os.Stat(uploading.RealPath); !os.IsNotExist(err) {
+		t.Fatalf("released content kept after unlock, error %v", err)
+	}
+}
+
+func storeContent(t *testing.T, s *FileServer, req proto.FileReq, content string) {
+	var sum = sha256.Sum256([]byte(content))
+	req.Size, req.Etag = uint64(len(content)), hex.EncodeToString(sum[:])
+	client, server := net.Pipe()
+	go s.ServeConn(context.Background(), server)
+	if ack := startUpload(t, client, req); ack.Offset < req.Size {
+		client.Write([]byte(content)[ack.Offset:])
+	}
+	var ack proto.UploadAck
+	if err := proto.ReadFrame(client, &ack); err != nil || ack.Code != proto.FileOk {
+		t.Fatalf("upload ack %+v error %v", ack, err)
+	}
+}
+
+func TestDeltaTransfer(t *testing.T) {
+	s, err := NewFileServer(&config.Config{Files: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx = context.Background()
+	var old = make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(old)
+	storeContent(t, s, proto.FileReq{Path: "vm.img"}, string(old))
+	var content = bytes.Join([][]byte{old[:1000], []byte("patched"), old[1000:]}, nil)
+	var sum = sha256.Sum256(content)
+	var req = proto.FileReq{Path: "vm.img", Size: uint64(len(content)), Etag: hex.EncodeToString(sum[:]), Delta: true}
+
+	client, server := net.Pipe()
+	go s.ServeConn(ctx, server)
+	if ack := startUpload(t, client, req); !ack.Delta {
+		t.Fatalf("upload ack %+v without delta", ack)
+	}
+	sig, err := delta.ReadSignature(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := delta.Encode(client, sig, bytes.NewReader(content))
+	if err != nil || stats.Literal > int64(sig.BlockSize)+7 {
+		t.Fatalf("delta %+v error %v", stats, err)
+	}
+	var ack proto.UploadAck
+	if err := proto.ReadFrame(client, &ack); err != nil || ack.Code != proto.FileOk {
+		t.Fatalf("upload ack %+v error %v", ack, err)
+	}
+	uf, _ := file.GetStorage().GetUserFile(ctx, "vm.img")
+	if data, err := os.ReadFile(uf.RealPath); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("patched content differs, error %v", err)
+	}
+
+	// the old copy is the base of the download
+	client, server = net.Pipe()
+	go s.ServeConn(ctx, server)
+	sig, _ = delta.Sign(bytes.NewReader(old), delta.BlockSize(int64(len(old))))
+	go func() {
+		proto.WriteFrame(client, proto.FileReq{Op: proto.FileDownload, Path: "vm.img", Delta: true})
+		sig.WriteTo(client)
+	}()
+	var dack proto.DownloadAck
+	if err := proto.ReadFrame(client, &dack); err != nil || dack.Code != proto.FileOk || !dack.Delta {
+		t.Fatalf("download ack %+v error %v", dack, err)
+	}
+	var out bytes.Buffer
+	if err := delta.Patch(&out, bytes.NewReader(old), sig.BlockSize, client); err != nil || !bytes.Equal(out.Bytes(), content) {
+		t.Fatalf("downloaded content differs, error %v", err)
+	}
+}
@@ -2,77 +2,282 @@ package backend
 
 import (
 	"context"
-	"encoding/binary"
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/yixinin/puup/config"
 	pnet "github.com/yixinin/puup/net"
 	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/proto"
 	"github.com/yixinin/puup/stderr"
 )
 
+const (
+	// attachTimeout is how long an accepted reverse connection waits for the frontend channel.
+	attachTimeout = 30 * time.Second
+
+	defaultUdpIdleTimeout = 60 * time.Second
+
+	dialTimeout = 10 * time.Second
+)
+
+var ErrNotAllowed = errors.New("destination not allowed")
+
 type ProxyServer struct {
+	sync.Mutex
+
 	lis       *pnet.Listener
 	localAddr string
-	ports     map[uint16]struct{}
+	acl       *ACL
+	udpIdle   time.Duration
+
+	reverseAddr string
+	listeners   map[uint16]reverseListener
+	pending     map[string]pendingConn
+}
+
+// reverseListener is a reverse port listening for the client that opened it.
+type reverseListener struct {
+	net.Listener
+	client string
 }
 
-func NewProxy(cfg *config.Config, lis *pnet.Listener) *ProxyServer {
-	var ports = make(map[uint16]struct{})
-	for _, v := range cfg.ProxyBack.Ports {
-		ports[v] = struct{}{}
+// pendingConn is an accepted reverse connection waiting for the client to attach.
+type pendingConn struct {
+	net.Conn
+	client string
+}
+
+func NewProxy(cfg *config.Config, lis *pnet.Listener) (*ProxyServer, error) {
+	acl, err := NewACL(cfg.ProxyBack)
+	if err != nil {
+		return nil, err
+	}
+	var udpIdle = cfg.UdpIdleTimeout
+	if udpIdle <= 0 {
+		udpIdle = defaultUdpIdleTimeout
 	}
 
 	return &ProxyServer{
-		lis:       lis,
-		localAddr: cfg.ProxyBack.Addr,
-		ports:     ports,
+		lis:         lis,
+		localAddr:   cfg.ProxyBack.Addr,
+		acl:         acl,
+		udpIdle:     udpIdle,
+		reverseAddr: cfg.ProxyBack.ReverseAddr,
+		listeners:   make(map[uint16]reverseListener),
+		pending:     make(map[string]pendingConn),
+	}, nil
+}
+
+// clientId is the frontend client the channel comes from.
+func clientId(rconn net.Conn) string {
+	if addr, ok := rconn.RemoteAddr().(*conn.ClientAddr); ok {
+		return addr.ClientId
 	}
+	return ""
 }
+
 func (p *ProxyServer) Run(ctx context.Context) error {
+	conn.GoFunc(ctx, p.runDatagram)
 	for {
 		rconn, err := p.lis.AcceptProxy()
 		if err != nil {
 			return stderr.Wrap(err)
 		}
-		if err := p.ServeConn(ctx, rconn); err != nil {
-			return err
-		}
+		conn.GoFunc(ctx, func(ctx context.Context) error {
+			return p.ServeConn(ctx, rconn)
+		})
 	}
 }
 
-type ProxyHeader struct {
-	Port uint16 `json:"port"`
+func (p *ProxyServer) ServeConn(ctx context.Context, rconn net.Conn) error {
+	logrus.Debugf("proxy from %s, read header", rconn.RemoteAddr())
+	var header proto.ProxyHeader
+	if err := proto.ReadFrame(rconn, &header); err != nil {
+		rconn.(*pnet.Conn).Release()
+		return stderr.Wrap(err)
+	}
+	logrus.Debugf("proxy %s header:%+v", rconn.RemoteAddr(), header)
+	if header.Version != proto.ProxyVersion {
+		p.reject(rconn, proto.ProxyBadHeader, "unsupported proxy version "+strconv.Itoa(header.Version))
+		return stderr.New("unsupported proxy version " + strconv.Itoa(header.Version))
+	}
+	switch header.Mode {
+	case "", proto.ProxyForward:
+		return p.forward(rconn, header)
+	case proto.ProxyListen:
+		return p.listen(rconn, header)
+	case proto.ProxyAttach:
+		return p.attach(rconn, header)
+	}
+	p.reject(rconn, proto.ProxyBadHeader, "unknown proxy mode "+string(header.Mode))
+	return stderr.New("unknown proxy mode " + string(header.Mode))
 }
 
-func (p *ProxyServer) ServeConn(ctx context.Context, rconn net.Conn) error {
-	logrus.Debugf("proxy from %s, read port", rconn.RemoteAddr())
-	var header = make([]byte, 2)
-	n, err := rconn.Read(header)
+// reject answers the header with code and releases the channel.
+func (p *ProxyServer) reject(rconn net.Conn, code int, msg string) {
+	if err := proto.WriteFrame(rconn, proto.ProxyAck{Code: code, Msg: msg}); err != nil {
+		logrus.Errorf("write proxy ack to %s error:%v", rconn.RemoteAddr(), err)
+	}
+	rconn.(*pnet.Conn).Release()
+}
+
+// destination is the address to dial for header if the client may reach it.
+func (p *ProxyServer) destination(ctx context.Context, client string, header proto.ProxyHeader) (string, error) {
+	if header.Port == 0 {
+		return "", errors.New("proxy port error")
+	}
+	if header.Host == "" {
+		if err := p.acl.CheckPort(client, header.Port); err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(p.localAddr, strconv.Itoa(int(header.Port))), nil
+	}
+	return p.acl.Resolve(ctx, client, header.Host, header.Port)
+}
+
+func (p *ProxyServer) forward(rconn net.Conn, header proto.ProxyHeader) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	addr, err := p.destination(ctx, clientId(rconn), header)
 	if err != nil {
+		code := proto.ProxyDenied
+		if !errors.Is(err, ErrNotAllowed) {
+			code = proto.ProxyUnreachable
+		}
+		p.reject(rconn, code, err.Error())
 		return err
 	}
-	if n != 2 {
-		return stderr.New("proxy header error")
+	var d net.Dialer
+	lconn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		p.reject(rconn, proto.ProxyUnreachable, err.Error())
+		return stderr.Wrap(err)
+	}
+	if err := proto.WriteFrame(rconn, proto.ProxyAck{Code: proto.ProxyOk}); err != nil {
+		lconn.Close()
+		rconn.(*pnet.Conn).Release()
+		return stderr.Wrap(err)
 	}
-	logrus.Debugf("read header: %v", header)
-	port := binary.BigEndian.Uint16(header)
-	if port == 0 {
-		return stderr.New("proxy port error")
+	logrus.Debugf("proxy %s to %s, start to copy data", rconn.RemoteAddr(), addr)
+	defer rconn.(*pnet.Conn).Release()
+	return conn.GoCopy(lconn, rconn)
+}
+
+// listen accepts connections on a reverse port until the control channel fails,
+// each of them is announced to the frontend and kept until attached.
+func (p *ProxyServer) listen(rconn net.Conn, header proto.ProxyHeader) error {
+	if err := p.acl.CheckReversePort(clientId(rconn), header.Port); err != nil {
+		p.reject(rconn, proto.ProxyDenied, err.Error())
+		return err
 	}
-	logrus.Debugf("proxy %s header:%v, on port: %d, start to copy data", rconn.RemoteAddr(), header, port)
-	lconn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", p.localAddr, port))
+	var client = clientId(rconn)
+	lis, err := net.Listen("tcp", net.JoinHostPort(p.reverseAddr, strconv.Itoa(int(header.Port))))
 	if err != nil {
+		// a frontend reconnecting replaces its stale listener, the port of another client is kept
+		p.Lock()
+		old, ok := p.listeners[header.Port]
+		p.Unlock()
+		if !ok || client == "" || old.client != client {
+			p.reject(rconn, proto.ProxyUnreachable, err.Error())
+			return stderr.Wrap(err)
+		}
+		old.Close()
+		if lis, err = net.Listen("tcp", net.JoinHostPort(p.reverseAddr, strconv.Itoa(int(header.Port)))); err != nil {
+			p.reject(rconn, proto.ProxyUnreachable, err.Error())
+			return stderr.Wrap(err)
+		}
+	}
+	defer rconn.(*pnet.Conn).Release()
+	if err := proto.WriteFrame(rconn, proto.ProxyAck{Code: proto.ProxyOk}); err != nil {
+		lis.Close()
 		return stderr.Wrap(err)
 	}
+	p.Lock()
+	p.listeners[header.Port] = reverseListener{Listener: lis, client: client}
+	p.Unlock()
+	defer func() {
+		lis.Close()
+		p.Lock()
+		if p.listeners[header.Port].Listener == lis {
+			delete(p.listeners, header.Port)
+		}
+		p.Unlock()
+	}()
+
+	// the frontend sends nothing more, a read error means the channel is gone
+	go func() {
+		io.Copy(io.Discard, rconn)
+		lis.Close()
+	}()
+
+	logrus.Infof("reverse proxy listen on %s for %s", lis.Addr(), rconn.RemoteAddr())
+	for {
+		lconn, err := lis.Accept()
+		if err != nil {
+			return stderr.Wrap(err)
+		}
+		id := p.addPending(lconn, client)
+		notice := proto.ProxyNotice{
+			Id:      id,
+			Backend: p.lis.Id(),
+			Remote:  lconn.RemoteAddr().String(),
+		}
+		if err := proto.WriteFrame(rconn, notice); err != nil {
+			if c := p.takePending(id); c != nil {
+				c.Close()
+			}
+			return stderr.Wrap(err)
+		}
+	}
+}
+
+func (p *ProxyServer) attach(rconn net.Conn, header proto.ProxyHeader) error {
+	defer rconn.(*pnet.Conn).Release()
+	lconn := p.takePending(header.Id)
+	if lconn == nil {
+		return stderr.New("reverse connection not found: " + header.Id)
+	}
+	// only the client which asked for the listener gets its connections
+	if client := clientId(rconn); lconn.client != client {
+		lconn.Close()
+		return stderr.New("reverse connection " + header.Id + " attached by " + client)
+	}
+	logrus.Debugf("reverse proxy %s attached to %s", lconn.RemoteAddr(), rconn.RemoteAddr())
+	return conn.GoCopy(lconn, rconn)
+}
+
+func (p *ProxyServer) addPending(lconn net.Conn, client string) string {
+	var buf = make([]byte, 16)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
 
-	conn.GoFunc(context.TODO(), func(ctx context.Context) error {
-		defer func() {
-			rconn.(*pnet.Conn).Release()
-		}()
-		return conn.GoCopy(lconn, rconn)
+	p.Lock()
+	p.pending[id] = pendingConn{Conn: lconn, client: client}
+	p.Unlock()
+	time.AfterFunc(attachTimeout, func() {
+		if c := p.takePending(id); c != nil {
+			logrus.Errorf("reverse connection %s from %s not attached", id, c.RemoteAddr())
+			c.Close()
+		}
 	})
-	return nil
+	return id
+}
+
+func (p *ProxyServer) takePending(id string) *pendingConn {
+	p.Lock()
+	defer p.Unlock()
+	c, ok := p.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(p.pending, id)
+	return &c
 }
@@ -0,0 +1,50 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	pnet "github.com/yixinin/puup/net"
+	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/proto"
+	"github.com/yixinin/puup/stderr"
+)
+
+// runDatagram serves the udp flows, every datagram channel is one flow.
+func (p *ProxyServer) runDatagram(ctx context.Context) error {
+	for {
+		rconn, err := p.lis.AcceptDatagram()
+		if err != nil {
+			return stderr.Wrap(err)
+		}
+		conn.GoFunc(ctx, func(ctx context.Context) error {
+			return p.serveDatagram(rconn.(*pnet.Conn))
+		})
+	}
+}
+
+func (p *ProxyServer) serveDatagram(rconn *pnet.Conn) error {
+	var header proto.ProxyHeader
+	if err := json.Unmarshal([]byte(rconn.Protocol()), &header); err != nil {
+		rconn.Close()
+		return stderr.Wrap(err)
+	}
+	if header.Version != proto.ProxyVersion {
+		rconn.Close()
+		return stderr.New("unsupported proxy version " + strconv.Itoa(header.Version))
+	}
+	if err := p.acl.CheckUdpPort(clientId(rconn), header.Port); err != nil {
+		rconn.Close()
+		return err
+	}
+	lconn, err := net.Dial("udp", net.JoinHostPort(p.localAddr, strconv.Itoa(int(header.Port))))
+	if err != nil {
+		rconn.Close()
+		return stderr.Wrap(err)
+	}
+	logrus.Debugf("udp flow %s to port %d", rconn.RemoteAddr(), header.Port)
+	return conn.CopyDatagram(lconn, rconn, p.udpIdle)
+}
@@ -2,16 +2,17 @@ package backend
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
-	"unicode"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/gin-gonic/gin"
@@ -20,14 +21,16 @@ import (
 	"github.com/yixinin/puup/db/file"
 	"github.com/yixinin/puup/middles"
 	pnet "github.com/yixinin/puup/net"
+	"github.com/yixinin/puup/proto"
 )
 
 type WebServer struct {
-	lis net.Listener
+	lis   net.Listener
+	files bool
 }
 
 func NewWebServer(cfg *config.Config, lis net.Listener) *WebServer {
-	return &WebServer{lis: lis}
+	return &WebServer{lis: lis, files: cfg.Files != ""}
 }
 
 func (s *WebServer) Run(ctx context.Context) error {
@@ -69,7 +72,9 @@ func (s *WebServer) Run(ctx context.Context) error {
 	e.StaticFS("/share", http.Dir("share"))
 	e.GET("/data", SendSerisData)
 	e.GET("/opi5", Image)
-	initFile(e)
+	if s.files {
+		initFile(e)
+	}
 	// e.StaticFS("/share", http.Dir(shareDir))
 	e.NoRoute(func(c *gin.Context) {
 		c.JSON(200, gin.H{"msg": "are you lost?"})
@@ -112,14 +117,14 @@ func Image(c *gin.Context) {
 func initFile(e *gin.Engine) {
 	g := e.Group("file")
 
-	g.HEAD("/:id", Head)
 	g.POST("/upload/pre", PreUpload)
-	g.StaticFS("/file", FileSystem{})
+	g.GET("/*path", Download)
+	g.HEAD("/*path", Download)
 }
 
 func PreUpload(c *gin.Context) {
-	var req UploadReq
-	var ack UploadAck
+	var req proto.FileReq
+	var ack proto.UploadAck
 	var ctx = c.Request.Context()
 	if err := c.BindJSON(&req); err != nil {
 		c.String(400, err.Error())
@@ -142,121 +147,34 @@ func PreUpload(c *gin.Context) {
 	return
 }
 
-func Head(c *gin.Context) {
-	var ctx = c.Request.Context()
-	path := c.Param("id")
-	uf, err := file.GetStorage().GetUserFile(ctx, path)
-	if errors.Is(err, badger.ErrKeyNotFound) {
-		c.AbortWithStatus(404)
-		return
-	}
-	if err != nil {
-		c.String(400, err.Error())
-		return
-	}
-
-	c.Header("ETAG", uf.Etag)
-	c.Header("Content-Length", strconv.FormatUint(uf.Size, 10))
-}
-
-type FileSystem struct {
-}
-
-func (f FileSystem) Open(name string) (http.File, error) {
-	uf, err := file.GetStorage().GetUserFile(context.Background(), name)
-	if err != nil {
-		return nil, err
-	}
-	fs, err := os.Open(uf.RealPath)
-	return fs, err
-}
-
+// Download serves a user file with range requests, the ETag is the sha-256 of the content,
+// also sent as Digest for clients to verify.
 func Download(c *gin.Context) {
 	var ctx = c.Request.Context()
-	path := c.Param("id")
-	// read range
-	var rg = c.Request.Header.Get("Range")
-	var start, end int
-	var err error
-	if rg != "" {
-		rgs := strings.Split(rg, "-")
-		start, err = strconv.Atoi(rgs[0])
-		if err != nil {
-			c.String(400, err.Error())
-			return
-		}
-		if len(rgs) > 1 && rgs[1] != "" {
-			end, err = strconv.Atoi(rgs[1])
-			if err != nil {
-				c.String(400, err.Error())
-				return
-			}
-		}
-	}
+	path := strings.TrimPrefix(c.Param("path"), "/")
 	uf, err := file.GetStorage().GetUserFile(ctx, path)
 	if errors.Is(err, badger.ErrKeyNotFound) {
 		c.AbortWithStatus(404)
 		return
 	}
 	if err != nil {
-		c.String(400, err.Error())
+		logrus.Errorf("get file %s error:%v", path, err)
+		c.AbortWithStatus(500)
 		return
 	}
-	c.Header("ETAG", uf.Etag)
-	c.Header("Content-Length", strconv.FormatUint(uf.Size-uint64(start), 10))
-	var filename = uf.Path
-	if isASCII(filename) {
-		c.Writer.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
-	} else {
-		c.Writer.Header().Set("Content-Disposition", `attachment; filename*=UTF-8''`+url.QueryEscape(filename))
-	}
 	fs, err := os.Open(uf.RealPath)
 	if err != nil {
-		c.String(400, err.Error())
+		logrus.Errorf("open file %s error:%v", path, err)
+		c.AbortWithStatus(500)
 		return
 	}
 	defer fs.Close()
-	if start > 0 {
-		_, err := fs.Seek(int64(start), os.SEEK_SET)
-		if err != nil {
-			c.String(400, err.Error())
-			return
-		}
-	}
-	c.Status(200)
-	var total int64
-	if end > start {
-		c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, uf.Size))
-		var buf = make([]byte, 4096)
-		for i := start; i < end; i += 4096 {
-			n, err := fs.Read(buf)
-			if err != nil && err != io.EOF {
-				c.String(400, err.Error())
-				return
-			}
-			writen, err := c.Writer.Write(buf[:n])
-			if err != nil && err != io.EOF {
-				c.String(400, err.Error())
-				return
-			}
-			total += int64(writen)
-		}
-	} else {
-		c.Header("Content-Range", fmt.Sprintf("bytes %d-/%d", start, uf.Size))
-	}
-	total, err = io.Copy(c.Writer, fs)
-	if err != nil {
-		logrus.Errorf("write file error")
-		return
-	}
 
-	return
-}
-func isASCII(s string) bool {
-	for i := 0; i < len(s); i++ {
-		if s[i] > unicode.MaxASCII {
-			return false
-		}
+	if sum, err := hex.DecodeString(uf.Etag); err == nil {
+		c.Header("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
 	}
-	return true
+	c.Header("ETag", `"`+uf.Etag+`"`)
+	var filename = filepath.Base(uf.Path)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	http.ServeContent(c.Writer, c.Request, filename, time.Unix(uf.UpdateTime, 0), fs)
 }
@@ -22,7 +22,7 @@ func Download() {
 		return
 	}
 
-	tp, err := net.NewTransport("http://114.115.218.1:8080", "open")
+	tp, err := net.NewTransport("http://114.115.218.1:8080", "open", "")
 	if err != nil {
 		fmt.Println(stderr.Wrap(err))
 		return
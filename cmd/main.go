@@ -97,7 +97,11 @@ func main() {
 	var wg sync.WaitGroup
 	if runServer {
 		wg.Add(1)
-		s := server.NewServer()
+		s, err := server.NewServer(cfgFilename)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
 		go func() {
 			defer wg.Done()
 			if err := s.Run(ctx); err != nil {
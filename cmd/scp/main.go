@@ -1 +1,305 @@
+// puup-scp copies files and directories between the local machine and the file server of a backend:
+//
+//	puup-scp [flags] ./file [user@]cluster:/path
+//	puup-scp [flags] -r [user@]cluster:/path ./dir
+//
+// A file copied to an existing remote directory, or a path ending with a slash, keeps its name.
+// With -r the destination directory becomes a copy of the source one, running it again
+// only copies what changed. Interrupted transfers resume from where they stopped.
+//
+// Exit codes: 0 copied, 1 failed, 2 bad usage, 3 source not found, 4 refused by the backend.
 package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/config"
+	"github.com/yixinin/puup/frontend"
+	"github.com/yixinin/puup/identity"
+	"github.com/yixinin/puup/proto"
+)
+
+const (
+	exitOk       = 0
+	exitFailed   = 1
+	exitUsage    = 2
+	exitNotFound = 3
+	exitRefused  = 4
+)
+
+var (
+	configFile, sigAddr, token, knownHosts  string
+	recursive, remove, dryRun, quiet, debug bool
+)
+
+func main() {
+	flag.StringVar(&configFile, "c", "", "frontend config file, the flags override it")
+	flag.StringVar(&sigAddr, "sig", "http://114.115.218.1:8080", "signalling server")
+	flag.StringVar(&token, "token", "", "cluster token")
+	flag.StringVar(&knownHosts, "known_hosts", identity.DefaultKnownHostsFile, "trusted backend fingerprints")
+	flag.BoolVar(&recursive, "r", false, "copy directories recursively")
+	flag.BoolVar(&remove, "delete", false, "with -r, delete the destination files missing from the source")
+	flag.BoolVar(&dryRun, "n", false, "with -r, only print what would be copied")
+	flag.BoolVar(&quiet, "q", false, "do not show progress")
+	flag.BoolVar(&debug, "debug", false, "debug log")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: puup-scp [flags] source [user@]cluster:path\n       puup-scp [flags] [user@]cluster:path target\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	logrus.SetLevel(logrus.WarnLevel)
+	if debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	os.Exit(run())
+}
+
+func run() int {
+	if flag.NArg() != 2 || (remove || dryRun) && !recursive {
+		flag.Usage()
+		return exitUsage
+	}
+	var src, dst = parseTarget(flag.Arg(0)), parseTarget(flag.Arg(1))
+	if (src.cluster == "") == (dst.cluster == "") {
+		fmt.Fprintln(os.Stderr, "puup-scp: exactly one of source and target must be remote")
+		return exitUsage
+	}
+	var remote = src
+	if remote.cluster == "" {
+		remote = dst
+	}
+	cfg, err := loadConfig(remote)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "puup-scp: %v\n", err)
+		return exitUsage
+	}
+	if err := frontend.Configure(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "puup-scp: %v\n", err)
+		return exitUsage
+	}
+	var c = frontend.NewFileClient(cfg)
+	var bar = new(progressBar)
+	if !quiet && isTerminal(os.Stderr) {
+		c.Progress = bar.update
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if src.cluster == "" {
+		err = push(ctx, c, src.path, dst.path)
+	} else {
+		err = pull(ctx, c, src.path, dst.path)
+	}
+	if err != nil {
+		bar.clear()
+		fmt.Fprintf(os.Stderr, "puup-scp: %s\n", message(err))
+	}
+	return exitCode(err)
+}
+
+type target struct {
+	user, cluster, path string
+}
+
+// parseTarget splits [user@]cluster:path, an argument without a colon before its first slash is local.
+// Single letters before the colon are taken as windows drives.
+func parseTarget(arg string) target {
+	host, p, ok := strings.Cut(arg, ":")
+	if !ok || len(host) < 2 || strings.ContainsAny(host, `/\`) {
+		return target{path: arg}
+	}
+	user, cluster, ok := strings.Cut(host, "@")
+	if !ok {
+		user, cluster = "", host
+	}
+	return target{user: user, cluster: cluster, path: p}
+}
+
+func loadConfig(remote target) (*config.Config, error) {
+	var cfg = new(config.Config)
+	if configFile != "" {
+		c, err := config.LoadConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg = c
+	}
+	var set = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if set["sig"] || cfg.SigAddr == "" {
+		cfg.SigAddr = sigAddr
+	}
+	if set["token"] || cfg.Token == "" {
+		cfg.Token = token
+	}
+	if set["known_hosts"] || cfg.KnownHosts == "" {
+		cfg.KnownHosts = knownHosts
+	}
+	cfg.ServerName = remote.cluster
+	if remote.user != "" {
+		cfg.ClientId = remote.user
+	}
+	return cfg, nil
+}
+
+func push(ctx context.Context, c *frontend.FileClient, local, remote string) error {
+	info, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if !recursive {
+			return usageError(local + " is a directory, use -r")
+		}
+		return syncDir(ctx, c, local, remote, false)
+	}
+	if strings.HasSuffix(remote, "/") || remote == "" || isRemoteDir(ctx, c, remote) {
+		remote = path.Join(remote, filepath.Base(local))
+	}
+	return c.Upload(ctx, local, remote)
+}
+
+func pull(ctx context.Context, c *frontend.FileClient, remote, local string) error {
+	if recursive {
+		files, err := c.List(ctx, remote)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return &frontend.FileError{Code: proto.FileNotFound, Msg: remote + " not found"}
+		}
+		return syncDir(ctx, c, local, remote, true)
+	}
+	if info, err := os.Stat(local); err == nil && info.IsDir() {
+		local = filepath.Join(local, path.Base(remote))
+	}
+	err := c.Download(ctx, remote, local)
+	var ackErr *frontend.FileError
+	if errors.As(err, &ackErr) && ackErr.Code == proto.FileNotFound && isRemoteDir(ctx, c, remote) {
+		return usageError(remote + " is a directory, use -r")
+	}
+	return err
+}
+
+func syncDir(ctx context.Context, c *frontend.FileClient, local, remote string, pull bool) error {
+	actions, err := c.Sync(ctx, local, remote, frontend.SyncOptions{Pull: pull, Delete: remove, DryRun: dryRun})
+	for _, a := range actions {
+		if dryRun {
+			fmt.Println(a)
+		} else if a.Op == frontend.SyncDelete && !quiet {
+			fmt.Fprintln(os.Stderr, a)
+		}
+	}
+	return err
+}
+
+func isRemoteDir(ctx context.Context, c *frontend.FileClient, remote string) bool {
+	files, err := c.List(ctx, remote)
+	return err == nil && len(files) > 0
+}
+
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// message drops the stack of a stderr error.
+func message(err error) string {
+	msg, _, _ := strings.Cut(err.Error(), "\nstacks:")
+	return strings.TrimPrefix(msg, "err:")
+}
+
+func exitCode(err error) int {
+	var ackErr *frontend.FileError
+	var usageErr usageError
+	switch {
+	case err == nil:
+		return exitOk
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case os.IsNotExist(err):
+		return exitNotFound
+	case errors.As(err, &ackErr):
+		switch ackErr.Code {
+		case proto.FileNotFound:
+			return exitNotFound
+		case proto.FileBadRequest, proto.FileBusy, proto.FileDisabled:
+			return exitRefused
+		}
+	}
+	return exitFailed
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBar draws the transfer of one file at a time on stderr.
+type progressBar struct {
+	local      string
+	from, done uint64
+	start      time.Time
+	drawn      time.Time
+}
+
+func (b *progressBar) update(local string, done, total uint64) {
+	var now = time.Now()
+	// a new file, or a retry starting over
+	if local != b.local || done < b.done {
+		b.clear()
+		*b = progressBar{local: local, from: done, start: now}
+	}
+	b.done = done
+	if done < total && now.Sub(b.drawn) < 200*time.Millisecond {
+		return
+	}
+	b.drawn = now
+	var percent uint64 = 100
+	if total > 0 {
+		percent = done * 100 / total
+	}
+	var rate float64
+	if elapsed := now.Sub(b.start).Seconds(); elapsed > 0 {
+		rate = float64(done-b.from) / elapsed
+	}
+	fmt.Fprintf(os.Stderr, "\r%-32s %3d%% %9s %9s/s", filepath.Base(local), percent, humanSize(float64(done)), humanSize(rate))
+	if done >= total {
+		b.clear()
+	}
+}
+
+// clear ends the line of an unfinished bar.
+func (b *progressBar) clear() {
+	if !b.drawn.IsZero() {
+		fmt.Fprintln(os.Stderr)
+		b.drawn = time.Time{}
+	}
+}
+
+func humanSize(n float64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", int64(n))
+	}
+	var i = -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%cB", n, units[i])
+}
@@ -5,21 +5,33 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/yixinin/puup/frontend"
+	"github.com/yixinin/puup/identity"
+	pnet "github.com/yixinin/puup/net"
 )
 
 const (
 	sigAddr = ""
 )
 
+var token, knownHosts string
+
 func main() {
+	flag.StringVar(&token, "token", "", "cluster token")
+	flag.StringVar(&knownHosts, "known_hosts", identity.DefaultKnownHostsFile, "trusted backend fingerprints")
 	flag.Parse()
 	// logrus.SetLevel(logrus.DebugLevel)
-	var c = frontend.NewSshClient("http://114.115.218.1:8080")
+	var c = frontend.NewSshClient("http://114.115.218.1:8080", token)
 	user, name, pass, err := frontend.GetArgsUserPass()
 	if err != nil {
 		logrus.Errorf("get args error:%v", err)
 		return
 	}
+	kh, err := identity.NewKnownHosts(knownHosts, name, nil)
+	if err != nil {
+		logrus.Errorf("load known hosts error:%v", err)
+		return
+	}
+	pnet.SetVerifier(name, kh)
 
 	err = c.Run(user, name, pass)
 	if err != nil {
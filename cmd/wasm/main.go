@@ -44,12 +44,16 @@ func Init() {
 	fmt.Println("init wasm ...")
 
 	serverName := js.Global().Get("serverName").String()
+	var token string
+	if v := js.Global().Get("token"); v.Type() == js.TypeString {
+		token = v.String()
+	}
 	fmt.Println("connect to server", serverName)
 	js.Global().Set("base64", encodeWrapper())
 	js.Global().Set("GoHttp", GoHttp())
 	js.Global().Set("GoHttp1", GoHttp1())
 	js.Global().Set("GoHttpAsync", GoHttpAsync())
-	tp, err := net.NewTransport("http://114.115.218.1:8080", serverName)
+	tp, err := net.NewTransport("http://114.115.218.1:8080", serverName, token)
 	if err != nil {
 		fmt.Printf("init webrtc wasm error:%v\n", err)
 		return
@@ -2,25 +2,162 @@ package config
 
 import (
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type ProxyPort struct {
-	Local  uint16 `yaml:"local"`
-	Remote uint16 `yaml:"remote,omitempty"`
+	Local   uint16 `yaml:"local"`
+	Remote  uint16 `yaml:"remote,omitempty"`
+	Network string `yaml:"network,omitempty"` // tcp (default) or udp
 }
 type ProxyBack struct {
 	Addr  string   `yaml:"addr"`
 	Ports []uint16 `yaml:"ports"`
+	// Allow lists the host:port frontends may dial by name through socks or http connect,
+	// e.g. "*.example.com:443", "10.0.0.0/8:*", "db.local:5432-5433".
+	Allow []string `yaml:"allow"`
+	// UdpPorts are the udp ports frontends may forward datagrams to.
+	UdpPorts []uint16 `yaml:"udp_ports"`
+	// ReverseAddr and ReversePorts are where frontends may ask the backend to listen.
+	ReverseAddr  string   `yaml:"reverse_addr"`
+	ReversePorts []uint16 `yaml:"reverse_ports"`
+	// Rules limit each frontend client id, nothing is limited per client without rules.
+	Rules []ProxyRule `yaml:"rules"`
+}
+
+// ProxyRule is what the frontend Client ("*" for all) may reach, within what ProxyBack allows.
+type ProxyRule struct {
+	Client       string   `yaml:"client"`
+	Ports        []uint16 `yaml:"ports"`
+	UdpPorts     []uint16 `yaml:"udp_ports"`
+	ReversePorts []uint16 `yaml:"reverse_ports"`
+	Allow        []string `yaml:"allow"`
+}
+
+// ProxyReverse forwards the connections accepted on the backend port Remote to Local,
+// an address reachable from the frontend.
+type ProxyReverse struct {
+	Remote uint16 `yaml:"remote"`
+	Local  string `yaml:"local"`
+}
+
+// ClusterAuth holds the credentials accepted for one cluster name,
+// Secret is shared by the backends, Tokens are handed out to frontends.
+// Clients binds a frontend client id to its own token, so the id cannot be claimed by others.
+type ClusterAuth struct {
+	Secret  string            `yaml:"secret"`
+	Tokens  []string          `yaml:"tokens"`
+	Clients map[string]string `yaml:"clients"`
+}
+
+// Mesh lets several signalling nodes share clients and forward packets to each other.
+type Mesh struct {
+	NodeId string   `yaml:"node_id"`
+	Secret string   `yaml:"secret"`
+	Nodes  []string `yaml:"nodes"` // sig addr of the other nodes
+}
+
+// ICEServer is a STUN or TURN server, CredentialType is password (default) or oauth.
+type ICEServer struct {
+	URLs           []string `yaml:"urls"`
+	Username       string   `yaml:"username"`
+	Credential     string   `yaml:"credential"`
+	CredentialType string   `yaml:"credential_type"`
+	MACKey         string   `yaml:"mac_key"` // oauth only
+}
+
+// TurnAuth hands out REST-API style short-lived TURN credentials in the signalling handshake,
+// the TURN server must share Secret.
+type TurnAuth struct {
+	URLs   []string      `yaml:"urls"`
+	Secret string        `yaml:"secret"`
+	TTL    time.Duration `yaml:"ttl"`
+}
+
+// TurnServer is the built-in STUN/TURN relay, it accepts the credentials of Turn and the static Users.
+type TurnServer struct {
+	Listen         string            `yaml:"listen"`    // default ":3478", udp and tcp
+	PublicIP       string            `yaml:"public_ip"` // relay address announced to peers
+	Realm          string            `yaml:"realm"`
+	MinPort        uint16            `yaml:"min_port"`
+	MaxPort        uint16            `yaml:"max_port"`
+	MaxAllocations int               `yaml:"max_allocations"` // 0 is unlimited
+	Users          map[string]string `yaml:"users"`
+}
+
+// FlowControl bounds the bytes buffered per data channel, sizes in bytes.
+type FlowControl struct {
+	SendHighWater int `yaml:"send_high_water"` // writes wait above it, default 1MB
+	SendLowWater  int `yaml:"send_low_water"`  // and resume below it, default 256KB
+	RecvWindow    int `yaml:"recv_window"`     // received bytes queued for a reader, default 4MB
+}
+
+type Server struct {
+	Addr       string                  `yaml:"addr"`
+	Clusters   map[string]*ClusterAuth `yaml:"clusters"`
+	Mesh       *Mesh                   `yaml:"mesh"`
+	Turn       *TurnAuth               `yaml:"turn"`
+	TurnServer *TurnServer             `yaml:"turn_server"`
+	// AdminToken enables the admin api at /api/admin and the metrics at /metrics,
+	// sent as "Authorization: Bearer <token>".
+	AdminToken string `yaml:"admin_token"`
+	// Bans are the cluster names refused at start, the admin api changes them until restart.
+	Bans []string `yaml:"bans"`
 }
 
 type Config struct {
-	Type       string      `yaml:"type"`
-	ServerName string      `yaml:"server_name"`
-	SigAddr    string      `yaml:"sig_addr"`
+	Type       string `yaml:"type"`
+	ServerName string `yaml:"server_name"`
+	SigAddr    string `yaml:"sig_addr"`
+	Token      string `yaml:"token"`
+	// ClientId is the frontend identity the backend proxy rules match, random if empty.
+	ClientId string `yaml:"client_id"`
+	// Balance selects the backend of a cluster: round_robin, least_active, lowest_rtt or sticky.
+	Balance string `yaml:"balance"`
+	// Mux multiplexes the frontend connections over one data channel per backend.
+	Mux bool `yaml:"mux"`
+	// Relay is webrtc, relay through the signalling server, or auto (default) to relay
+	// when webrtc does not connect within RelayAfter, default 20s.
+	Relay      string        `yaml:"relay"`
+	RelayAfter time.Duration `yaml:"relay_after"`
+	// ReconnectGrace keeps a disconnected peer alive while ice restarts, e.g. "30s", negative disables it.
+	ReconnectGrace time.Duration `yaml:"reconnect_grace"`
+	// KeepaliveInterval is how often peers are pinged, default 5s, a peer is closed
+	// after KeepaliveMaxMissed pongs in a row are missed, default 3, negative never.
+	KeepaliveInterval  time.Duration `yaml:"keepalive_interval"`
+	KeepaliveMaxMissed int           `yaml:"keepalive_max_missed"`
+	FlowControl        *FlowControl  `yaml:"flow_control"`
+
+	ICEServers []ICEServer `yaml:"ice_servers"`
+	// ICETransportPolicy is all (default) or relay to only use TURN.
+	ICETransportPolicy string `yaml:"ice_transport_policy"`
+
 	ProxyBack  *ProxyBack  `yaml:"proxy_back"`
 	ProxyFront []ProxyPort `yaml:"proxy_front"`
+	// ProxySocks and ProxyHttp are the local listen addrs of the socks5 and http CONNECT proxies,
+	// the backend dials the requested destinations if its allow list permits them.
+	ProxySocks string `yaml:"proxy_socks"`
+	ProxyHttp  string `yaml:"proxy_http"`
+	// ProxyReverse exposes frontend-local services on backend ports.
+	ProxyReverse []ProxyReverse `yaml:"proxy_reverse"`
+	// UdpIdleTimeout closes udp flows without traffic, default 60s.
+	UdpIdleTimeout time.Duration `yaml:"udp_idle_timeout"`
+	// Files is where the backend file server keeps its database and the uploaded files,
+	// the file server is disabled if empty.
+	Files string `yaml:"files"`
+	// Metrics is the local addr serving prometheus metrics at /metrics, disabled if empty.
+	Metrics string  `yaml:"metrics"`
+	Server  *Server `yaml:"server"`
+
+	// Identity is the backend certificate file, generated on first run.
+	Identity string `yaml:"identity"`
+	// KnownHosts stores backend fingerprints trusted on first use by frontends.
+	KnownHosts string `yaml:"known_hosts"`
+	// Fingerprints pins backend fingerprints by cluster name, e.g. "sha-256 AB:CD:...",
+	// a cluster with several backends lists all of them, only the first one is trusted on first use.
+	Fingerprints map[string][]string `yaml:"fingerprints"`
 }
 
 func LoadConfig(filename string) (*Config, error) {
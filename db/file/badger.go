@@ -2,6 +2,8 @@ package file
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"github.com/yixinin/puup/db"
 )
@@ -14,7 +16,6 @@ func init() {
 }
 
 func (b *BadgerStorage) InsertFile(ctx context.Context, file File) error {
-	file.Reference = 1
 	_, _, err := db.GetOrSet(ctx, file.Key(), file, 0)
 	return err
 }
@@ -40,9 +41,37 @@ func (b *BadgerStorage) GetUserFile(ctx context.Context, path string) (UserFile,
 	return db.Get[UserFile](ctx, GetUserFileKey(path))
 }
 
+func (b *BadgerStorage) ListUserFiles(ctx context.Context, dir string) ([]UserFile, error) {
+	var prefix = GetUserFileKey("")
+	if dir = strings.Trim(dir, "/"); dir != "" {
+		prefix = GetUserFileKey(dir + "/")
+	}
+	return db.Scan[UserFile](ctx, prefix, 0)
+}
+
+func (b *BadgerStorage) DeleteFile(ctx context.Context, etag string, size uint64) error {
+	return db.Delete(ctx, GetFileKey(etag, size))
+}
+
+func (b *BadgerStorage) DeleteUserFile(ctx context.Context, path string) error {
+	return db.Delete(ctx, GetUserFileKey(path))
+}
+
 func (b *BadgerStorage) Rename(ctx context.Context, oldPath, newPath string) error {
 	return db.Update(ctx, GetUserFileKey(oldPath), func(value *File) error {
 		value.Path = newPath
 		return nil
 	})
 }
+
+func (b *BadgerStorage) SetUpload(ctx context.Context, upload Upload, ttl time.Duration) error {
+	return db.Set(ctx, GetUploadKey(upload.Etag, upload.Size), upload, int(ttl/time.Second))
+}
+
+func (b *BadgerStorage) GetUpload(ctx context.Context, etag string, size uint64) (Upload, error) {
+	return db.Get[Upload](ctx, GetUploadKey(etag, size))
+}
+
+func (b *BadgerStorage) DeleteUpload(ctx context.Context, etag string, size uint64) error {
+	return db.Delete(ctx, GetUploadKey(etag, size))
+}
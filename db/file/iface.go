@@ -1,6 +1,9 @@
 package file
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type Storage interface {
 	InsertFile(ctx context.Context, file File) error
@@ -8,6 +11,18 @@ type Storage interface {
 
 	GetFile(ctx context.Context, etag string, size uint64) (File, error)
 	GetUserFile(ctx context.Context, path string) (UserFile, error)
+	// ListUserFiles returns the user files under dir, all of them if dir is empty.
+	ListUserFiles(ctx context.Context, dir string) ([]UserFile, error)
+
+	// IncrReference counts the user files of a content, it returns the new count.
+	IncrReference(ctx context.Context, etag string, size uint64, inc int) (int, error)
+	DeleteFile(ctx context.Context, etag string, size uint64) error
+	DeleteUserFile(ctx context.Context, path string) error
+
+	// SetUpload saves an unfinished upload, it is forgotten after ttl.
+	SetUpload(ctx context.Context, upload Upload, ttl time.Duration) error
+	GetUpload(ctx context.Context, etag string, size uint64) (Upload, error)
+	DeleteUpload(ctx context.Context, etag string, size uint64) error
 }
 
 var storage Storage
@@ -2,7 +2,8 @@ package file
 
 import (
 	"fmt"
-	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -22,13 +23,32 @@ func (f *File) Key() string {
 func GetFileKey(etag string, size uint64) string {
 	return fmt.Sprintf("file/%s/%d", etag, size)
 }
-func GetFileName(etag string, size uint64, ext string) (string, string) {
-	var dir, _ = os.Getwd()
-	filename := fmt.Sprintf("%s/files/%s_%d.%s", dir, etag, size, ext)
-	previewFilename := fmt.Sprintf("%s/previews/%s_%d.png", dir, etag, size)
+
+// GetFileName returns the stored file and its preview under dir, ext starts with a dot.
+func GetFileName(dir, etag string, size uint64, ext string) (string, string) {
+	filename := filepath.Join(dir, "files", fmt.Sprintf("%s_%d%s", etag, size, ext))
+	previewFilename := filepath.Join(dir, "previews", fmt.Sprintf("%s_%d.png", etag, size))
 	return filename, previewFilename
 }
 
+// GetPartialName returns where the upload of etag is written until it is verified.
+func GetPartialName(dir, etag string, size uint64) string {
+	return filepath.Join(dir, "partial", fmt.Sprintf("%s_%d", etag, size))
+}
+
+// Upload is an unfinished upload, its partial file is removed once it expires.
+type Upload struct {
+	Etag       string   `json:"etag"`
+	Size       uint64   `json:"size"`
+	Path       string   `json:"path"`
+	Type       FileType `json:"type"`
+	UpdateTime int64    `json:"update"`
+}
+
+func GetUploadKey(etag string, size uint64) string {
+	return fmt.Sprintf("file/upload/%s/%d", etag, size)
+}
+
 func GetUserFileKey(path string) string {
 	return fmt.Sprintf("file/user/%s", path)
 }
@@ -43,6 +63,21 @@ const (
 	TypeOther = 10
 )
 
+// TypeOf guesses the type of a file by its extension.
+func TypeOf(name string) FileType {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp", ".webp":
+		return TypeImage
+	case ".mp4", ".mkv", ".mov", ".avi", ".webm":
+		return TypeVideo
+	case ".mp3", ".flac", ".wav", ".aac", ".ogg":
+		return TypeAudio
+	case ".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx", ".txt", ".md":
+		return TypeDoc
+	}
+	return TypeOther
+}
+
 func (t FileType) String() string {
 	switch t {
 	case TypeImage:
@@ -66,6 +101,9 @@ type UserFile struct {
 	Type        FileType `json:"type"`
 	CreateTime  int64    `json:"create"`
 	UpdateTime  int64    `json:"update"`
+	// Mode and ModTime (unix nano) are of the uploaded file, restored on download.
+	Mode    uint32 `json:"mode,omitempty"`
+	ModTime int64  `json:"mtime,omitempty"`
 }
 
 func CopyFile(f File, path string) UserFile {
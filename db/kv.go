@@ -15,18 +15,21 @@ type Storage struct {
 
 var storage *Storage
 
-func Init() {
-	db, err := badger.Open(badger.DefaultOptions("data/db"))
+// Init opens the database in dir.
+func Init(dir string) error {
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLoggingLevel(badger.WARNING))
 	if err != nil {
-		panic(err)
+		return err
 	}
 	storage = &Storage{db: db}
+	return nil
 }
+
 func GetOrSet[T any](ctx context.Context, key string, value T, ttl int) (bool, T, error) {
 	var ok bool
 	err := storage.db.Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
-		if err != nil && errors.Is(err, badger.ErrKeyNotFound) {
+		if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
 			return err
 		}
 		if item != nil {
@@ -115,18 +118,17 @@ func Delete(ctx context.Context, key string) error {
 	})
 }
 
+// Scan returns the values of the keys with prefix, all of them if limit <= 0.
 func Scan[T any](ctx context.Context, prefix string, limit int) ([]T, error) {
-	var ts = make([]T, 0, limit)
-	return ts, storage.db.View(func(txn *badger.Txn) error {
-
+	var ts []T
+	err := storage.db.View(func(txn *badger.Txn) error {
 		var opt = badger.DefaultIteratorOptions
 		if prefix != "" {
 			opt.Prefix = []byte(prefix)
 		}
 		iter := txn.NewIterator(opt)
-		var i int
-		for iter.Rewind(); iter.Valid() && i < limit; iter.Next() {
-			i++
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid() && (limit <= 0 || len(ts) < limit); iter.Next() {
 			var t T
 			err := iter.Item().Value(func(val []byte) error {
 				return json.Unmarshal(val, &t)
@@ -135,10 +137,8 @@ func Scan[T any](ctx context.Context, prefix string, limit int) ([]T, error) {
 				return err
 			}
 			ts = append(ts, t)
-			if len(ts) == limit {
-				return nil
-			}
 		}
 		return nil
 	})
+	return ts, err
 }
@@ -0,0 +1,353 @@
+// Package delta transfers a file as the difference to an older copy, like rsync:
+// the receiver signs the blocks of its copy, the sender finds them in the new content
+// with a rolling checksum and sends block references and the literal bytes between them.
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	MinBlockSize = 2 << 10
+	MaxBlockSize = 128 << 10
+	// maxLiteral bounds the literal bytes of an op
+	maxLiteral = 64 << 10
+)
+
+const (
+	opEnd     = 0
+	opCopy    = 1
+	opLiteral = 2
+)
+
+var ErrCorrupt = errors.New("corrupt delta")
+
+// BlockSize picks the block size for a file of size bytes, about its square root.
+func BlockSize(size int64) int {
+	var bs = int(math.Sqrt(float64(size)))
+	bs = (bs + 1023) &^ 1023
+	switch {
+	case bs < MinBlockSize:
+		return MinBlockSize
+	case bs > MaxBlockSize:
+		return MaxBlockSize
+	}
+	return bs
+}
+
+type Block struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// Signature identifies the blocks of a file, the last one may be short.
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []Block
+}
+
+// Sign reads r and returns the signature of its blocks.
+func Sign(r io.Reader, blockSize int) (*Signature, error) {
+	if blockSize < 1 || blockSize > MaxBlockSize {
+		return nil, errors.New("bad block size")
+	}
+	var sig = &Signature{BlockSize: blockSize}
+	var buf = make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Size += int64(n)
+			sig.Blocks = append(sig.Blocks, Block{Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WriteTo encodes the signature as block size, file size, block count and the blocks.
+func (s *Signature) WriteTo(w io.Writer) (int64, error) {
+	var bw = bufio.NewWriter(w)
+	var head = binary.AppendUvarint(nil, uint64(s.BlockSize))
+	head = binary.AppendUvarint(head, uint64(s.Size))
+	head = binary.AppendUvarint(head, uint64(len(s.Blocks)))
+	bw.Write(head)
+	var block [20]byte
+	for _, b := range s.Blocks {
+		binary.BigEndian.PutUint32(block[:], b.Weak)
+		copy(block[4:], b.Strong[:])
+		bw.Write(block[:])
+	}
+	return int64(len(head) + 20*len(s.Blocks)), bw.Flush()
+}
+
+// ReadSignature reads a signature written by WriteTo, it does not read past it.
+func ReadSignature(r io.Reader) (*Signature, error) {
+	var br = byteReader{r}
+	bs, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if bs < 1 || bs > MaxBlockSize || size > math.MaxInt64 || count != (size+bs-1)/bs {
+		return nil, ErrCorrupt
+	}
+	// the blocks are not allocated before they are read, count is not trusted
+	var sig = &Signature{BlockSize: int(bs), Size: int64(size), Blocks: make([]Block, 0, minInt(int(count), 1<<16))}
+	var block [20]byte
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(r, block[:]); err != nil {
+			return nil, err
+		}
+		var b = Block{Weak: binary.BigEndian.Uint32(block[:])}
+		copy(b.Strong[:], block[4:])
+		sig.Blocks = append(sig.Blocks, b)
+	}
+	return sig, nil
+}
+
+func (s *Signature) blockLen(i int) int {
+	if rest := s.Size - int64(i)*int64(s.BlockSize); rest < int64(s.BlockSize) {
+		return int(rest)
+	}
+	return s.BlockSize
+}
+
+// Stats counts the bytes of the new content sent as literals and as block references.
+type Stats struct {
+	Literal int64
+	Copied  int64
+}
+
+type encoder struct {
+	w       *bufio.Writer
+	sig     *Signature
+	index   map[uint32][]int
+	stats   Stats
+	copyAt  int
+	copyLen int
+}
+
+// Encode writes the delta turning the content signed by sig into the content of r.
+func Encode(w io.Writer, sig *Signature, r io.Reader) (Stats, error) {
+	var e = &encoder{w: bufio.NewWriter(w), sig: sig, index: make(map[uint32][]int, len(sig.Blocks))}
+	for i, b := range sig.Blocks {
+		e.index[b.Weak] = append(e.index[b.Weak], i)
+	}
+	var bs = sig.BlockSize
+	// buf[lit:pos] is the pending literal, buf[pos:pos+bs] the window
+	var buf = make([]byte, 0, maxLiteral+2*bs)
+	var lit, pos int
+	var eof bool
+	fill := func() error {
+		for !eof && len(buf)-pos < bs {
+			if cap(buf)-len(buf) < bs {
+				n := copy(buf, buf[lit:])
+				buf, pos, lit = buf[:n], pos-lit, 0
+			}
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	window := func() []byte {
+		return buf[pos:minInt(pos+bs, len(buf))]
+	}
+
+	if err := fill(); err != nil {
+		return e.stats, err
+	}
+	var sum = newRolling(window())
+	for pos < len(buf) {
+		if i, ok := e.match(sum.value(), window()); ok {
+			if err := e.literal(buf[lit:pos]); err != nil {
+				return e.stats, err
+			}
+			if err := e.copy(i); err != nil {
+				return e.stats, err
+			}
+			pos += e.sig.blockLen(i)
+			lit = pos
+			if err := fill(); err != nil {
+				return e.stats, err
+			}
+			sum = newRolling(window())
+			continue
+		}
+		if pos-lit+1 >= maxLiteral {
+			if err := e.literal(buf[lit : pos+1]); err != nil {
+				return e.stats, err
+			}
+			lit = pos + 1
+		}
+		var out = buf[pos]
+		pos++
+		if err := fill(); err != nil {
+			return e.stats, err
+		}
+		if pos+bs <= len(buf) {
+			sum.roll(out, buf[pos+bs-1])
+		} else {
+			sum.remove(out)
+		}
+	}
+	if err := e.literal(buf[lit:pos]); err != nil {
+		return e.stats, err
+	}
+	if err := e.flushCopy(); err != nil {
+		return e.stats, err
+	}
+	e.w.WriteByte(opEnd)
+	return e.stats, e.w.Flush()
+}
+
+// match finds the block of the window, only the last block of the signature can be short.
+func (e *encoder) match(weak uint32, window []byte) (int, bool) {
+	var candidates = e.index[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	var strong = strongSum(window)
+	for _, i := range candidates {
+		if e.sig.blockLen(i) == len(window) && e.sig.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// copy merges the references to consecutive blocks.
+func (e *encoder) copy(i int) error {
+	e.stats.Copied += int64(e.sig.blockLen(i))
+	if e.copyLen > 0 && e.copyAt+e.copyLen == i {
+		e.copyLen++
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyAt, e.copyLen = i, 1
+	return nil
+}
+
+func (e *encoder) flushCopy() error {
+	if e.copyLen == 0 {
+		return nil
+	}
+	var op = binary.AppendUvarint([]byte{opCopy}, uint64(e.copyAt))
+	op = binary.AppendUvarint(op, uint64(e.copyLen))
+	e.copyLen = 0
+	_, err := e.w.Write(op)
+	return err
+}
+
+func (e *encoder) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.stats.Literal += int64(len(data))
+	e.w.Write(binary.AppendUvarint([]byte{opLiteral}, uint64(len(data))))
+	_, err := e.w.Write(data)
+	return err
+}
+
+// Patch applies the delta read from r to base, the content signed by the receiver with blockSize,
+// and writes the new content to w. It does not read past the delta.
+func Patch(w io.Writer, base io.ReaderAt, blockSize int, r io.Reader) error {
+	var br = byteReader{r}
+	var buf = make([]byte, maxLiteral)
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opEnd:
+			return nil
+		case opCopy:
+			at, err := binary.ReadUvarint(br)
+			if err != nil {
+				return err
+			}
+			count, err := binary.ReadUvarint(br)
+			if err != nil {
+				return err
+			}
+			if count == 0 || at > math.MaxInt64/uint64(blockSize) || count > math.MaxInt64/uint64(blockSize)-at {
+				return ErrCorrupt
+			}
+			var section = io.NewSectionReader(base, int64(at)*int64(blockSize), int64(count)*int64(blockSize))
+			n, err := io.CopyBuffer(w, section, buf)
+			if err != nil {
+				return err
+			}
+			// only the last block is short
+			if n <= int64(count-1)*int64(blockSize) {
+				return ErrCorrupt
+			}
+		case opLiteral:
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return err
+			}
+			if n == 0 || n > maxLiteral {
+				return ErrCorrupt
+			}
+			if _, err := io.ReadFull(r, buf[:n]); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		default:
+			return ErrCorrupt
+		}
+	}
+}
+
+// byteReader reads the varints one byte at a time, so nothing after them is buffered.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+func strongSum(data []byte) [16]byte {
+	var sum = sha256.Sum256(data)
+	return *(*[16]byte)(sum[:16])
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,90 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	var rnd = rand.New(rand.NewSource(1))
+	var random = func(n int) []byte {
+		var b = make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	var base = random(1 << 20)
+	var join = func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	for _, c := range []struct {
+		name       string
+		base, data []byte
+		maxLiteral int64
+	}{
+		{"same", base, base, 0},
+		{"changed byte", base, join(base[:5000], []byte{^base[5000]}, base[5001:]), MinBlockSize},
+		{"inserted", base, join(base[:300000], random(100), base[300000:]), MinBlockSize + 100},
+		{"deleted", base, join(base[:300000], base[300100:]), MinBlockSize},
+		{"appended", base, join(base, random(10)), 10},
+		{"truncated", base, base[:len(base)-10], MinBlockSize},
+		{"moved", base, join(base[500000:], base[:500000]), 2 * MinBlockSize},
+		{"short tail", base[:5000], join(random(7), base[:5000]), 7},
+		{"new", base, random(100000), 100000},
+		{"empty base", nil, base[:5000], 5000},
+		{"empty", base, nil, 0},
+	} {
+		var bs = BlockSize(int64(len(c.base)))
+		sig, err := Sign(bytes.NewReader(c.base), bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sigBuf bytes.Buffer
+		if _, err := sig.WriteTo(&sigBuf); err != nil {
+			t.Fatal(err)
+		}
+		sigBuf.WriteString("after")
+		sig, err = ReadSignature(&sigBuf)
+		if err != nil || sigBuf.String() != "after" {
+			t.Fatalf("%s: read signature error %v, left %q", c.name, err, sigBuf.String())
+		}
+
+		var delta bytes.Buffer
+		stats, err := Encode(&delta, sig, bytes.NewReader(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Literal > c.maxLiteral || stats.Literal+stats.Copied != int64(len(c.data)) {
+			t.Fatalf("%s: stats %+v of %d bytes", c.name, stats, len(c.data))
+		}
+		delta.WriteString("after")
+		var out bytes.Buffer
+		if err := Patch(&out, bytes.NewReader(c.base), bs, &delta); err != nil {
+			t.Fatalf("%s: patch error %v", c.name, err)
+		}
+		if !bytes.Equal(out.Bytes(), c.data) {
+			t.Fatalf("%s: patched content differs", c.name)
+		}
+		if delta.String() != "after" {
+			t.Fatalf("%s: patch read past the delta", c.name)
+		}
+	}
+}
+
+func TestRolling(t *testing.T) {
+	var data = []byte("the quick brown fox jumps over the lazy dog")
+	const n = 8
+	var r = newRolling(data[:n])
+	for i := 1; i+n <= len(data); i++ {
+		r.roll(data[i-1], data[i+n-1])
+		if r.value() != weakSum(data[i:i+n]) {
+			t.Fatalf("rolled sum at %d differs", i)
+		}
+	}
+	for i := len(data) - n + 1; i < len(data); i++ {
+		r.remove(data[i-1])
+		if r.value() != weakSum(data[i:]) {
+			t.Fatalf("removed sum at %d differs", i)
+		}
+	}
+}
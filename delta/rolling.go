@@ -0,0 +1,37 @@
+package delta
+
+// rolling is the rsync weak checksum of a window, it slides by a byte in constant time.
+type rolling struct {
+	a, b, n uint32
+}
+
+func newRolling(window []byte) rolling {
+	var r = rolling{n: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+	return r
+}
+
+func (r *rolling) value() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// roll drops out from the start of the window and appends in.
+func (r *rolling) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+// remove drops out from the start of the window, at the end of the content.
+func (r *rolling) remove(out byte) {
+	r.a -= uint32(out)
+	r.b -= r.n * uint32(out)
+	r.n--
+}
+
+func weakSum(data []byte) uint32 {
+	var r = newRolling(data)
+	return r.value()
+}
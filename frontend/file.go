@@ -3,14 +3,24 @@ package frontend
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/yixinin/puup/config"
+	"github.com/yixinin/puup/delta"
 	pnet "github.com/yixinin/puup/net"
 	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/proto"
+	"github.com/yixinin/puup/stderr"
 )
 
 type CopyFile struct {
@@ -22,6 +32,10 @@ type CopyFile struct {
 type FileClient struct {
 	serverName string
 	sigAddr    string
+	token      string
+
+	// Progress is called as the content of a file is transferred, done starts at the resumed offset.
+	Progress func(local string, done, total uint64)
 
 	ch chan CopyFile
 }
@@ -30,6 +44,7 @@ func NewFileClient(cfg *config.Config) *FileClient {
 	return &FileClient{
 		serverName: cfg.ServerName,
 		sigAddr:    cfg.SigAddr,
+		token:      cfg.Token,
 		ch:         make(chan CopyFile, 1),
 	}
 }
@@ -43,7 +58,7 @@ func (c *FileClient) Run(ctx context.Context) error {
 			if !ok {
 				return net.ErrClosed
 			}
-			err := c.handle(file)
+			err := c.handle(ctx, file)
 			if err != nil {
 				logrus.Errorf("scp file error:%v", err)
 			}
@@ -51,79 +66,288 @@ func (c *FileClient) Run(ctx context.Context) error {
 	}
 }
 
-func (c *FileClient) handle(file CopyFile) error {
-	conn, err := pnet.Dial(c.sigAddr, c.serverName, conn.File)
+func (c *FileClient) handle(ctx context.Context, file CopyFile) error {
+	switch file.mode {
+	case "pull":
+		return c.Download(ctx, file.remoteName, file.localName)
+	case "push":
+		return c.Push(ctx, file.localName, file.remoteName)
+	}
+	return stderr.New("unknown copy mode " + file.mode)
+}
+
+var (
+	// UploadRetries is how many times an interrupted upload or download is resumed.
+	UploadRetries = 3
+	// DeltaMin is the size from which files replacing an older copy are sent as deltas.
+	DeltaMin int64 = 1 << 20
+)
+
+// Push uploads local to remote, a directory is synced recursively.
+func (c *FileClient) Push(ctx context.Context, local, remote string) error {
+	info, err := os.Stat(local)
 	if err != nil {
 		return err
 	}
+	if !info.IsDir() {
+		return c.Upload(ctx, local, remote)
+	}
+	_, err = c.Sync(ctx, local, remote, SyncOptions{})
+	return err
+}
 
-	switch file.mode {
-	case "pull":
-		for {
-			rd := bufio.NewReader(conn)
-			line, _, err := rd.ReadLine()
-			if err != nil {
-				return err
-			}
-			filename := string(line)
-			for {
-				err := func() error {
-					f, err := os.Create(filename)
-					if err != nil {
-						return err
-					}
-					if _, err := io.Copy(f, conn); err != nil && err != io.EOF {
-						return err
-					}
-					return err
-				}()
-				if err != nil {
-					return err
-				}
-			}
+// Upload sends the file local to the backend as remote,
+// an interrupted upload resumes from the bytes the backend has.
+func (c *FileClient) Upload(ctx context.Context, local, remote string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var hash = sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return err
+	}
+	var req = proto.FileReq{
+		Path:    remote,
+		Size:    uint64(size),
+		Etag:    hex.EncodeToString(hash.Sum(nil)),
+		Mode:    uint32(info.Mode().Perm()),
+		ModTime: info.ModTime().UnixNano(),
+		Delta:   size >= DeltaMin,
+	}
+	for i := 0; ; i++ {
+		err = c.upload(f, local, req)
+		var ackErr *FileError
+		// the backend may not have seen the interrupted channel closed yet
+		if err == nil || errors.As(err, &ackErr) && ackErr.Code != proto.FileError && ackErr.Code != proto.FileBusy ||
+			i >= UploadRetries {
+			return err
 		}
-	case "push":
-		f, err := os.Open(file.localName)
+		logrus.Warnf("upload %s interrupted, resume:%v", local, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second << i):
+		}
+	}
+}
+
+func (c *FileClient) upload(f *os.File, local string, req proto.FileReq) error {
+	rconn, err := pnet.Dial(c.sigAddr, c.serverName, c.token, conn.File)
+	if err != nil {
+		return err
+	}
+	defer rconn.Close()
+	if err := proto.WriteFrame(rconn, req); err != nil {
+		return err
+	}
+	var ack proto.UploadAck
+	if err := proto.ReadFrame(rconn, &ack); err != nil {
+		return err
+	}
+	if ack.Code != proto.FileOk {
+		return &FileError{Code: ack.Code, Msg: ack.Msg}
+	}
+	if ack.Offset > req.Size {
+		return stderr.New("bad upload offset")
+	}
+	if _, err := f.Seek(int64(ack.Offset), io.SeekStart); err != nil {
+		return err
+	}
+	var r = io.TeeReader(f, c.progress(local, ack.Offset, req.Size))
+	if ack.Delta {
+		sig, err := delta.ReadSignature(rconn)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		info, err := f.Stat()
+		stats, err := delta.Encode(rconn, sig, r)
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			return c.CopyFs(conn, f, file.remoteName)
-		}
-		fs, err := f.ReadDir(-1)
-		if err != nil {
+		logrus.Infof("upload %s as delta, literal:%d copied:%d", req.Path, stats.Literal, stats.Copied)
+	} else if _, err := io.CopyN(rconn, r, int64(req.Size-ack.Offset)); err != nil {
+		return err
+	}
+	if err := proto.ReadFrame(rconn, &ack); err != nil {
+		return err
+	}
+	if ack.Code != proto.FileOk {
+		return &FileError{Code: ack.Code, Msg: ack.Msg}
+	}
+	return nil
+}
+
+// Download fetches remote into local, an interrupted download resumes from
+// the partial file kept next to local if the remote content has not changed.
+func (c *FileClient) Download(ctx context.Context, remote, local string) error {
+	for i := 0; ; i++ {
+		err := c.download(remote, local)
+		// a mismatch removes the corrupted partial file, the retry starts over
+		var ackErr *FileError
+		if err == nil || errors.As(err, &ackErr) && ackErr.Code != proto.FileError && ackErr.Code != proto.FileMismatch ||
+			i >= UploadRetries {
 			return err
 		}
-		for _, e := range fs {
-			if err := c.CopyFile(conn, e.Name(), e.Name()); err != nil {
-				return err
-			}
+		logrus.Warnf("download %s failed, retry:%v", remote, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second << i):
 		}
 	}
-
-	return nil
 }
 
-func (c *FileClient) CopyFile(conn net.Conn, src, dst string) error {
-	f, err := os.Open(src)
+func (c *FileClient) download(remote, local string) error {
+	var partial, etag = findPartial(local)
+	var offset uint64
+	if info, err := os.Stat(partial); err == nil {
+		offset = uint64(info.Size())
+	}
+	// without a partial file, the local copy is the base of a delta
+	var base *os.File
+	var sig *delta.Signature
+	if partial == "" {
+		if base, sig = deltaBase(local); base != nil {
+			defer base.Close()
+		}
+	}
+	rconn, err := pnet.Dial(c.sigAddr, c.serverName, c.token, conn.File)
+	if err != nil {
+		return err
+	}
+	defer rconn.Close()
+	err = proto.WriteFrame(rconn, proto.FileReq{Op: proto.FileDownload, Path: remote, Etag: etag, Offset: offset, Delta: sig != nil})
+	if err != nil {
+		return err
+	}
+	if sig != nil {
+		if _, err := sig.WriteTo(rconn); err != nil {
+			return err
+		}
+	}
+	var ack proto.DownloadAck
+	if err := proto.ReadFrame(rconn, &ack); err != nil {
+		return err
+	}
+	if ack.Code != proto.FileOk {
+		return &FileError{Code: ack.Code, Msg: ack.Msg}
+	}
+	// the remote content changed, the partial file is stale
+	if ack.Etag != etag || ack.Offset != offset {
+		if partial != "" {
+			os.Remove(partial)
+		}
+		partial, offset = local+"."+ack.Etag+partialExt, 0
+	}
+	if ack.Offset != offset {
+		return stderr.New("bad download offset")
+	}
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	conn.Write([]byte(dst))
-	conn.Write([]byte{'\n'})
-	_, err = io.Copy(conn, f)
-	return err
+	// a stale partial file may be longer than the bytes resumed
+	if err := f.Truncate(int64(offset)); err != nil {
+		return err
+	}
+	var hash = sha256.New()
+	if _, err := io.CopyN(hash, f, int64(offset)); err != nil {
+		return err
+	}
+	var w = io.MultiWriter(f, hash, c.progress(local, offset, ack.Size))
+	if ack.Delta && sig != nil {
+		err = delta.Patch(w, base, sig.BlockSize, rconn)
+	} else {
+		_, err = io.CopyN(w, rconn, int64(ack.Size-offset))
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != ack.Etag {
+		os.Remove(partial)
+		return &FileError{Code: proto.FileMismatch, Msg: "content does not match etag"}
+	}
+	if err := os.Rename(partial, local); err != nil {
+		return err
+	}
+	return setMeta(local, proto.FileInfo{Mode: ack.Mode, ModTime: ack.ModTime})
 }
 
-func (c *FileClient) CopyFs(conn net.Conn, src *os.File, dst string) error {
-	conn.Write([]byte(dst))
-	conn.Write([]byte{'\n'})
-	_, err := io.Copy(conn, src)
-	return err
+// deltaBase opens and signs local if it is large enough for a delta.
+func deltaBase(local string) (*os.File, *delta.Signature) {
+	f, err := os.Open(local)
+	if err != nil {
+		return nil, nil
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() < DeltaMin {
+		f.Close()
+		return nil, nil
+	}
+	sig, err := delta.Sign(bufio.NewReader(f), delta.BlockSize(info.Size()))
+	if err != nil {
+		f.Close()
+		logrus.Errorf("sign %s error:%v", local, err)
+		return nil, nil
+	}
+	return f, sig
+}
+
+// progress reports the bytes written to it to c.Progress.
+func (c *FileClient) progress(local string, done, total uint64) io.Writer {
+	if c.Progress == nil {
+		return io.Discard
+	}
+	c.Progress(local, done, total)
+	return &progressWriter{fn: c.Progress, local: local, done: done, total: total}
+}
+
+type progressWriter struct {
+	fn          func(local string, done, total uint64)
+	local       string
+	done, total uint64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.done += uint64(len(p))
+	w.fn(w.local, w.done, w.total)
+	return len(p), nil
+}
+
+const partialExt = ".part"
+
+// findPartial returns the partial download of local and the etag in its name, "<local>.<etag>.part".
+func findPartial(local string) (string, string) {
+	entries, err := os.ReadDir(filepath.Dir(local))
+	if err != nil {
+		return "", ""
+	}
+	var prefix = filepath.Base(local) + "."
+	for _, e := range entries {
+		etag, ok := strings.CutSuffix(strings.TrimPrefix(e.Name(), prefix), partialExt)
+		if ok && len(etag) == 2*sha256.Size && strings.HasPrefix(e.Name(), prefix) {
+			return filepath.Join(filepath.Dir(local), e.Name()), etag
+		}
+	}
+	return "", ""
+}
+
+// FileError is a file request refused by the backend.
+type FileError struct {
+	Code int
+	Msg  string
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("file request refused, code:%d msg:%s", e.Code, e.Msg)
 }
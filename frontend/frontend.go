@@ -6,12 +6,19 @@ import (
 
 	"github.com/pion/webrtc/v3"
 	"github.com/yixinin/puup/config"
+	"github.com/yixinin/puup/ice"
+	"github.com/yixinin/puup/identity"
+	"github.com/yixinin/puup/metrics"
+	pnet "github.com/yixinin/puup/net"
 	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/stderr"
 )
 
 type FrontEnd struct {
 	proxy *ProxyClient
 	file  *FileClient
+
+	metrics string
 }
 
 func NewFrontEnd(filename string) (*FrontEnd, error) {
@@ -19,8 +26,10 @@ func NewFrontEnd(filename string) (*FrontEnd, error) {
 	if err != nil {
 		return nil, err
 	}
-	f := &FrontEnd{}
-
+	f := &FrontEnd{metrics: cfg.Metrics}
+	if err := Configure(cfg); err != nil {
+		return nil, err
+	}
 	proxy, err := NewProxy(cfg, webrtc.SDPTypeOffer)
 	if err != nil {
 		return nil, err
@@ -30,7 +39,52 @@ func NewFrontEnd(filename string) (*FrontEnd, error) {
 	return f, nil
 }
 
+// Configure sets up the connections to cfg.ServerName and the channel options of cfg.
+func Configure(cfg *config.Config) error {
+	kh, err := identity.NewKnownHosts(cfg.KnownHosts, cfg.ServerName, cfg.Fingerprints[cfg.ServerName])
+	if err != nil {
+		return err
+	}
+	pnet.SetVerifier(cfg.ServerName, kh)
+	pnet.SetBalancer(cfg.ServerName, pnet.NewBalancer(cfg.Balance))
+	pnet.SetClientId(cfg.ServerName, cfg.ClientId)
+	iceCfg, err := ice.NewConfiguration(cfg)
+	if err != nil {
+		return err
+	}
+	ice.SetConfig(iceCfg)
+	conn.Multiplex = cfg.Mux
+	switch mode := conn.RelayMode(cfg.Relay); mode {
+	case "":
+	case conn.RelayAuto, conn.RelayOff, conn.RelayOnly:
+		conn.Relay = mode
+	default:
+		return stderr.New("unknown relay mode " + cfg.Relay)
+	}
+	if cfg.RelayAfter > 0 {
+		conn.RelayAfter = cfg.RelayAfter
+	}
+	if cfg.ReconnectGrace != 0 {
+		conn.ReconnectGrace = cfg.ReconnectGrace
+	}
+	if cfg.KeepaliveInterval > 0 {
+		conn.KeepaliveInterval = cfg.KeepaliveInterval
+	}
+	if cfg.KeepaliveMaxMissed != 0 {
+		conn.KeepaliveMaxMissed = cfg.KeepaliveMaxMissed
+	}
+	if fc := cfg.FlowControl; fc != nil {
+		conn.SetFlowControl(fc.SendHighWater, fc.SendLowWater, fc.RecvWindow)
+	}
+	return nil
+}
+
 func (f *FrontEnd) Run(ctx context.Context) error {
+	if f.metrics != "" {
+		conn.GoFunc(ctx, func(ctx context.Context) error {
+			return metrics.Serve(f.metrics)
+		})
+	}
 	var wg sync.WaitGroup
 	wg.Add(2)
 	conn.GoFunc(ctx, func(ctx context.Context) error {
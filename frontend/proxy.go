@@ -2,16 +2,17 @@ package frontend
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
 	"github.com/yixinin/puup/config"
 	pnet "github.com/yixinin/puup/net"
 	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/proto"
 	"github.com/yixinin/puup/stderr"
 )
 
@@ -19,27 +20,76 @@ type ProxyClient struct {
 	Type       webrtc.SDPType
 	sigAddr    string
 	serverName string
+	token      string
 	ports      map[uint16]uint16
+	udpPorts   map[uint16]uint16
+	udpIdle    time.Duration
+	reverses   []config.ProxyReverse
+	socksAddr  string
+	httpAddr   string
 }
 
 func NewProxy(cfg *config.Config, pt webrtc.SDPType) (*ProxyClient, error) {
 	var ports = make(map[uint16]uint16)
+	var udpPorts = make(map[uint16]uint16)
 	for _, v := range cfg.ProxyFront {
-		ports[v.Local] = v.Remote
+		switch v.Network {
+		case "", "tcp":
+			ports[v.Local] = v.Remote
+		case "udp":
+			udpPorts[v.Local] = v.Remote
+		default:
+			return nil, stderr.New("unknown proxy network " + v.Network)
+		}
+	}
+	var udpIdle = cfg.UdpIdleTimeout
+	if udpIdle <= 0 {
+		udpIdle = defaultUdpIdleTimeout
 	}
 	return &ProxyClient{
 		Type:       pt,
 		sigAddr:    cfg.SigAddr,
 		serverName: cfg.ServerName,
+		token:      cfg.Token,
 		ports:      ports,
+		udpPorts:   udpPorts,
+		udpIdle:    udpIdle,
+		reverses:   cfg.ProxyReverse,
+		socksAddr:  cfg.ProxySocks,
+		httpAddr:   cfg.ProxyHttp,
 	}, nil
 }
 func (p *ProxyClient) Run(ctx context.Context) error {
+	for _, r := range p.reverses {
+		r := r
+		conn.GoFunc(ctx, func(ctx context.Context) error {
+			return p.runReverse(ctx, r)
+		})
+	}
+	if p.socksAddr != "" {
+		conn.GoFunc(ctx, func(ctx context.Context) error {
+			return p.runSocks(p.socksAddr)
+		})
+	}
+	if p.httpAddr != "" {
+		conn.GoFunc(ctx, func(ctx context.Context) error {
+			return p.runHttp(p.httpAddr)
+		})
+	}
 	return p.runForwards()
 }
 
 func (p *ProxyClient) runForwards() error {
 	var wg sync.WaitGroup
+	for local, remote := range p.udpPorts {
+		wg.Add(1)
+		l := local
+		r := remote
+		conn.GoFunc(context.TODO(), func(ctx context.Context) error {
+			defer wg.Done()
+			return p.runDatagram(l, r)
+		})
+	}
 	for local, remote := range p.ports {
 		wg.Add(1)
 		l := local
@@ -62,16 +112,11 @@ func (p *ProxyClient) runForward(localPort, remotePort uint16) error {
 		if err != nil {
 			return stderr.Wrap(err)
 		}
-		rconn, err := pnet.Dial(p.sigAddr, p.serverName, conn.Proxy)
+		rconn, _, err := p.dialRemote(lconn, proto.NewProxyHeader("", remotePort))
 		if err != nil {
-			return stderr.Wrap(err)
-		}
-		var header = make([]byte, 2)
-		binary.BigEndian.PutUint16(header, remotePort)
-		logrus.Debugf("proxy %s, on port: %d, write header:%v", rconn.RemoteAddr(), remotePort, header)
-		_, err = rconn.Write(header)
-		if err != nil {
-			return err
+			logrus.Errorf("proxy port %d error:%v", remotePort, err)
+			lconn.Close()
+			continue
 		}
 		logrus.Debugf("proxy %s, on port: %d, start to copy data", rconn.RemoteAddr(), remotePort)
 		conn.GoFunc(context.TODO(), func(ctx context.Context) error {
@@ -82,3 +127,90 @@ func (p *ProxyClient) runForward(localPort, remotePort uint16) error {
 		})
 	}
 }
+
+// dialRemote opens a proxy channel for lconn and waits for the backend to accept header,
+// the ack is returned with a nil conn when the backend refused.
+func (p *ProxyClient) dialRemote(lconn net.Conn, header proto.ProxyHeader) (net.Conn, proto.ProxyAck, error) {
+	var ack proto.ProxyAck
+	// stick the connections of one source host to the same backend
+	host, _, _ := net.SplitHostPort(lconn.RemoteAddr().String())
+	rconn, err := pnet.DialKey(p.sigAddr, p.serverName, p.token, host, conn.Proxy)
+	if err != nil {
+		ack.Code = proto.ProxyUnreachable
+		return nil, ack, err
+	}
+	logrus.Debugf("proxy %s, write header:%+v", rconn.RemoteAddr(), header)
+	if err = proto.WriteFrame(rconn, header); err == nil {
+		err = proto.ReadFrame(rconn, &ack)
+	}
+	if err != nil {
+		rconn.(*pnet.Conn).Release()
+		ack.Code = proto.ProxyUnreachable
+		return nil, ack, err
+	}
+	if ack.Code != proto.ProxyOk {
+		rconn.(*pnet.Conn).Release()
+		return nil, ack, stderr.New(fmt.Sprintf("proxy refused, code:%d, msg:%s", ack.Code, ack.Msg))
+	}
+	return rconn, ack, nil
+}
+
+// runReverse keeps the backend listening on r.Remote and forwards its connections to r.Local.
+func (p *ProxyClient) runReverse(ctx context.Context, r config.ProxyReverse) error {
+	for {
+		err := p.serveReverse(r)
+		logrus.Errorf("reverse proxy %d -> %s stopped:%v", r.Remote, r.Local, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (p *ProxyClient) serveReverse(r config.ProxyReverse) error {
+	ctrl, err := pnet.Dial(p.sigAddr, p.serverName, p.token, conn.Proxy)
+	if err != nil {
+		return err
+	}
+	defer ctrl.(*pnet.Conn).Release()
+	if err := proto.WriteFrame(ctrl, proto.ProxyHeader{Version: proto.ProxyVersion, Mode: proto.ProxyListen, Port: r.Remote}); err != nil {
+		return err
+	}
+	var ack proto.ProxyAck
+	if err := proto.ReadFrame(ctrl, &ack); err != nil {
+		return err
+	}
+	if ack.Code != proto.ProxyOk {
+		return stderr.New(fmt.Sprintf("reverse listen refused, code:%d, msg:%s", ack.Code, ack.Msg))
+	}
+	for {
+		var notice proto.ProxyNotice
+		if err := proto.ReadFrame(ctrl, &notice); err != nil {
+			return err
+		}
+		logrus.Debugf("reverse proxy %d accepted %s", r.Remote, notice.Remote)
+		conn.GoFunc(context.TODO(), func(ctx context.Context) error {
+			return p.attachReverse(r, notice)
+		})
+	}
+}
+
+func (p *ProxyClient) attachReverse(r config.ProxyReverse, notice proto.ProxyNotice) error {
+	lconn, err := net.Dial("tcp", r.Local)
+	if err != nil {
+		return stderr.Wrap(err)
+	}
+	// the connection waits on the backend which sent the notice
+	rconn, err := pnet.DialBackend(p.sigAddr, p.serverName, p.token, notice.Backend, conn.Proxy)
+	if err != nil {
+		lconn.Close()
+		return err
+	}
+	defer rconn.(*pnet.Conn).Release()
+	if err := proto.WriteFrame(rconn, proto.ProxyHeader{Version: proto.ProxyVersion, Mode: proto.ProxyAttach, Id: notice.Id}); err != nil {
+		lconn.Close()
+		return err
+	}
+	return conn.GoCopy(lconn, rconn)
+}
@@ -0,0 +1,232 @@
+package frontend
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	pnet "github.com/yixinin/puup/net"
+	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/proto"
+	"github.com/yixinin/puup/stderr"
+)
+
+const (
+	socks5Version = 0x05
+
+	socksNoAuth       = 0x00
+	socksNoAcceptable = 0xff
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNotAllowed          = 0x02
+	socksHostUnreachable     = 0x04
+	socksCommandNotSupported = 0x07
+	socksAddrNotSupported    = 0x08
+)
+
+// runSocks serves socks5 CONNECT on addr, the destination is dialed by the backend.
+func (p *ProxyClient) runSocks(addr string) error {
+	return p.serveDynamic(addr, p.serveSocks)
+}
+
+// runHttp serves http CONNECT on addr, the destination is dialed by the backend.
+func (p *ProxyClient) runHttp(addr string) error {
+	return p.serveDynamic(addr, p.serveHttp)
+}
+
+func (p *ProxyClient) serveDynamic(addr string, serve func(lconn net.Conn) error) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return stderr.Wrap(err)
+	}
+	logrus.Infof("dynamic proxy listen on %s", lis.Addr())
+	for {
+		lconn, err := lis.Accept()
+		if err != nil {
+			return stderr.Wrap(err)
+		}
+		conn.GoFunc(context.TODO(), func(ctx context.Context) error {
+			return serve(lconn)
+		})
+	}
+}
+
+func (p *ProxyClient) serveSocks(lconn net.Conn) error {
+	var buf = make([]byte, 262)
+	// greeting: version, methods
+	if _, err := io.ReadFull(lconn, buf[:2]); err != nil {
+		lconn.Close()
+		return stderr.Wrap(err)
+	}
+	if buf[0] != socks5Version {
+		lconn.Close()
+		return stderr.New("unsupported socks version " + strconv.Itoa(int(buf[0])))
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(lconn, methods); err != nil {
+		lconn.Close()
+		return stderr.Wrap(err)
+	}
+	var method byte = socksNoAcceptable
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := lconn.Write([]byte{socks5Version, method}); err != nil || method == socksNoAcceptable {
+		lconn.Close()
+		return stderr.New("no acceptable socks auth method")
+	}
+
+	// request: version, cmd, reserved, address type
+	if _, err := io.ReadFull(lconn, buf[:4]); err != nil {
+		lconn.Close()
+		return stderr.Wrap(err)
+	}
+	if buf[1] != socksConnect {
+		socksReply(lconn, socksCommandNotSupported)
+		return stderr.New("unsupported socks command " + strconv.Itoa(int(buf[1])))
+	}
+	var host string
+	switch buf[3] {
+	case socksIPv4:
+		if _, err := io.ReadFull(lconn, buf[:net.IPv4len]); err != nil {
+			lconn.Close()
+			return stderr.Wrap(err)
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socksIPv6:
+		if _, err := io.ReadFull(lconn, buf[:net.IPv6len]); err != nil {
+			lconn.Close()
+			return stderr.Wrap(err)
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socksDomain:
+		if _, err := io.ReadFull(lconn, buf[:1]); err != nil {
+			lconn.Close()
+			return stderr.Wrap(err)
+		}
+		size := int(buf[0])
+		if _, err := io.ReadFull(lconn, buf[:size]); err != nil {
+			lconn.Close()
+			return stderr.Wrap(err)
+		}
+		host = string(buf[:size])
+	default:
+		socksReply(lconn, socksAddrNotSupported)
+		return stderr.New("unsupported socks address type " + strconv.Itoa(int(buf[3])))
+	}
+	if _, err := io.ReadFull(lconn, buf[:2]); err != nil {
+		lconn.Close()
+		return stderr.Wrap(err)
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+
+	rconn, ack, err := p.dialRemote(lconn, proto.NewProxyHeader(host, port))
+	if err != nil {
+		socksReply(lconn, socksReplyCode(ack.Code))
+		return err
+	}
+	if err := socksReply(lconn, socksSucceeded); err != nil {
+		rconn.(*pnet.Conn).Release()
+		return err
+	}
+	logrus.Debugf("socks %s to %s", lconn.RemoteAddr(), net.JoinHostPort(host, strconv.Itoa(int(port))))
+	defer rconn.(*pnet.Conn).Release()
+	return conn.GoCopy(lconn, rconn)
+}
+
+func socksReplyCode(code int) byte {
+	switch code {
+	case proto.ProxyDenied:
+		return socksNotAllowed
+	case proto.ProxyUnreachable:
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// socksReply answers the request with a zero bind address, the connection is closed on failure.
+func socksReply(lconn net.Conn, code byte) error {
+	_, err := lconn.Write([]byte{socks5Version, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil || code != socksSucceeded {
+		lconn.Close()
+	}
+	return err
+}
+
+// bufConn reads what the http parser buffered before the connection.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return net.ErrClosed
+}
+
+func (p *ProxyClient) serveHttp(lconn net.Conn) error {
+	br := bufio.NewReader(lconn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		lconn.Close()
+		return stderr.Wrap(err)
+	}
+	if req.Method != http.MethodConnect {
+		httpReply(lconn, http.StatusMethodNotAllowed)
+		return stderr.New("unsupported http proxy method " + req.Method)
+	}
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		httpReply(lconn, http.StatusBadRequest)
+		return stderr.Wrap(err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		httpReply(lconn, http.StatusBadRequest)
+		return stderr.Wrap(err)
+	}
+
+	rconn, ack, err := p.dialRemote(lconn, proto.NewProxyHeader(host, uint16(port)))
+	if err != nil {
+		switch ack.Code {
+		case proto.ProxyDenied:
+			httpReply(lconn, http.StatusForbidden)
+		default:
+			httpReply(lconn, http.StatusBadGateway)
+		}
+		return err
+	}
+	if _, err := io.WriteString(lconn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		lconn.Close()
+		rconn.(*pnet.Conn).Release()
+		return stderr.Wrap(err)
+	}
+	logrus.Debugf("http connect %s to %s", lconn.RemoteAddr(), req.Host)
+	defer rconn.(*pnet.Conn).Release()
+	return conn.GoCopy(&bufConn{Conn: lconn, r: br}, rconn)
+}
+
+func httpReply(lconn net.Conn, code int) {
+	io.WriteString(lconn, "HTTP/1.1 "+strconv.Itoa(code)+" "+http.StatusText(code)+"\r\nContent-Length: 0\r\n\r\n")
+	lconn.Close()
+}
@@ -24,16 +24,18 @@ type SshHeader struct {
 
 type SshClient struct {
 	sigAddr string
+	token   string
 }
 
-func NewSshClient(sigAddr string) *SshClient {
+func NewSshClient(sigAddr, token string) *SshClient {
 	return &SshClient{
 		sigAddr: sigAddr,
+		token:   token,
 	}
 }
 
 func (c *SshClient) Run(user, name, pass string) error {
-	rconn, err := net.Dial(c.sigAddr, name, conn.Ssh)
+	rconn, err := net.Dial(c.sigAddr, name, c.token, conn.Ssh)
 	if err != nil {
 		return err
 	}
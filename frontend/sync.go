@@ -0,0 +1,271 @@
+package frontend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	pnet "github.com/yixinin/puup/net"
+	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/proto"
+	"github.com/yixinin/puup/stderr"
+)
+
+// SyncOptions changes what Sync does.
+type SyncOptions struct {
+	Pull   bool // copy the remote files to local, local to remote if false
+	Delete bool // delete the destination files missing from the source
+	DryRun bool // only plan the actions
+}
+
+type SyncOp string
+
+const (
+	SyncCopy   SyncOp = "copy"
+	SyncMeta   SyncOp = "meta" // same content, only the mode or mtime is updated
+	SyncDelete SyncOp = "delete"
+)
+
+// SyncAction is a change of the destination, Path is relative to the synced directories.
+type SyncAction struct {
+	Op   SyncOp
+	Path string
+	Size uint64
+}
+
+func (a SyncAction) String() string {
+	if a.Op == SyncCopy {
+		return fmt.Sprintf("%s %s (%d bytes)", a.Op, a.Path, a.Size)
+	}
+	return fmt.Sprintf("%s %s", a.Op, a.Path)
+}
+
+// Sync makes the remote directory a copy of the local one, or the other way with opt.Pull.
+// Files are copied if their sizes differ, or their contents when their mtimes differ,
+// mode and mtime are kept.
+func (c *FileClient) Sync(ctx context.Context, local, remote string, opt SyncOptions) ([]SyncAction, error) {
+	locals, err := scanLocal(local)
+	if err != nil && !(opt.Pull && os.IsNotExist(err)) {
+		return nil, err
+	}
+	remotes, err := c.List(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	actions, err := planSync(locals, remotes, opt)
+	if err != nil || opt.DryRun {
+		return actions, err
+	}
+	for i, a := range actions {
+		var localPath = filepath.Join(local, filepath.FromSlash(a.Path))
+		var remotePath = path.Join(remote, a.Path)
+		switch {
+		case a.Op == SyncDelete && opt.Pull:
+			err = os.Remove(localPath)
+		case a.Op == SyncDelete:
+			err = c.Delete(ctx, remotePath)
+		case opt.Pull && a.Op == SyncMeta:
+			err = setMeta(localPath, remotes[a.Path])
+		case opt.Pull:
+			if err = os.MkdirAll(filepath.Dir(localPath), 0755); err == nil {
+				err = c.Download(ctx, remotePath, localPath)
+			}
+		default:
+			// the backend has the content of a meta change, only the request is sent
+			err = c.Upload(ctx, localPath, remotePath)
+		}
+		if err != nil {
+			return actions[:i], err
+		}
+	}
+	return actions, nil
+}
+
+// List returns the remote files under dir, their paths are relative to dir.
+func (c *FileClient) List(ctx context.Context, dir string) (map[string]proto.FileInfo, error) {
+	rconn, err := pnet.Dial(c.sigAddr, c.serverName, c.token, conn.File)
+	if err != nil {
+		return nil, err
+	}
+	defer rconn.Close()
+	if err := proto.WriteFrame(rconn, proto.FileReq{Op: proto.FileList, Path: dir}); err != nil {
+		return nil, err
+	}
+	var ack proto.ListAck
+	if err := proto.ReadFrame(rconn, &ack); err != nil {
+		return nil, err
+	}
+	if ack.Code != proto.FileOk {
+		return nil, &FileError{Code: ack.Code, Msg: ack.Msg}
+	}
+	var files = make(map[string]proto.FileInfo, ack.Count)
+	for i := 0; i < ack.Count; i++ {
+		var info proto.FileInfo
+		if err := proto.ReadFrame(rconn, &info); err != nil {
+			return nil, err
+		}
+		files[info.Path] = info
+	}
+	return files, nil
+}
+
+// Delete removes the remote file.
+func (c *FileClient) Delete(ctx context.Context, remote string) error {
+	rconn, err := pnet.Dial(c.sigAddr, c.serverName, c.token, conn.File)
+	if err != nil {
+		return err
+	}
+	defer rconn.Close()
+	if err := proto.WriteFrame(rconn, proto.FileReq{Op: proto.FileDelete, Path: remote}); err != nil {
+		return err
+	}
+	var ack proto.FileAck
+	if err := proto.ReadFrame(rconn, &ack); err != nil {
+		return err
+	}
+	if ack.Code != proto.FileOk {
+		return &FileError{Code: ack.Code, Msg: ack.Msg}
+	}
+	return nil
+}
+
+type localFile struct {
+	path    string
+	size    uint64
+	mode    uint32
+	modTime int64
+}
+
+// scanLocal returns the regular files under dir by their slash separated relative paths,
+// partial downloads are skipped.
+func scanLocal(dir string) (map[string]localFile, error) {
+	var files = make(map[string]localFile)
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || isPartial(d.Name()) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = localFile{
+			path:    name,
+			size:    uint64(info.Size()),
+			mode:    uint32(info.Mode().Perm()),
+			modTime: info.ModTime().UnixNano(),
+		}
+		return nil
+	})
+	return files, err
+}
+
+// planSync compares the source and destination files, the local files are hashed
+// only if they have the size but not the mtime of the remote ones.
+// The remote paths must stay inside the synced directory.
+func planSync(locals map[string]localFile, remotes map[string]proto.FileInfo, opt SyncOptions) ([]SyncAction, error) {
+	for rel := range remotes {
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return nil, stderr.New("bad remote path " + rel)
+		}
+	}
+	var actions []SyncAction
+	for rel, l := range locals {
+		r, ok := remotes[rel]
+		var size = l.size
+		if opt.Pull {
+			size = r.Size
+		}
+		switch {
+		case !ok:
+			if opt.Pull {
+				if opt.Delete {
+					actions = append(actions, SyncAction{Op: SyncDelete, Path: rel})
+				}
+				continue
+			}
+			actions = append(actions, SyncAction{Op: SyncCopy, Path: rel, Size: size})
+		case l.size != r.Size:
+			actions = append(actions, SyncAction{Op: SyncCopy, Path: rel, Size: size})
+		case l.modTime != r.ModTime:
+			etag, err := hashFile(l.path)
+			if err != nil {
+				return nil, err
+			}
+			if etag != r.Etag {
+				actions = append(actions, SyncAction{Op: SyncCopy, Path: rel, Size: size})
+				continue
+			}
+			actions = append(actions, SyncAction{Op: SyncMeta, Path: rel})
+		case r.Mode != 0 && l.mode != r.Mode:
+			actions = append(actions, SyncAction{Op: SyncMeta, Path: rel})
+		}
+	}
+	for rel, r := range remotes {
+		if _, ok := locals[rel]; ok {
+			continue
+		}
+		if opt.Pull {
+			actions = append(actions, SyncAction{Op: SyncCopy, Path: rel, Size: r.Size})
+		} else if opt.Delete {
+			actions = append(actions, SyncAction{Op: SyncDelete, Path: rel})
+		}
+	}
+	// the copies are done before the deletes
+	sort.Slice(actions, func(i, j int) bool {
+		if (actions[i].Op == SyncDelete) != (actions[j].Op == SyncDelete) {
+			return actions[j].Op == SyncDelete
+		}
+		return actions[i].Path < actions[j].Path
+	})
+	return actions, nil
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var hash = sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// setMeta gives the local file the mode and mtime of the remote one.
+func setMeta(name string, info proto.FileInfo) error {
+	if info.Mode != 0 {
+		if err := os.Chmod(name, fs.FileMode(info.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if info.ModTime != 0 {
+		var t = time.Unix(0, info.ModTime)
+		return os.Chtimes(name, t, t)
+	}
+	return nil
+}
+
+func isPartial(name string) bool {
+	name, ok := strings.CutSuffix(name, partialExt)
+	if !ok {
+		return false
+	}
+	var i = strings.LastIndexByte(name, '.')
+	_, err := hex.DecodeString(name[i+1:])
+	return i >= 0 && err == nil && len(name)-i-1 == 2*sha256.Size
+}
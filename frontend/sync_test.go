@@ -0,0 +1,96 @@
+package frontend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yixinin/puup/proto"
+)
+
+func TestPlanSync(t *testing.T) {
+	var dir = t.TempDir()
+	var mtime = time.Unix(1700000000, 0)
+	for name, content := range map[string]string{
+		"same.txt":    "same",
+		"touched.txt": "touched",
+		"changed.txt": "local",
+		"grown.txt":   "grown content",
+		"a/new.txt":   "new",
+		"chmod.txt":   "chmod",
+		"x.txt." + hex.EncodeToString(make([]byte, 32)) + ".part": "partial",
+	} {
+		var name = filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(name, 0644)
+		os.Chtimes(name, mtime, mtime)
+	}
+	os.Chtimes(filepath.Join(dir, "touched.txt"), mtime, mtime.Add(time.Hour))
+	os.Chtimes(filepath.Join(dir, "changed.txt"), mtime, mtime.Add(time.Hour))
+
+	locals, err := scanLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info = func(name, content string) proto.FileInfo {
+		sum := sha256.Sum256([]byte(content))
+		return proto.FileInfo{Path: name, Size: uint64(len(content)), Etag: hex.EncodeToString(sum[:]),
+			Mode: 0644, ModTime: mtime.UnixNano()}
+	}
+	var remotes = map[string]proto.FileInfo{
+		"same.txt":     info("same.txt", "same"),
+		"touched.txt":  info("touched.txt", "touched"),
+		"changed.txt":  info("changed.txt", "remot"),
+		"grown.txt":    info("grown.txt", "grown"),
+		"chmod.txt":    info("chmod.txt", "chmod"),
+		"old/gone.txt": info("old/gone.txt", "gone"),
+	}
+	var chmod = remotes["chmod.txt"]
+	chmod.Mode = 0600
+	remotes["chmod.txt"] = chmod
+
+	push, err := planSync(locals, remotes, SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = []SyncAction{
+		{Op: SyncCopy, Path: "a/new.txt", Size: 3},
+		{Op: SyncCopy, Path: "changed.txt", Size: 5},
+		{Op: SyncMeta, Path: "chmod.txt"},
+		{Op: SyncCopy, Path: "grown.txt", Size: 13},
+		{Op: SyncMeta, Path: "touched.txt"},
+		{Op: SyncDelete, Path: "old/gone.txt"},
+	}
+	if !reflect.DeepEqual(push, want) {
+		t.Fatalf("push\n%v\nwant\n%v", push, want)
+	}
+
+	pull, err := planSync(locals, remotes, SyncOptions{Pull: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []SyncAction{
+		{Op: SyncCopy, Path: "changed.txt", Size: 5},
+		{Op: SyncMeta, Path: "chmod.txt"},
+		{Op: SyncCopy, Path: "grown.txt", Size: 5},
+		{Op: SyncCopy, Path: "old/gone.txt", Size: 4},
+		{Op: SyncMeta, Path: "touched.txt"},
+	}
+	if !reflect.DeepEqual(pull, want) {
+		t.Fatalf("pull\n%v\nwant\n%v", pull, want)
+	}
+
+	for _, rel := range []string{"../x.txt", "a/../../x.txt", "/etc/passwd", ""} {
+		var bad = map[string]proto.FileInfo{rel: info(rel, "bad")}
+		if _, err := planSync(locals, bad, SyncOptions{Pull: true, Delete: true}); err == nil {
+			t.Fatalf("remote path %q is accepted", rel)
+		}
+	}
+}
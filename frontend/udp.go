@@ -0,0 +1,119 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	pnet "github.com/yixinin/puup/net"
+	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/proto"
+	"github.com/yixinin/puup/stderr"
+)
+
+const defaultUdpIdleTimeout = 60 * time.Second
+
+// udpFlow is the datagrams of one source address on the local udp port.
+type udpFlow struct {
+	pc    net.PacketConn
+	addr  net.Addr
+	in    chan []byte
+	close chan struct{}
+	once  sync.Once
+}
+
+func newUdpFlow(pc net.PacketConn, addr net.Addr) *udpFlow {
+	return &udpFlow{
+		pc:    pc,
+		addr:  addr,
+		in:    make(chan []byte, 64),
+		close: make(chan struct{}),
+	}
+}
+
+// push queues a datagram, it is dropped if the flow is behind like udp does.
+func (f *udpFlow) push(data []byte) {
+	select {
+	case f.in <- data:
+	default:
+	}
+}
+
+func (f *udpFlow) Read(p []byte) (int, error) {
+	select {
+	case <-f.close:
+		return 0, io.EOF
+	case data := <-f.in:
+		return copy(p, data), nil
+	}
+}
+
+func (f *udpFlow) Write(p []byte) (int, error) {
+	return f.pc.WriteTo(p, f.addr)
+}
+
+func (f *udpFlow) Close() error {
+	f.once.Do(func() {
+		close(f.close)
+	})
+	return nil
+}
+
+// runDatagram forwards the udp port localPort, every source address is a flow on its own channel.
+func (p *ProxyClient) runDatagram(localPort, remotePort uint16) error {
+	pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", localPort))
+	if err != nil {
+		return stderr.Wrap(err)
+	}
+	defer pc.Close()
+	protocol, err := json.Marshal(proto.NewProxyHeader("", remotePort))
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var flows = make(map[string]*udpFlow)
+	var buf = make([]byte, conn.MaxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return stderr.Wrap(err)
+		}
+		var data = make([]byte, n)
+		copy(data, buf[:n])
+
+		key := addr.String()
+		mu.Lock()
+		flow, ok := flows[key]
+		if !ok {
+			flow = newUdpFlow(pc, addr)
+			flows[key] = flow
+		}
+		mu.Unlock()
+		flow.push(data)
+		if ok {
+			continue
+		}
+
+		conn.GoFunc(context.TODO(), func(ctx context.Context) error {
+			defer func() {
+				flow.Close()
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+			}()
+			host, _, _ := net.SplitHostPort(key)
+			rconn, err := pnet.DialDatagram(p.sigAddr, p.serverName, p.token, host, string(protocol))
+			if err != nil {
+				return err
+			}
+			logrus.Debugf("udp flow %s on port %d to %d", key, localPort, remotePort)
+			return conn.CopyDatagram(flow, rconn, p.udpIdle)
+		})
+	}
+}
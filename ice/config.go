@@ -1,7 +1,15 @@
 package ice
 
-import "github.com/pion/webrtc/v3"
+import (
+	"strings"
+	"sync"
 
+	"github.com/pion/webrtc/v3"
+	"github.com/yixinin/puup/config"
+	"github.com/yixinin/puup/stderr"
+)
+
+// Config is the default configuration, used until SetConfig is called.
 var Config = webrtc.Configuration{
 	ICEServers: []webrtc.ICEServer{
 		{
@@ -9,3 +17,69 @@ var Config = webrtc.Configuration{
 		},
 	},
 }
+
+var (
+	mu sync.RWMutex
+	// provided are the servers with short-lived credentials handed out by the signalling server.
+	provided []webrtc.ICEServer
+)
+
+// NewConfiguration builds the webrtc configuration from ice_servers and ice_transport_policy,
+// the default Config is kept when no server is configured.
+func NewConfiguration(cfg *config.Config) (webrtc.Configuration, error) {
+	var c = Config
+	if len(cfg.ICEServers) > 0 {
+		c.ICEServers = make([]webrtc.ICEServer, 0, len(cfg.ICEServers))
+		for _, s := range cfg.ICEServers {
+			server := webrtc.ICEServer{
+				URLs:       s.URLs,
+				Username:   s.Username,
+				Credential: s.Credential,
+			}
+			switch strings.ToLower(s.CredentialType) {
+			case "", "password":
+				server.CredentialType = webrtc.ICECredentialTypePassword
+			case "oauth":
+				server.CredentialType = webrtc.ICECredentialTypeOauth
+				server.Credential = webrtc.OAuthCredential{MACKey: s.MACKey, AccessToken: s.Credential}
+			default:
+				return c, stderr.New("unknown ice credential type " + s.CredentialType)
+			}
+			c.ICEServers = append(c.ICEServers, server)
+		}
+	}
+	switch strings.ToLower(cfg.ICETransportPolicy) {
+	case "", "all":
+		c.ICETransportPolicy = webrtc.ICETransportPolicyAll
+	case "relay":
+		c.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	default:
+		return c, stderr.New("unknown ice transport policy " + cfg.ICETransportPolicy)
+	}
+	return c, nil
+}
+
+// SetConfig replaces the configuration used by new peers.
+func SetConfig(c webrtc.Configuration) {
+	mu.Lock()
+	defer mu.Unlock()
+	Config = c
+}
+
+// SetProvided replaces the servers handed out by the signalling server.
+func SetProvided(servers []webrtc.ICEServer) {
+	mu.Lock()
+	defer mu.Unlock()
+	provided = servers
+}
+
+// GetConfig returns the configuration for a new peer connection.
+func GetConfig() webrtc.Configuration {
+	mu.RLock()
+	defer mu.RUnlock()
+	var c = Config
+	c.ICEServers = make([]webrtc.ICEServer, 0, len(Config.ICEServers)+len(provided))
+	c.ICEServers = append(c.ICEServers, Config.ICEServers...)
+	c.ICEServers = append(c.ICEServers, provided...)
+	return c
+}
@@ -0,0 +1,99 @@
+package identity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/stderr"
+)
+
+const DefaultCertFile = "identity.pem"
+
+// LoadCertificate loads the long-lived backend DTLS certificate from filename,
+// a new one is generated and saved when the file does not exist.
+func LoadCertificate(filename string) (*webrtc.Certificate, error) {
+	if filename == "" {
+		filename = DefaultCertFile
+	}
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		cert, err := webrtc.CertificateFromPEM(string(data))
+		if err != nil {
+			return nil, stderr.Wrap(err)
+		}
+		if cert.Expires().Before(time.Now()) {
+			return nil, stderr.New("identity certificate expired: " + filename)
+		}
+		return cert, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, stderr.Wrap(err)
+	}
+
+	cert, err := GenerateCertificate()
+	if err != nil {
+		return nil, err
+	}
+	pem, err := cert.PEM()
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	if err := os.WriteFile(filename, []byte(pem), 0600); err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	logrus.Infof("generated identity certificate %s", filename)
+	return cert, nil
+}
+
+// GenerateCertificate creates a self signed certificate valid for ten years.
+func GenerateCertificate() (*webrtc.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	now := time.Now()
+	cert, err := webrtc.NewCertificate(key, x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "puup"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+	})
+	return cert, stderr.Wrap(err)
+}
+
+// Fingerprint returns the sha-256 fingerprint of cert in sdp form, e.g. "sha-256 AB:CD:...".
+func Fingerprint(cert *webrtc.Certificate) (string, error) {
+	fps, err := cert.GetFingerprints()
+	if err != nil {
+		return "", stderr.Wrap(err)
+	}
+	for _, fp := range fps {
+		if strings.EqualFold(fp.Algorithm, "sha-256") {
+			return Normalize(fp.Algorithm + " " + fp.Value), nil
+		}
+	}
+	return "", stderr.New("no sha-256 fingerprint")
+}
+
+// Normalize formats a fingerprint as lower case algorithm and upper case hex value.
+func Normalize(fp string) string {
+	fields := strings.Fields(fp)
+	if len(fields) != 2 {
+		return strings.ToUpper(strings.TrimSpace(fp))
+	}
+	return strings.ToLower(fields[0]) + " " + strings.ToUpper(fields[1])
+}
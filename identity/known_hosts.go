@@ -0,0 +1,104 @@
+package identity
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/stderr"
+)
+
+const DefaultKnownHostsFile = "known_hosts"
+
+var ErrFingerprintMismatch = errors.New("backend fingerprint mismatch")
+
+// KnownHosts verifies backend fingerprints of one cluster,
+// explicit pins win, otherwise the first seen fingerprint is trusted and remembered.
+// Only the first backend of a cluster is trusted on first use, backend ids change on every start
+// so they cannot tell the backends apart: the others must be pinned, or added to the file
+// as more "<cluster> <fingerprint>" lines.
+type KnownHosts struct {
+	sync.Mutex
+	filename    string
+	clusterName string
+	pins        map[string]struct{}
+	known       map[string]struct{}
+}
+
+func NewKnownHosts(filename, clusterName string, pins []string) (*KnownHosts, error) {
+	if filename == "" {
+		filename = DefaultKnownHostsFile
+	}
+	k := &KnownHosts{
+		filename:    filename,
+		clusterName: clusterName,
+		pins:        make(map[string]struct{}, len(pins)),
+		known:       make(map[string]struct{}),
+	}
+	for _, fp := range pins {
+		k.pins[Normalize(fp)] = struct{}{}
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *KnownHosts) load() error {
+	f, err := os.Open(k.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return stderr.Wrap(err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, fp, ok := strings.Cut(line, " ")
+		if !ok || name != k.clusterName {
+			continue
+		}
+		k.known[Normalize(fp)] = struct{}{}
+	}
+	return stderr.Wrap(sc.Err())
+}
+
+func (k *KnownHosts) Verify(fingerprint string) error {
+	k.Lock()
+	defer k.Unlock()
+	fingerprint = Normalize(fingerprint)
+	if len(k.pins) != 0 {
+		if _, ok := k.pins[fingerprint]; ok {
+			return nil
+		}
+		return fmt.Errorf("%w: %s %s is not pinned", ErrFingerprintMismatch, k.clusterName, fingerprint)
+	}
+	if len(k.known) != 0 {
+		if _, ok := k.known[fingerprint]; ok {
+			return nil
+		}
+		return fmt.Errorf("%w: %s %s is not in %s, add the line \"%s %s\" if it is another backend of the cluster",
+			ErrFingerprintMismatch, k.clusterName, fingerprint, k.filename, k.clusterName, fingerprint)
+	}
+
+	f, err := os.OpenFile(k.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return stderr.Wrap(err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", k.clusterName, fingerprint); err != nil {
+		return stderr.Wrap(err)
+	}
+	k.known[fingerprint] = struct{}{}
+	logrus.Warnf("trust %s on first use, fingerprint %s", k.clusterName, fingerprint)
+	return nil
+}
@@ -0,0 +1,194 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// DurationBuckets are the default histogram buckets of durations in seconds.
+var DurationBuckets = []float64{0.1, 1, 10, 60, 300, 1800, 3600, 4 * 3600, 24 * 3600}
+
+// Registry holds the metric families, they are written sorted by name.
+type Registry struct {
+	sync.RWMutex
+	families map[string]family
+}
+
+type family interface {
+	write(w *bufio.Writer, name string)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+// Default is the registry the New functions register in.
+var Default = NewRegistry()
+
+func (r *Registry) register(name, help string, typ metricType, f family) {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.families[name]; ok {
+		panic("metric " + name + " registered twice")
+	}
+	r.families[name] = &described{family: f, help: help, typ: typ}
+}
+
+type described struct {
+	family
+	help string
+	typ  metricType
+}
+
+func (d *described) write(w *bufio.Writer, name string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, d.help, name, d.typ)
+	d.family.write(w, name)
+}
+
+// WriteTo writes all metrics in the prometheus text format.
+func (r *Registry) WriteTo(w *bufio.Writer) error {
+	r.RLock()
+	var names = make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		r.RLock()
+		f := r.families[name]
+		r.RUnlock()
+		f.write(w, name)
+	}
+	return w.Flush()
+}
+
+// ServeHTTP writes the metrics of r.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := r.WriteTo(bufio.NewWriter(w)); err != nil {
+		logrus.Debugf("write metrics error:%v", err)
+	}
+}
+
+// Serve serves the default registry on addr at /metrics.
+func Serve(addr string) error {
+	var mux = http.NewServeMux()
+	mux.Handle("/metrics", Default)
+	logrus.Infof("metrics listen on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// vec keeps one metric per label values.
+type vec[T any] struct {
+	sync.RWMutex
+	labels  []string
+	metrics map[string]*T
+	keys    map[string][]string
+	new     func() *T
+}
+
+func newVec[T any](labels []string, new func() *T) *vec[T] {
+	return &vec[T]{labels: labels, metrics: make(map[string]*T), keys: make(map[string][]string), new: new}
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("%d label values for labels %v", len(values), v.labels))
+	}
+	var key = strings.Join(values, "\xff")
+	v.RLock()
+	m, ok := v.metrics[key]
+	v.RUnlock()
+	if ok {
+		return m
+	}
+	v.Lock()
+	defer v.Unlock()
+	if m, ok = v.metrics[key]; !ok {
+		m = v.new()
+		v.metrics[key] = m
+		v.keys[key] = append([]string(nil), values...)
+	}
+	return m
+}
+
+func (v *vec[T]) each(f func(values []string, m *T)) {
+	v.RLock()
+	var keys = make([]string, 0, len(v.metrics))
+	for key := range v.metrics {
+		keys = append(keys, key)
+	}
+	v.RUnlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		v.RLock()
+		m, values := v.metrics[key], v.keys[key]
+		v.RUnlock()
+		f(values, m)
+	}
+}
+
+func formatLabels(labels, values []string, extra ...string) string {
+	if len(labels)+len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	var write = func(name, value string) {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escape(value))
+		b.WriteByte('"')
+	}
+	for i, name := range labels {
+		write(name, values[i])
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		write(extra[i], extra[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Since returns the seconds elapsed since t, for observing durations.
+func Since(t time.Time) float64 {
+	return time.Since(t).Seconds()
+}
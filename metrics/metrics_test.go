@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounterVec("test_bytes_total", "Bytes.", "dir")
+	c.With("in").Add(3)
+	c.With(`a"b`).Inc()
+	g := NewGaugeVec("test_conns", "Conns.")
+	g.With().Inc()
+	g.With().Add(0.5)
+	h := NewHistogramVec("test_seconds", "Seconds.", []float64{1, 10})
+	h.With().Observe(0.5)
+	h.With().Observe(5)
+	h.With().Observe(50)
+	NewGaugeFunc("test_peers", "Peers.", func(emit func(float64, ...string)) {
+		emit(2, "connected")
+	}, "state")
+
+	var b strings.Builder
+	if err := Default.WriteTo(bufio.NewWriter(&b)); err != nil {
+		t.Fatal(err)
+	}
+	const want = `# HELP test_bytes_total Bytes.
+# TYPE test_bytes_total counter
+test_bytes_total{dir="a\"b"} 1
+test_bytes_total{dir="in"} 3
+# HELP test_conns Conns.
+# TYPE test_conns gauge
+test_conns 1.5
+# HELP test_peers Peers.
+# TYPE test_peers gauge
+test_peers{state="connected"} 2
+# HELP test_seconds Seconds.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="10"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 55.5
+test_seconds_count 3
+`
+	if b.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
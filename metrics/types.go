@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter only goes up.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(n uint64)  { c.v.Add(n) }
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+// Gauge goes up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+func (g *Gauge) Inc()          { g.Add(1) }
+func (g *Gauge) Dec()          { g.Add(-1) }
+
+func (g *Gauge) Add(v float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 { return math.Float64frombits(g.bits.Load()) }
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+	h.count++
+	h.sum += v
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+}
+
+type CounterVec struct{ *vec[Counter] }
+
+// NewCounterVec registers a counter with labels in the default registry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{newVec(labels, func() *Counter { return new(Counter) })}
+	Default.register(name, help, typeCounter, v)
+	return v
+}
+
+func (v *CounterVec) With(values ...string) *Counter { return v.with(values) }
+
+func (v *CounterVec) write(w *bufio.Writer, name string) {
+	v.each(func(values []string, c *Counter) {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(v.labels, values), c.Value())
+	})
+}
+
+type GaugeVec struct{ *vec[Gauge] }
+
+// NewGaugeVec registers a gauge with labels in the default registry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{newVec(labels, func() *Gauge { return new(Gauge) })}
+	Default.register(name, help, typeGauge, v)
+	return v
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge { return v.with(values) }
+
+func (v *GaugeVec) write(w *bufio.Writer, name string) {
+	v.each(func(values []string, g *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(v.labels, values), formatValue(g.Value()))
+	})
+}
+
+type HistogramVec struct{ *vec[Histogram] }
+
+// NewHistogramVec registers a histogram with labels in the default registry, buckets are sorted upper bounds.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{newVec(labels, func() *Histogram { return newHistogram(buckets) })}
+	Default.register(name, help, typeHistogram, v)
+	return v
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram { return v.with(values) }
+
+func (v *HistogramVec) write(w *bufio.Writer, name string) {
+	v.each(func(values []string, h *Histogram) {
+		h.Lock()
+		defer h.Unlock()
+		var labels = formatLabels(v.labels, values)
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(v.labels, values, "le", formatValue(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(v.labels, values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+	})
+}
+
+// GaugeFunc is a gauge collected when the metrics are written,
+// collect calls emit once per label values.
+type GaugeFunc struct {
+	labels  []string
+	collect func(emit func(v float64, values ...string))
+}
+
+// NewGaugeFunc registers a collected gauge in the default registry.
+func NewGaugeFunc(name, help string, collect func(emit func(v float64, values ...string)), labels ...string) {
+	Default.register(name, help, typeGauge, &GaugeFunc{labels: labels, collect: collect})
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer, name string) {
+	var lines []string
+	g.collect(func(v float64, values ...string) {
+		lines = append(lines, fmt.Sprintf("%s%s %s\n", name, formatLabels(g.labels, values), formatValue(v)))
+	})
+	sort.Strings(lines)
+	for _, line := range lines {
+		w.WriteString(line)
+	}
+}
@@ -0,0 +1,100 @@
+package net
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/yixinin/puup/net/conn"
+)
+
+const (
+	BalanceRoundRobin  = "round_robin"
+	BalanceLeastActive = "least_active"
+	BalanceLowestRTT   = "lowest_rtt"
+	BalanceSticky      = "sticky"
+)
+
+// Balancer picks the backend peer for a new connection, key is used by sticky selection.
+type Balancer interface {
+	Pick(peers []conn.Transport, key string) conn.Transport
+}
+
+func NewBalancer(name string) Balancer {
+	switch name {
+	case BalanceLeastActive:
+		return LeastActive{}
+	case BalanceLowestRTT:
+		return LowestRTT{}
+	case BalanceSticky:
+		return &Sticky{}
+	}
+	return &RoundRobin{}
+}
+
+type RoundRobin struct {
+	idx uint64
+}
+
+func (b *RoundRobin) Pick(peers []conn.Transport, key string) conn.Transport {
+	if len(peers) == 0 {
+		return nil
+	}
+	idx := atomic.AddUint64(&b.idx, 1)
+	return peers[idx%uint64(len(peers))]
+}
+
+type LeastActive struct{}
+
+func (LeastActive) Pick(peers []conn.Transport, key string) conn.Transport {
+	var best conn.Transport
+	var min int
+	for _, p := range peers {
+		n := p.ActiveCount()
+		if best == nil || n < min {
+			best, min = p, n
+		}
+	}
+	return best
+}
+
+// LowestRTT prefers the peer with the smallest known round trip time.
+type LowestRTT struct{}
+
+func (LowestRTT) Pick(peers []conn.Transport, key string) conn.Transport {
+	var best conn.Transport
+	for _, p := range peers {
+		if p.RTT() == 0 {
+			continue
+		}
+		if best == nil || p.RTT() < best.RTT() {
+			best = p
+		}
+	}
+	if best == nil {
+		return LeastActive{}.Pick(peers, key)
+	}
+	return best
+}
+
+// Sticky maps the same key to the same backend with rendezvous hashing,
+// so only the keys of a lost backend move. an empty key falls back to round robin.
+type Sticky struct {
+	rr RoundRobin
+}
+
+func (b *Sticky) Pick(peers []conn.Transport, key string) conn.Transport {
+	if key == "" {
+		return b.rr.Pick(peers, key)
+	}
+	var best conn.Transport
+	var max uint64
+	for _, p := range peers {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(p.RemoteClient()))
+		if score := h.Sum64(); best == nil || score > max {
+			best, max = p, score
+		}
+	}
+	return best
+}
@@ -1,25 +1,304 @@
 package net
 
 import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/proto"
+	"github.com/yixinin/puup/stderr"
 )
 
+const discoverInterval = 30 * time.Second
+
+// PeerClient connects to the backends of one cluster.
 type PeerClient struct {
 	sync.RWMutex
+	connectMu sync.Mutex
+
+	id          string
+	sigAddr     string
 	clusterName string
-	peers       map[string]*conn.Peer
-	sig         conn.Signalinger
+	token       string
+
+	peers    map[string]conn.Transport // backend client id -> peer
+	sig      conn.Signalinger
+	balancer Balancer
+	verifier conn.FingerprintVerifier
+
+	lastDiscover time.Time
 }
 
-func NewPeerClient(wsURL, clusterName string) (*PeerClient, error) {
-	p := &PeerClient{
+func NewPeerClient(sigAddr, clusterName, token string) *PeerClient {
+	return &PeerClient{
+		id:          uuid.NewString(),
+		sigAddr:     sigAddr,
 		clusterName: clusterName,
-		peers:       make(map[string]*conn.Peer),
-		sig:         conn.NewWsFrontendSigClient(uuid.NewString(), wsURL, clusterName),
+		token:       token,
+		peers:       make(map[string]conn.Transport),
+		balancer:    &RoundRobin{},
+	}
+}
+
+func (c *PeerClient) SetBalancer(b Balancer) {
+	c.Lock()
+	defer c.Unlock()
+	c.balancer = b
+}
+
+func (c *PeerClient) SetVerifier(v conn.FingerprintVerifier) {
+	c.Lock()
+	defer c.Unlock()
+	c.verifier = v
+}
+
+// signalling returns the connected signalling client, it is started on first use.
+func (c *PeerClient) signalling(ctx context.Context) (conn.Signalinger, error) {
+	c.Lock()
+	sig := c.sig
+	if sig == nil {
+		sig = conn.NewWsFrontendSigClient(c.id, c.sigAddr, c.clusterName, c.token)
+		c.sig = sig
+		go sig.Serve(context.Background())
+	}
+	c.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+		return nil, stderr.Wrap(ctx.Err())
+	case <-sig.Ready():
+		return sig, nil
+	}
+}
+
+// Discover lists the backends of the cluster from the signalling server.
+func (c *PeerClient) Discover(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, proto.GetClusterURL(c.sigAddr, c.clusterName, c.token), nil)
+	if err != nil {
+		return nil, stderr.Wrap(err)
 	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, stderr.New("get cluster failed, status: " + resp.Status)
+	}
+	var ack proto.GetClusterAck
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	return ack.Ids, nil
+}
+
+// Connect discovers the backends and connects the ones not connected yet.
+func (c *PeerClient) Connect(ctx context.Context) error {
+	c.connectMu.Lock()
+	defer c.connectMu.Unlock()
+
+	cids, err := c.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.lastDiscover = time.Now()
+	c.Unlock()
+	if len(cids) == 0 {
+		return stderr.New("cluster has no backend: " + c.clusterName)
+	}
+	sig, err := c.signalling(ctx)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var errs = make(chan error, len(cids))
+	for _, cid := range cids {
+		if _, ok := c.getPeer(cid); ok {
+			continue
+		}
+		wg.Add(1)
+		go func(cid string) {
+			defer wg.Done()
+			peer, err := c.connect(ctx, sig, cid)
+			if err != nil {
+				logrus.Errorf("connect backend %s error:%v", cid, err)
+				errs <- err
+				return
+			}
+			c.addPeer(cid, peer)
+		}(cid)
+	}
+	wg.Wait()
+	close(errs)
+	if len(c.alivePeers()) == 0 {
+		if err, ok := <-errs; ok {
+			return err
+		}
+		return stderr.New("no backend connected: " + c.clusterName)
+	}
+	return nil
+}
 
-	return p, nil
+// connect connects the backend cid over webrtc or the relay as conn.Relay selects.
+func (c *PeerClient) connect(ctx context.Context, sig conn.Signalinger, cid string) (conn.Transport, error) {
+	c.RLock()
+	verifier := c.verifier
+	c.RUnlock()
+	if conn.Relay == conn.RelayOnly {
+		return conn.DialRelay(ctx, sig, c.clusterName, cid, verifier)
+	}
+	peer, err := conn.NewOfferPeer(sig, cid, verifier)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Relay != conn.RelayAuto {
+		if err := peer.Connect(ctx); err != nil {
+			return nil, err
+		}
+		return peer, nil
+	}
+	ictx, cancel := context.WithTimeout(ctx, conn.RelayAfter)
+	defer cancel()
+	if err = peer.Connect(ictx); err == nil {
+		return peer, nil
+	}
+	logrus.Infof("webrtc to backend %s failed, fall back to relay:%v", cid, err)
+	return conn.DialRelay(ctx, sig, c.clusterName, cid, verifier)
+}
+
+func (c *PeerClient) addPeer(cid string, p conn.Transport) {
+	c.Lock()
+	if old, ok := c.peers[cid]; ok && old != p {
+		old.Close()
+	}
+	c.peers[cid] = p
+	c.Unlock()
+
+	// fail over: forget the peer once its connection failed
+	go func() {
+		<-p.Done()
+		logrus.Infof("backend %s of %s closed", cid, c.clusterName)
+		c.delPeer(cid, p)
+	}()
+}
+
+func (c *PeerClient) delPeer(cid string, p conn.Transport) {
+	c.Lock()
+	defer c.Unlock()
+	if c.peers[cid] == p {
+		delete(c.peers, cid)
+	}
+}
+
+func (c *PeerClient) getPeer(cid string) (conn.Transport, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	p, ok := c.peers[cid]
+	if ok && p.IsClose() {
+		return nil, false
+	}
+	return p, ok
+}
+
+func (c *PeerClient) alivePeers() []conn.Transport {
+	c.RLock()
+	defer c.RUnlock()
+	var peers = make([]conn.Transport, 0, len(c.peers))
+	for _, p := range c.peers {
+		if !p.IsClose() {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// Dial opens a channel on a backend picked by the balancer,
+// backends failing to open a channel are skipped.
+func (c *PeerClient) Dial(ctx context.Context, key string, ct conn.ChannelType) (net.Conn, error) {
+	return c.dial(ctx, key, func(p conn.Transport) (conn.ReadWriterReleaser, error) {
+		return p.Get(ct)
+	})
+}
+
+// DialDatagram opens an unreliable datagram channel, protocol is passed to the backend on open.
+func (c *PeerClient) DialDatagram(ctx context.Context, key, protocol string) (net.Conn, error) {
+	return c.dial(ctx, key, func(p conn.Transport) (conn.ReadWriterReleaser, error) {
+		return p.GetDatagram(protocol)
+	})
+}
+
+func (c *PeerClient) dial(ctx context.Context, key string, get func(p conn.Transport) (conn.ReadWriterReleaser, error)) (net.Conn, error) {
+	peers := c.alivePeers()
+	if len(peers) == 0 {
+		if err := c.Connect(ctx); err != nil {
+			return nil, err
+		}
+		peers = c.alivePeers()
+	} else {
+		c.RLock()
+		stale := time.Since(c.lastDiscover) > discoverInterval
+		c.RUnlock()
+		if stale {
+			conn.GoFunc(context.Background(), c.Connect)
+		}
+	}
+
+	c.RLock()
+	balancer := c.balancer
+	c.RUnlock()
+	var err = stderr.New("no backend connected: " + c.clusterName)
+	for len(peers) > 0 {
+		p := balancer.Pick(peers, key)
+		if p == nil {
+			break
+		}
+		var rwr conn.ReadWriterReleaser
+		rwr, err = get(p)
+		if err == nil {
+			return NewConn(rwr), nil
+		}
+		logrus.Errorf("get channel from backend %s error:%v", p.RemoteClient(), err)
+		for i := range peers {
+			if peers[i] == p {
+				peers = append(peers[:i], peers[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, err
+}
+
+// DialBackend opens a channel on the connected backend cid.
+func (c *PeerClient) DialBackend(cid string, ct conn.ChannelType) (net.Conn, error) {
+	p, ok := c.getPeer(cid)
+	if !ok {
+		return nil, stderr.New("backend not connected: " + cid)
+	}
+	rwr, err := p.Get(ct)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(rwr), nil
+}
+
+func (c *PeerClient) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	for _, p := range c.peers {
+		p.Close()
+	}
+	if c.sig != nil {
+		c.sig.Close(context.Background())
+	}
+	return nil
 }
@@ -5,116 +5,92 @@ import (
 	"net"
 	"sync"
 
-	"github.com/google/uuid"
 	"github.com/yixinin/puup/net/conn"
-	"github.com/yixinin/puup/proto"
 )
 
 type PeersClient struct {
 	sync.Mutex
-	cluster map[string]PeerClient
+	cluster   map[string]*PeerClient
+	verifiers map[string]conn.FingerprintVerifier
+	balancers map[string]Balancer
+	ids       map[string]string
 }
 
 func NewPeersClient() *PeersClient {
 	return &PeersClient{
-		cluster: make(map[string]PeerClient),
+		cluster:   make(map[string]*PeerClient),
+		verifiers: make(map[string]conn.FingerprintVerifier),
+		balancers: make(map[string]Balancer),
+		ids:       make(map[string]string),
 	}
 }
 
-func (c *PeersClient) addPeer(serverName string, p *conn.Peer) {
+// SetVerifier pins the backend fingerprints of clusterName.
+func (c *PeersClient) SetVerifier(clusterName string, v conn.FingerprintVerifier) {
 	c.Lock()
 	defer c.Unlock()
-	if m, ok := c.cluster[serverName]; ok {
-		m.peers[p.Id] = p
-	} else {
-		c.cluster[serverName] = PeerClient{
-			clusterName: serverName,
-			peers: map[string]*conn.Peer{
-				p.Id: p,
-			},
-		}
+	c.verifiers[clusterName] = v
+	if cc, ok := c.cluster[clusterName]; ok {
+		cc.SetVerifier(v)
 	}
 }
 
-func (c *PeersClient) getPeer(serverName, clientId string) (*conn.Peer, bool) {
+// SetBalancer sets the backend selection of clusterName.
+func (c *PeersClient) SetBalancer(clusterName string, b Balancer) {
 	c.Lock()
 	defer c.Unlock()
-	m, ok := c.cluster[serverName]
-	if ok && m.peers != nil {
-		if p, ok := m.peers[clientId]; ok {
-			return p, true
-		}
+	c.balancers[clusterName] = b
+	if cc, ok := c.cluster[clusterName]; ok {
+		cc.SetBalancer(b)
 	}
-	return nil, false
 }
 
-func (c *PeersClient) getRandPeer(serverName string) (*conn.Peer, bool) {
+// SetClientId sets the id the client signals to clusterName with, it must be called before the first dial.
+func (c *PeersClient) SetClientId(clusterName, id string) {
 	c.Lock()
 	defer c.Unlock()
-	if m, ok := c.cluster[serverName]; ok {
-		for _, v := range m.peers {
-			return v, true
-		}
-	}
-
-	return nil, false
+	c.ids[clusterName] = id
 }
 
-func (c *PeersClient) GetCluster() ([]string, error) {
-	var ack proto.GetClusterAck
-
-	return ack.Ids, nil
-}
-func (c *PeersClient) GetCluserClient(wsURL, clusterName string) PeerClient {
+func (c *PeersClient) GetCluserClient(sigAddr, clusterName, token string) *PeerClient {
 	c.Lock()
 	defer c.Unlock()
 	cc, ok := c.cluster[clusterName]
 	if !ok {
-		cc = PeerClient{
-			sig:         conn.NewWsFrontendSigClient(uuid.NewString(), wsURL, clusterName),
-			peers:       make(map[string]*conn.Peer),
-			clusterName: clusterName,
+		cc = NewPeerClient(sigAddr, clusterName, token)
+		if id, ok := c.ids[clusterName]; ok && id != "" {
+			cc.id = id
+		}
+		if v, ok := c.verifiers[clusterName]; ok {
+			cc.SetVerifier(v)
+		}
+		if b, ok := c.balancers[clusterName]; ok {
+			cc.SetBalancer(b)
 		}
 		c.cluster[clusterName] = cc
 	}
 	return cc
 }
-func (c *PeersClient) Connect(wsURL, clusterName string) error {
-	cids, err := c.GetCluster()
-	if err != nil {
-		return err
-	}
-	cc := c.GetCluserClient(wsURL, clusterName)
-	for _, cid := range cids {
-		peer, err := conn.NewOfferPeer(cc.sig, cid)
-		if err != nil {
-			return err
-		}
-		if err = peer.Connect(context.TODO()); err != nil {
-			return err
-		}
-		c.addPeer(clusterName, peer)
-	}
 
-	return nil
+func (c *PeersClient) Connect(sigAddr, clusterName, token string) error {
+	return c.GetCluserClient(sigAddr, clusterName, token).Connect(context.TODO())
 }
 
-func (c *PeersClient) Dial(wsURL string, clusterName string, ct conn.ChannelType) (net.Conn, error) {
-	_, ok := c.getRandPeer(clusterName)
-	if !ok {
-		var err error
-		err = c.Connect(wsURL, clusterName)
-		if err != nil {
-			return nil, err
-		}
-	}
-	for _, p := range c.cluster[clusterName].peers {
-		cc, err := p.Get(ct)
-		if err != nil {
-			return nil, err
-		}
-		conn := NewConn(cc)
-		return conn, nil
-	}
-	return nil, nil
+func (c *PeersClient) Dial(sigAddr, clusterName, token string, ct conn.ChannelType) (net.Conn, error) {
+	return c.DialKey(sigAddr, clusterName, token, "", ct)
+}
+
+// DialDatagram dials an unreliable datagram channel with a sticky key.
+func (c *PeersClient) DialDatagram(sigAddr, clusterName, token, key, protocol string) (net.Conn, error) {
+	return c.GetCluserClient(sigAddr, clusterName, token).DialDatagram(context.TODO(), key, protocol)
+}
+
+// DialBackend dials the backend cid of clusterName, it must be connected already.
+func (c *PeersClient) DialBackend(sigAddr, clusterName, token, cid string, ct conn.ChannelType) (net.Conn, error) {
+	return c.GetCluserClient(sigAddr, clusterName, token).DialBackend(cid, ct)
+}
+
+// DialKey dials with a sticky key, the same key goes to the same backend with sticky balance.
+func (c *PeersClient) DialKey(sigAddr, clusterName, token, key string, ct conn.ChannelType) (net.Conn, error) {
+	return c.GetCluserClient(sigAddr, clusterName, token).Dial(context.TODO(), key, ct)
 }
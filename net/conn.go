@@ -1,14 +1,16 @@
 package net
 
 import (
-	"context"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/stderr"
 )
 
+// Conn is a net.Conn over a data channel or a mux stream,
+// its deadlines are kept until reset and apply to blocked reads and writes.
 type Conn struct {
 	sync.RWMutex
 
@@ -16,7 +18,6 @@ type Conn struct {
 
 	isRelease bool
 	close     chan struct{}
-	rdl       time.Time
 }
 
 func NewConn(rwr conn.ReadWriterReleaser) *Conn {
@@ -41,79 +42,17 @@ func (s *Conn) IsClose() bool {
 }
 
 func (c *Conn) SetDeadline(t time.Time) error {
-	c.rdl = t
-	return nil
-}
-
-func (c *Conn) SetReadDeadline(t time.Time) error {
-	c.rdl = t
-	return nil
-}
-
-func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return nil
-}
-
-func (c *Conn) getRdl() (*time.Timer, error) {
-	var timeout time.Duration
-	zero := c.rdl.IsZero()
-	if !zero {
-		timeout = time.Until(c.rdl)
-	}
-	c.rdl = time.Time{}
-
-	if timeout <= 0 && !zero {
-		return nil, context.DeadlineExceeded
-	}
-	if timeout <= 100*time.Millisecond {
-		timeout = 100 * time.Millisecond
-	}
-	tm := time.NewTimer(timeout)
-	defer tm.Stop()
-
-	if zero {
-		tm.Stop()
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
 	}
-	return tm, nil
-}
-
-type DataInfo struct {
-	N   int
-	Err error
-}
-
-func (d *DataInfo) Unwrap() (int, error) {
-	return d.N, d.Err
+	return c.SetWriteDeadline(t)
 }
 
 func (c *Conn) Read(data []byte) (n int, err error) {
-	tm, err := c.getRdl()
-	if err != nil {
-		return 0, err
-	}
-
-	var ch = make(chan error)
-	defer close(ch)
-
-	conn.GoFunc(context.TODO(), func(ctx context.Context) error {
-		n, err = c.ReadWriterReleaser.Read(data)
-		select {
-		case <-ch:
-		case ch <- err:
-		}
-		return err
-	})
-	select {
-	case <-tm.C:
-		select {
-		case <-c.close:
-			return 0, net.ErrClosed
-		default:
-			return 0, context.DeadlineExceeded
-		}
-	case err = <-ch:
-		return n, err
+	if c.IsClose() {
+		return 0, net.ErrClosed
 	}
+	return c.ReadWriterReleaser.Read(data)
 }
 
 func (c *Conn) Write(data []byte) (n int, err error) {
@@ -126,6 +65,25 @@ func (c *Conn) Write(data []byte) (n int, err error) {
 	return
 }
 
+// CloseWrite half closes the connection, the remote reads EOF and may keep writing.
+func (c *Conn) CloseWrite() error {
+	if c.IsClose() {
+		return net.ErrClosed
+	}
+	if cw, ok := c.ReadWriterReleaser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return stderr.New("half close is not supported")
+}
+
+// Protocol is the sub protocol of the channel, set for datagram channels.
+func (c *Conn) Protocol() string {
+	if p, ok := c.ReadWriterReleaser.(interface{ Protocol() string }); ok {
+		return p.Protocol()
+	}
+	return ""
+}
+
 func (c *Conn) Release() {
 	c.Lock()
 	defer c.Unlock()
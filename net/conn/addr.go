@@ -23,11 +23,15 @@ const (
 	Proxy     ChannelType = "proxy"
 	Ssh       ChannelType = "ssh"
 	File      ChannelType = "file"
+	// Datagram channels are unordered and unreliable, every message is one datagram.
+	Datagram ChannelType = "udp"
+	// Mux channels carry the streams of the other types when multiplexing.
+	Mux ChannelType = "mux"
 )
 
 func (t ChannelType) String() string {
 	switch t {
-	case Cmd, Keepalive, Web, Proxy, Ssh, File:
+	case Cmd, Keepalive, Web, Proxy, Ssh, File, Datagram, Mux:
 		return string(t)
 	}
 	return "unknown"
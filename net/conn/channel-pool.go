@@ -2,12 +2,14 @@ package conn
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"sync/atomic"
 
 	"github.com/google/uuid"
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/net/mux"
 	"github.com/yixinin/puup/stderr"
 )
 
@@ -23,12 +25,22 @@ type ChannelPool struct {
 	idles   map[string]ReadWriterReleaser
 	actives map[string]ReadWriterReleaser
 	pc      *webrtc.PeerConnection
+	cmd     *webrtc.DataChannel
+	cmdOpen chan struct{}
+	pending map[string]pendingConnect // connects of channels not open yet
+
+	pingMu sync.Mutex
+	pings  map[uint64]chan struct{}
 
 	accept  chan ReadWriterReleaser
 	release chan ReadWriterReleaser
 
 	idx uint64
 
+	muxMu sync.Mutex
+	mux   *mux.Session   // offer side
+	muxes []*mux.Session // answer side
+
 	close chan struct{}
 }
 
@@ -41,6 +53,9 @@ func NewChannelPool(pc *webrtc.PeerConnection, rid, rcid string, pt webrtc.SDPTy
 
 		idles:   make(map[string]ReadWriterReleaser, 8),
 		actives: make(map[string]ReadWriterReleaser, 8),
+		pending: make(map[string]pendingConnect),
+		cmdOpen: make(chan struct{}),
+		pings:   make(map[uint64]chan struct{}),
 		pc:      pc,
 		release: make(chan ReadWriterReleaser, 1),
 		close:   make(chan struct{}),
@@ -54,19 +69,57 @@ func (p *ChannelPool) loop(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-p.close:
+			return nil
 		case dc := <-p.release:
 			logrus.Debug(dc.Label(), "released")
 			p.Lock()
 			delete(p.actives, dc.Label().String())
+			// datagram channels carry their flow in the header, they are never reused
+			if ch, ok := dc.(*Channel); dc.Label().ChannelType == Datagram || ok && ch.IsClosed() {
+				delete(p.idles, dc.Label().String())
+				p.Unlock()
+				continue
+			}
 			p.idles[dc.Label().String()] = dc
 			p.Unlock()
 		}
 	}
 }
 
-func (p *ChannelPool) Get(ct ChannelType, labels ...string) (ch ReadWriterReleaser, err error) {
-	p.RLock()
-	defer p.RUnlock()
+func (p *ChannelPool) nextIdx() uint64 {
+	return atomic.AddUint64(&p.idx, 1)
+}
+
+// connectRetries is how many other channels Get tries when the remote took the same idle one.
+const connectRetries = 3
+
+// Get takes an idle channel of type ct or creates one, it is returned once the remote peer takes it too.
+func (p *ChannelPool) Get(ct ChannelType, labels ...string) (ReadWriterReleaser, error) {
+	if Multiplex && len(labels) == 0 && ct != Datagram {
+		return p.openStream(ct)
+	}
+	for i := 0; ; i++ {
+		ch, err := p.take(ct, labels...)
+		if err != nil {
+			return nil, err
+		}
+		err = p.connect(ch, "")
+		if err == nil {
+			return ch, nil
+		}
+		// both peers took the idle channel at once, connect dropped it
+		var reset *ResetError
+		if len(labels) != 0 || i >= connectRetries || !errors.As(err, &reset) || reset.Reason != ReasonBusy {
+			return nil, err
+		}
+		logrus.Debugf("channel %s busy, take another", ch.Label())
+	}
+}
+
+func (p *ChannelPool) take(ct ChannelType, labels ...string) (ch *Channel, err error) {
+	p.Lock()
+	defer p.Unlock()
 	var key string
 	defer func() {
 		if err == nil {
@@ -77,22 +130,30 @@ func (p *ChannelPool) Get(ct ChannelType, labels ...string) (ch ReadWriterReleas
 	switch len(labels) {
 	case 1:
 		key = labels[0]
-		if ch = p.idles[key]; ch == nil {
+		if ch, _ = p.idles[key].(*Channel); ch == nil {
 			return nil, stderr.New("not found")
 		}
 		if ch.TakeConn() {
 			return ch, nil
 		}
 	default:
-		for key, ch = range p.idles {
-			if ch.TakeConn() {
+		for k, rwr := range p.idles {
+			c, ok := rwr.(*Channel)
+			if !ok || c.Label().ChannelType != ct {
+				continue
+			}
+			if c.IsClosed() {
+				delete(p.idles, k)
+				continue
+			}
+			if c.TakeConn() {
+				key, ch = k, c
 				return ch, nil
 			}
 		}
 	}
 	for i := 0; i < 5; i++ {
-		idx := atomic.AddUint64(&p.idx, 1)
-		var label = NewLabel(ct, idx)
+		var label = NewLabel(ct, p.nextIdx())
 		b := true
 		var init = &webrtc.DataChannelInit{
 			Ordered: &b,
@@ -101,7 +162,7 @@ func (p *ChannelPool) Get(ct ChannelType, labels ...string) (ch ReadWriterReleas
 		if err != nil {
 			return nil, err
 		}
-		ch = NewOfferChannel(p.clusterName, p.Id, dc, label, p.release)
+		ch = p.newOfferChannel(dc, label)
 		if ch.TakeConn() {
 			return ch, nil
 		}
@@ -110,6 +171,71 @@ func (p *ChannelPool) Get(ct ChannelType, labels ...string) (ch ReadWriterReleas
 	return nil, stderr.New("cannot take conn")
 }
 
+// connect waits until the remote peer takes ch, ch is closed and dropped if it does not.
+func (p *ChannelPool) connect(ch *Channel, header string) error {
+	err := ch.connect(header, ConnectTimeout)
+	if err == nil {
+		return nil
+	}
+	ch.Close()
+	p.Lock()
+	delete(p.actives, ch.Label().String())
+	delete(p.idles, ch.Label().String())
+	p.Unlock()
+	return err
+}
+
+// GetDatagram creates an unordered, unreliable channel, protocol tells the remote where the datagrams go.
+func (p *ChannelPool) GetDatagram(protocol string) (ReadWriterReleaser, error) {
+	var label = NewLabel(Datagram, p.nextIdx())
+	var ordered = false
+	var retransmits uint16 = 0
+	var init = &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &retransmits,
+	}
+	dc, err := p.pc.CreateDataChannel(label.String(), init)
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	ch := p.newOfferChannel(dc, label)
+	if !ch.TakeConn() {
+		return nil, stderr.New("cannot take conn")
+	}
+	p.Lock()
+	p.actives[label.String()] = ch
+	p.Unlock()
+	if err := p.connect(ch, protocol); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (p *ChannelPool) newOfferChannel(dc *webrtc.DataChannel, label *Label) *Channel {
+	ch := NewOfferChannel(p.clusterName, p.Id, dc, label, p.release)
+	ch.command = p.SendCommand
+	return ch
+}
+
+func (p *ChannelPool) IdleCount() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.idles)
+}
+
+// ActiveCount returns the number of channels in use.
+func (p *ChannelPool) ActiveCount() int {
+	p.RLock()
+	n := len(p.actives)
+	p.RUnlock()
+	return n + p.muxStreams()
+}
+
+// RemoteClient is the signalling client id of the remote peer.
+func (p *ChannelPool) RemoteClient() string {
+	return p.RemoteClientId
+}
+
 func (p *ChannelPool) OnChannelOpen(dc *webrtc.DataChannel) error {
 	p.Lock()
 	defer p.Unlock()
@@ -117,23 +243,29 @@ func (p *ChannelPool) OnChannelOpen(dc *webrtc.DataChannel) error {
 	if err != nil {
 		return err
 	}
+	if label.ChannelType == Mux {
+		p.serveMux(dc, label)
+		return nil
+	}
 	if _, ok := p.actives[dc.Label()]; ok {
 		return nil
 	}
 	if _, ok := p.idles[dc.Label()]; !ok {
-		p.idles[dc.Label()] = NewAnswerChannel(p.clusterName, p.Id, dc, label, p.accept, p.release)
+		ch := NewAnswerChannel(p.clusterName, p.RemoteClientId, dc, label, p.release)
+		ch.command = p.SendCommand
+		p.idles[dc.Label()] = ch
+	}
+	// the connect may come before the channel is open
+	if c, ok := p.pending[dc.Label()]; ok {
+		delete(p.pending, dc.Label())
+		GoFunc(context.TODO(), func(ctx context.Context) error {
+			p.onConnect(c.DataChannelCommand)
+			return nil
+		})
 	}
 
 	return nil
 }
-func (p *ChannelPool) OnRelease(label string) {
-	p.Lock()
-	defer p.Unlock()
-	ch, ok := p.actives[label]
-	if ok && ch != nil {
-		ch.Release()
-	}
-}
 func (p *ChannelPool) Close() error {
 	select {
 	case <-p.close:
@@ -141,5 +273,6 @@ func (p *ChannelPool) Close() error {
 	default:
 	}
 	close(p.close)
+	p.closeMux()
 	return nil
 }
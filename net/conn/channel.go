@@ -1,12 +1,16 @@
 package conn
 
 import (
-	"bufio"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/pion/transport/deadline"
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/metrics"
 	"github.com/yixinin/puup/stderr"
 )
 
@@ -19,42 +23,253 @@ const (
 	Closed  ChanStatus = "closed"
 )
 
-type ChannelReader struct {
-	batchSize int
-	recvData  chan []byte
+// MaxDatagramSize is the largest message of a datagram channel.
+const MaxDatagramSize = 65535
+
+// Writes wait once SendHighWater bytes are buffered by sctp until it drains to SendLowWater,
+// RecvWindow bounds the bytes queued for a reader before the channel stops reading.
+var (
+	SendHighWater = 1 << 20
+	SendLowWater  = 256 << 10
+	RecvWindow    = 4 << 20
+)
+
+const writableRecheck = 200 * time.Millisecond
+
+// SetFlowControl sets the water marks and the receive window, zero values are left unchanged.
+func SetFlowControl(high, low, window int) {
+	if high > 0 {
+		SendHighWater = high
+	}
+	if low > 0 {
+		SendLowWater = low
+	}
+	if SendLowWater > SendHighWater {
+		SendLowWater = SendHighWater
+	}
+	if window > 0 {
+		RecvWindow = window
+	}
 }
 
-func (c *ChannelReader) Release() {
-	close(c.recvData)
+// ChannelReader queues the received messages of a channel,
+// OnData blocks while window bytes are queued and not read.
+type ChannelReader struct {
+	sync.Mutex
+	window   int
+	queued   int
+	msgs     [][]byte
+	readable chan struct{}
+	writable chan struct{}
+	released chan struct{}
+	deadline *deadline.Deadline
+	err      error
+
+	recv int64
+	eof  int64 // total bytes the remote sent before EOF, -1 until it closes write
+	// onDrained is called once the bytes sent before EOF are all received
+	onDrained func()
 }
 
-func NewChannelReader(batchSize int) *ChannelReader {
+func NewChannelReader(window int) *ChannelReader {
 	return &ChannelReader{
-		batchSize: batchSize,
-		recvData:  make(chan []byte, 10),
+		window:   window,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		released: make(chan struct{}),
+		deadline: deadline.New(),
+		eof:      -1,
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Release discards the queued data and wakes the blocked readers and writers,
+// data received later is counted and dropped.
+func (r *ChannelReader) Release() {
+	r.Lock()
+	defer r.Unlock()
+	r.msgs = nil
+	r.queued = 0
+	r.release()
+}
+
+// Fail makes reads return err at once.
+func (r *ChannelReader) Fail(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.err = err
+	r.msgs = nil
+	r.queued = 0
+	r.release()
+}
+
+func (r *ChannelReader) release() {
+	select {
+	case <-r.released:
+	default:
+		close(r.released)
+	}
+}
+
+func (r *ChannelReader) isReleased() bool {
+	select {
+	case <-r.released:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseAt makes reads return io.EOF after size bytes,
+// the EOF command may overtake the data it follows.
+func (r *ChannelReader) CloseAt(size int64) {
+	r.Lock()
+	r.eof = size
+	drained := r.drained()
+	r.Unlock()
+	r.notifyDrained(drained)
+}
+
+func (r *ChannelReader) drained() bool {
+	if r.eof >= 0 && r.recv >= r.eof {
+		r.release()
+		return true
+	}
+	return false
+}
+
+func (r *ChannelReader) notifyDrained(drained bool) {
+	if drained && r.onDrained != nil {
+		r.onDrained()
 	}
 }
 
 func (r *ChannelReader) OnData(data []byte) {
-	var size = len(data)
-	for i := 0; i < size; i += r.batchSize {
-		end := min(i+r.batchSize, size)
-		r.recvData <- data[i:end]
+	for {
+		r.Lock()
+		if r.queued == 0 || r.queued+len(data) <= r.window || r.isReleased() {
+			drained := r.push(data)
+			r.Unlock()
+			r.notifyDrained(drained)
+			return
+		}
+		r.Unlock()
+		select {
+		case <-r.writable:
+		case <-r.released:
+		}
+	}
+}
+
+// OfferData queues data without blocking, it is dropped if the reader is behind.
+func (r *ChannelReader) OfferData(data []byte) {
+	r.Lock()
+	defer r.Unlock()
+	if r.queued > 0 && r.queued+len(data) > r.window {
+		return
+	}
+	r.push(data)
+}
+
+func (r *ChannelReader) push(data []byte) bool {
+	r.recv += int64(len(data))
+	if !r.isReleased() && len(data) > 0 {
+		r.msgs = append(r.msgs, data)
+		r.queued += len(data)
+		notify(r.readable)
+	}
+	return r.drained()
+}
+
+// Buffered returns the bytes queued and not read.
+func (r *ChannelReader) Buffered() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.queued
+}
+
+// SetDeadline makes blocked and future reads fail with os.ErrDeadlineExceeded after t.
+func (r *ChannelReader) SetDeadline(t time.Time) {
+	r.deadline.Set(t)
+}
+
+// next waits for a queued message and calls fn with the lock held.
+func (r *ChannelReader) next(fn func(msg []byte) int) (int, error) {
+	for {
+		select {
+		case <-r.deadline.Done():
+			return 0, os.ErrDeadlineExceeded
+		default:
+		}
+		r.Lock()
+		if r.err != nil {
+			r.Unlock()
+			return 0, r.err
+		}
+		if len(r.msgs) > 0 {
+			n := fn(r.msgs[0])
+			if n < len(r.msgs[0]) {
+				r.msgs[0] = r.msgs[0][n:]
+			} else {
+				r.msgs[0] = nil
+				r.msgs = r.msgs[1:]
+			}
+			r.queued -= n
+			if len(r.msgs) > 0 {
+				notify(r.readable)
+			}
+			r.Unlock()
+			notify(r.writable)
+			return n, nil
+		}
+		r.Unlock()
+		select {
+		case <-r.readable:
+		case <-r.released:
+			r.Lock()
+			empty := len(r.msgs) == 0 && r.err == nil
+			r.Unlock()
+			if empty {
+				return 0, io.EOF
+			}
+		case <-r.deadline.Done():
+			return 0, os.ErrDeadlineExceeded
+		}
 	}
 }
 
 func (r *ChannelReader) Read(p []byte) (int, error) {
-	data, ok := <-r.recvData
-	if !ok {
-		return 0, io.EOF
+	return r.next(func(msg []byte) int {
+		return copy(p, msg)
+	})
+}
+
+// ReadMsg reads one message, io.ErrShortBuffer if it does not fit in p.
+func (r *ChannelReader) ReadMsg(p []byte) (int, error) {
+	var short bool
+	n, err := r.next(func(msg []byte) int {
+		copy(p, msg)
+		short = len(msg) > len(p)
+		return len(msg)
+	})
+	if err != nil {
+		return 0, err
 	}
-	if len(data) > len(p) {
-		panic("read out of memeroy!")
+	if short {
+		return len(p), io.ErrShortBuffer
 	}
-	return copy(p, data), nil
+	return n, nil
 }
 
+// Channel is one data channel, it is reused once both peers released it.
 type Channel struct {
+	mu     sync.Mutex
 	status ChanStatus
 	Type   webrtc.SDPType
 	label  *Label
@@ -62,17 +277,30 @@ type Channel struct {
 	laddr, raddr net.Addr
 	dc           *webrtc.DataChannel
 
-	open  chan struct{}
-	close chan struct{}
+	open     chan struct{}
+	close    chan struct{}
+	writable chan struct{}
+	wdl      *deadline.Deadline
 
-	accept  chan ReadWriterReleaser
 	release chan ReadWriterReleaser
 
 	batchSize int
+	datagram  bool
+
+	bytesIn, bytesOut *metrics.Counter
+
+	// command sends a command about this channel to the remote peer
+	command func(DataChannelCommand) error
 
-	rd     *ChannelReader
-	buffer *bufio.Reader
-	// sendData chan []byte
+	// the state of the current conn, reset by TakeConn
+	rd         *ChannelReader
+	done       chan struct{} // closed when the conn is released
+	ack        chan error
+	header     string
+	sent       int64
+	wclosed    bool
+	werr       error // set when the remote disconnects or resets
+	remoteDone bool  // the remote released and everything it sent is received
 }
 
 func NewOfferChannel(sname, cid string, dc *webrtc.DataChannel, label *Label, release chan ReadWriterReleaser) *Channel {
@@ -82,9 +310,8 @@ func NewOfferChannel(sname, cid string, dc *webrtc.DataChannel, label *Label, re
 	return ch
 }
 
-func NewAnswerChannel(sname, cid string, dc *webrtc.DataChannel, label *Label, accept, release chan ReadWriterReleaser) *Channel {
+func NewAnswerChannel(sname, cid string, dc *webrtc.DataChannel, label *Label, release chan ReadWriterReleaser) *Channel {
 	ch := newChannel(dc, webrtc.SDPTypeAnswer, release, label)
-	ch.accept = accept
 	ch.raddr = NewClientAddr(cid, label)
 	ch.laddr = NewServerAddr(sname, label)
 	return ch
@@ -92,7 +319,7 @@ func NewAnswerChannel(sname, cid string, dc *webrtc.DataChannel, label *Label, a
 
 func newChannel(dc *webrtc.DataChannel, typ webrtc.SDPType, release chan ReadWriterReleaser, label *Label) *Channel {
 	ch := &Channel{
-		batchSize: 4096,
+		batchSize: 16 << 10,
 		status:    Idle,
 		Type:      typ,
 		dc:        dc,
@@ -100,9 +327,21 @@ func newChannel(dc *webrtc.DataChannel, typ webrtc.SDPType, release chan ReadWri
 		release:   release,
 		open:      make(chan struct{}),
 		close:     make(chan struct{}),
+		writable:  make(chan struct{}, 1),
+		wdl:       deadline.New(),
+		bytesIn:   channelBytes.With(string(label.ChannelType), "in"),
+		bytesOut:  channelBytes.With(string(label.ChannelType), "out"),
+	}
+	if label.ChannelType == Datagram {
+		ch.datagram = true
+		ch.batchSize = MaxDatagramSize
 	}
 	logrus.Debugf("register %s on message", ch.dc.Label())
 	dc.OnMessage(ch.OnMessage)
+	dc.SetBufferedAmountLowThreshold(uint64(SendLowWater))
+	dc.OnBufferedAmountLow(func() {
+		notify(ch.writable)
+	})
 	dc.OnOpen(func() {
 		logrus.Debugf("channel %s opend", ch.Label().String())
 		select {
@@ -114,30 +353,35 @@ func newChannel(dc *webrtc.DataChannel, typ webrtc.SDPType, release chan ReadWri
 	})
 
 	dc.OnClose(func() {
+		ch.mu.Lock()
+		ch.status = Closed
 		select {
 		case <-ch.close:
+			ch.mu.Unlock()
 			return
 		default:
 			close(ch.close)
 		}
+		ch.mu.Unlock()
+		ch.releaseReader()
 	})
 	return ch
 }
 
+// OnMessage queues the data for the taken conn, it is dropped if the channel is not taken.
 func (c *Channel) OnMessage(msg webrtc.DataChannelMessage) {
-	select {
-	case <-c.close:
+	c.bytesIn.Add(uint64(len(msg.Data)))
+	rd := c.reader()
+	if rd == nil {
+		logrus.Debugf("%s drop data %d, not taken", c.dc.Label(), len(msg.Data))
 		return
-	case <-c.open:
-		if c.TakeConn() {
-			if c.Type == webrtc.SDPTypeAnswer && c.accept != nil {
-				logrus.Debugf("channel %s accept", c.Label().String())
-				c.accept <- c
-			}
-		}
-		c.rd.OnData(msg.Data)
-		logrus.Debugf("%s recv data %d", c.dc.Label(), len(msg.Data))
 	}
+	if c.datagram {
+		rd.OfferData(msg.Data)
+		return
+	}
+	rd.OnData(msg.Data)
+	logrus.Debugf("%s recv data %d", c.dc.Label(), len(msg.Data))
 }
 
 func min(a, b int) int {
@@ -148,6 +392,8 @@ func min(a, b int) int {
 }
 
 func (c *Channel) TakeConn() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.status != Idle {
 		return false
 	}
@@ -155,29 +401,229 @@ func (c *Channel) TakeConn() bool {
 	logrus.Debugf("channel %s taken", c.Label().String())
 	c.status = Active
 
-	var rd = NewChannelReader(c.batchSize)
-	c.rd = rd
-	c.buffer = bufio.NewReader(rd)
-
+	c.rd = NewChannelReader(RecvWindow)
+	c.rd.onDrained = c.remoteDrained
+	c.done = make(chan struct{})
+	c.ack = make(chan error, 1)
+	c.wdl.Set(time.Time{})
+	c.header = ""
+	c.sent = 0
+	c.wclosed = false
+	c.werr = nil
+	c.remoteDone = false
 	return true
 }
+
+// IsClosed reports whether the data channel is closed, it cannot be taken any more.
+func (c *Channel) IsClosed() bool {
+	select {
+	case <-c.close:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Channel) sendCommand(cmd Command, size int64, reason string) error {
+	if c.command == nil {
+		return stderr.New("channel " + c.label.String() + " has no command channel")
+	}
+	return c.command(DataChannelCommand{Cmd: cmd, Label: c.label.String(), Size: size, Reason: reason})
+}
+
+// connect asks the remote peer to take the channel with header and waits for its ack.
+func (c *Channel) connect(header string, timeout time.Duration) error {
+	c.mu.Lock()
+	ack := c.ack
+	c.header = header
+	c.mu.Unlock()
+	if c.command == nil {
+		return stderr.New("channel " + c.label.String() + " has no command channel")
+	}
+	err := c.command(DataChannelCommand{Cmd: CmdConnect, Label: c.label.String(), Header: header})
+	if err != nil {
+		return err
+	}
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+	select {
+	case err := <-ack:
+		return err
+	case <-c.close:
+		return net.ErrClosed
+	case <-tm.C:
+		return stderr.New("connect " + c.label.String() + " timeout")
+	}
+}
+
+// onAck ends connect, err is the reset reason of the remote.
+func (c *Channel) onAck(err error) {
+	c.mu.Lock()
+	ack := c.ack
+	c.mu.Unlock()
+	if ack == nil {
+		return
+	}
+	select {
+	case ack <- err:
+	default:
+	}
+}
+
+// CloseWrite tells the remote peer that nothing more is written, it reads EOF after the data sent.
+func (c *Channel) CloseWrite() error {
+	if c.datagram {
+		return nil
+	}
+	c.mu.Lock()
+	if c.status != Active || c.wclosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.wclosed = true
+	sent := c.sent
+	c.mu.Unlock()
+	return c.sendCommand(CmdEOF, sent, "")
+}
+
+// remoteEOF is called when the remote peer closed write after size bytes.
+func (c *Channel) remoteEOF(size int64) {
+	if rd := c.reader(); rd != nil {
+		rd.CloseAt(size)
+	}
+}
+
+// remoteDisconnect is called when the remote peer released the conn after sending size bytes,
+// err is the reason of a reset, the reads fail with it instead of EOF.
+func (c *Channel) remoteDisconnect(size int64, err error) {
+	c.mu.Lock()
+	rd := c.rd
+	if c.status != Active || rd == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.werr = io.ErrClosedPipe
+	if err != nil {
+		c.werr = err
+	}
+	c.mu.Unlock()
+	if err != nil {
+		rd.Fail(err)
+	}
+	rd.CloseAt(size)
+}
+
+// remoteDrained is called when everything the remote sent before EOF is received,
+// the channel is idle again if both sides released it.
+func (c *Channel) remoteDrained() {
+	c.mu.Lock()
+	if c.werr == nil {
+		// only a half close
+		c.mu.Unlock()
+		return
+	}
+	c.remoteDone = true
+	idle := c.isReleased()
+	c.mu.Unlock()
+	if idle {
+		c.idle()
+	}
+}
+
+func (c *Channel) isReleased() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// idle gives the channel back to the pool.
+func (c *Channel) idle() {
+	c.mu.Lock()
+	if c.status != Active {
+		c.mu.Unlock()
+		return
+	}
+	logrus.Debugf("channel %s idle", c.label)
+	c.status = Idle
+	c.rd = nil
+	c.mu.Unlock()
+	if c.release == nil {
+		return
+	}
+	select {
+	case c.release <- c:
+	case <-c.close:
+	}
+}
+
+func (c *Channel) reader() *ChannelReader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rd
+}
+
+func (c *Channel) releaseReader() {
+	if rd := c.reader(); rd != nil {
+		rd.Release()
+	}
+}
+
+// Release ends the conn and tells the remote peer, which reads EOF after the data sent.
 func (c *Channel) Release() {
+	c.release0(CmdDisConnect, "")
+}
+
+// Reset ends the conn, the remote reads and writes fail with reason.
+func (c *Channel) Reset(reason string) {
+	c.release0(CmdReset, reason)
+}
+
+func (c *Channel) release0(cmd Command, reason string) {
+	c.mu.Lock()
 	logrus.Debugf("start to release %s conn %s ", c.dc.Label(), c.status)
-	if c.status != Active {
+	if c.status != Active || c.isReleased() {
+		c.mu.Unlock()
 		return
 	}
+	close(c.done)
 	c.rd.Release()
-	c.status = Idle
+	sent := c.sent
+	idle := c.remoteDone
+	c.mu.Unlock()
+	// datagram channels carry their flow in the header, they are never reused
+	if c.datagram {
+		c.Close()
+		select {
+		case c.release <- c:
+		default:
+		}
+		return
+	}
+	if err := c.sendCommand(cmd, sent, reason); err != nil {
+		logrus.Errorf("send %s %s error:%v", cmd, c.label, err)
+		c.Close()
+		return
+	}
+	if idle {
+		c.idle()
+	}
 }
 
 func (c *Channel) Close() error {
+	c.mu.Lock()
 	c.status = Closed
 	select {
 	case <-c.close:
+		c.mu.Unlock()
 		return nil
 	default:
 	}
 	close(c.close)
+	c.mu.Unlock()
+	c.releaseReader()
 	return c.dc.Close()
 }
 
@@ -191,36 +637,135 @@ func (c *Channel) RemoteAddr() net.Addr {
 	return c.raddr
 }
 
+// Protocol is the header the conn is connected with, or the sub protocol of the channel.
+func (c *Channel) Protocol() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.header != "" {
+		return c.header
+	}
+	return c.dc.Protocol()
+}
+
 func (c *Channel) Read(data []byte) (n int, err error) {
-	select {
-	case <-c.close:
-		if c.buffer.Buffered() > 0 {
-			return c.buffer.Read(data)
+	rd := c.reader()
+	if rd == nil {
+		return 0, net.ErrClosed
+	}
+	if c.datagram {
+		return rd.ReadMsg(data)
+	}
+	return rd.Read(data)
+}
+
+func (c *Channel) SetReadDeadline(t time.Time) error {
+	if rd := c.reader(); rd != nil {
+		rd.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c *Channel) SetWriteDeadline(t time.Time) error {
+	c.wdl.Set(t)
+	return nil
+}
+
+// waitWritable blocks until the channel is open and at most SendHighWater bytes are buffered.
+func (c *Channel) waitWritable(released <-chan struct{}) error {
+	var opening = c.open
+	for {
+		select {
+		case <-c.close:
+			return net.ErrClosed
+		case <-released:
+			return net.ErrClosed
+		case <-c.wdl.Done():
+			return os.ErrDeadlineExceeded
+		default:
 		}
-		return 0, io.EOF
-	default:
-		return c.buffer.Read(data)
+		if opening == nil && c.dc.BufferedAmount() <= uint64(SendHighWater) {
+			return nil
+		}
+		// buffered amount low is edge triggered, recheck periodically so a missed edge cannot stall the writer
+		var recheck = time.NewTimer(writableRecheck)
+		select {
+		case <-opening:
+			opening = nil
+		case <-c.writable:
+		case <-recheck.C:
+		case <-c.close:
+		case <-released:
+		case <-c.wdl.Done():
+		}
+		recheck.Stop()
 	}
 }
 
 func (c *Channel) Write(data []byte) (int, error) {
+	if c.datagram {
+		return c.writeDatagram(data)
+	}
+	c.mu.Lock()
+	var done = c.done
+	c.mu.Unlock()
 	var size = len(data)
 	writen := 0
-	for i := 0; i < size; i += c.batchSize {
-		writen = min(size, i+c.batchSize)
-		select {
-		case <-c.close:
-			return 0, net.ErrClosed
-		case <-c.open:
-			err := c.dc.Send(data[i:writen])
-			if err != nil {
-				return writen, stderr.Wrap(err)
-			}
+	for writen < size {
+		if err := c.waitWritable(done); err != nil {
+			return writen, err
+		}
+		end := min(size, writen+c.batchSize)
+		c.mu.Lock()
+		if err := c.writeErr(); err != nil {
+			c.mu.Unlock()
+			return writen, err
+		}
+		err := c.dc.Send(data[writen:end])
+		if err == nil {
+			c.sent += int64(end - writen)
+			c.bytesOut.Add(uint64(end - writen))
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return writen, stderr.Wrap(err)
 		}
+		writen = end
 	}
 	return writen, nil
 }
 
+func (c *Channel) writeErr() error {
+	if c.werr != nil {
+		return c.werr
+	}
+	if c.wclosed {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+func (c *Channel) writeDatagram(data []byte) (int, error) {
+	if len(data) > MaxDatagramSize {
+		return 0, stderr.New("datagram too large")
+	}
+	select {
+	case <-c.close:
+		return 0, net.ErrClosed
+	case <-c.wdl.Done():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.open:
+		// datagrams are dropped instead of queued behind a slow link
+		if c.dc.BufferedAmount() > uint64(SendHighWater) {
+			return len(data), nil
+		}
+		if err := c.dc.Send(data); err != nil {
+			return 0, stderr.Wrap(err)
+		}
+		c.bytesOut.Add(uint64(len(data)))
+	}
+	return len(data), nil
+}
+
 // func (c *Channel) loopWrite(ctx context.Context) error {
 // 	var total = 0
 // 	defer func() {
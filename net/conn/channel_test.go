@@ -0,0 +1,266 @@
+package conn
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// peerPair returns two peers that connect over loopback when negotiate is called.
+func peerPair(tb testing.TB) (pa, pb *webrtc.PeerConnection, negotiate func()) {
+	var se webrtc.SettingEngine
+	se.SetIncludeLoopbackCandidate(true)
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(se))
+
+	pa, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pb, err = api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		pa.Close()
+		pb.Close()
+	})
+	negotiate = func() {
+		sdp, err := pa.CreateOffer(nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		gather := webrtc.GatheringCompletePromise(pa)
+		if err := pa.SetLocalDescription(sdp); err != nil {
+			tb.Fatal(err)
+		}
+		<-gather
+		if err := pb.SetRemoteDescription(*pa.LocalDescription()); err != nil {
+			tb.Fatal(err)
+		}
+		sdp, err = pb.CreateAnswer(nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		gather = webrtc.GatheringCompletePromise(pb)
+		if err := pb.SetLocalDescription(sdp); err != nil {
+			tb.Fatal(err)
+		}
+		<-gather
+		if err := pa.SetRemoteDescription(*pb.LocalDescription()); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return pa, pb, negotiate
+}
+
+// channelPair returns both ends of one taken data channel.
+func channelPair(tb testing.TB) (offer, answer *Channel) {
+	pa, pb, negotiate := peerPair(tb)
+	var label = NewLabel(Proxy, 1)
+	ordered := true
+	dc, err := pa.CreateDataChannel(label.String(), &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	offer = NewOfferChannel("bench", "a", dc, label, nil)
+	var answers = make(chan *Channel, 1)
+	pb.OnDataChannel(func(dc *webrtc.DataChannel) {
+		ch := NewAnswerChannel("bench", "a", dc, label, nil)
+		go func() {
+			<-ch.open
+			answers <- ch
+		}()
+	})
+	negotiate()
+
+	select {
+	case answer = <-answers:
+	case <-time.After(10 * time.Second):
+		tb.Fatal("data channel not opened")
+	}
+	offer.TakeConn()
+	answer.TakeConn()
+	return offer, answer
+}
+
+func serveCommand(p *ChannelPool, dc *webrtc.DataChannel) {
+	p.setCommand(dc)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var cmd DataChannelCommand
+		if err := json.Unmarshal(msg.Data, &cmd); err == nil {
+			p.OnCommand(cmd)
+		}
+	})
+}
+
+// poolPair returns the pools of two connected peers, the answer pool accepts on its accept chan.
+func poolPair(tb testing.TB) (offer, answer *ChannelPool) {
+	pa, pb, negotiate := peerPair(tb)
+	offer = NewChannelPool(pa, "", "b", webrtc.SDPTypeOffer)
+	answer = NewChannelPool(pb, "", "a", webrtc.SDPTypeAnswer)
+	answer.accept = make(chan ReadWriterReleaser, 1)
+	tb.Cleanup(func() {
+		offer.Close()
+		answer.Close()
+	})
+	cmd, err := pa.CreateDataChannel(string(Cmd), nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	serveCommand(offer, cmd)
+	pb.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() == string(Cmd) {
+			serveCommand(answer, dc)
+			return
+		}
+		answer.OnChannelOpen(dc)
+	})
+	negotiate()
+	select {
+	case <-offer.cmdOpen:
+	case <-time.After(10 * time.Second):
+		tb.Fatal("command channel not opened")
+	}
+	return offer, answer
+}
+
+// connPair gets a conn from the offer pool and returns it with the one the answer pool accepts.
+func connPair(tb testing.TB, offer, answer *ChannelPool) (a, b ReadWriterReleaser) {
+	a, err := offer.Get(Proxy)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	select {
+	case b = <-answer.accept:
+	case <-time.After(10 * time.Second):
+		tb.Fatal("conn not accepted")
+	}
+	return a, b
+}
+
+func TestChannelReuse(t *testing.T) {
+	offer, answer := poolPair(t)
+	for i := 0; i < 3; i++ {
+		a, b := connPair(t, offer, answer)
+		if i > 0 && a.Label().Index != 1 {
+			t.Fatalf("channel %s is not reused", a.Label())
+		}
+		var msg = []byte(fmt.Sprintf("round %d", i))
+		if _, err := a.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		a.Release()
+		got, err := io.ReadAll(b)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("read %q %v, want %q", got, err, msg)
+		}
+		if _, err := b.Write(msg); err == nil {
+			t.Fatal("write after remote disconnect")
+		}
+		b.Release()
+		// both pools put the channel back to idle
+		for start := time.Now(); offer.ActiveCount()+answer.ActiveCount() > 0; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("channel not idle, %d %d active", offer.ActiveCount(), answer.ActiveCount())
+			}
+		}
+	}
+}
+
+func TestChannelReset(t *testing.T) {
+	offer, answer := poolPair(t)
+	a, b := connPair(t, offer, answer)
+	b.(*Channel).Reset("denied")
+	_, err := a.Read(make([]byte, 16))
+	var reset *ResetError
+	if !errors.As(err, &reset) || reset.Reason != "denied" {
+		t.Fatalf("read error %v, want reset", err)
+	}
+	if _, err := offer.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChannelBusy(t *testing.T) {
+	offer, answer := poolPair(t)
+	a, b := connPair(t, offer, answer)
+	a.Release()
+	io.ReadAll(b)
+	b.Release()
+	for start := time.Now(); offer.IdleCount() == 0 || answer.IdleCount() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("channel not idle")
+		}
+	}
+	// the answer side takes the idle channel for itself at the same time
+	answer.Lock()
+	answer.idles[a.Label().String()].(*Channel).TakeConn()
+	answer.Unlock()
+	a, _ = connPair(t, offer, answer)
+	if a.Label().Index == 1 {
+		t.Fatalf("busy channel %s is used", a.Label())
+	}
+}
+
+func TestChannelWindow(t *testing.T) {
+	old := RecvWindow
+	RecvWindow = 64 << 10
+	defer func() { RecvWindow = old }()
+
+	offer, answer := channelPair(t)
+	var data = make([]byte, 8<<20)
+	rand.Read(data)
+	go func() {
+		offer.Write(data)
+	}()
+
+	var got = make([]byte, len(data))
+	time.Sleep(100 * time.Millisecond)
+	if n := answer.rd.Buffered(); n > RecvWindow {
+		t.Fatalf("%d bytes queued over window %d", n, RecvWindow)
+	}
+	if _, err := io.ReadFull(answer, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func benchmarkChannel(b *testing.B, size int) {
+	offer, answer := channelPair(b)
+	var data = make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+
+	var done = make(chan error, 1)
+	go func() {
+		var buf = make([]byte, 32<<10)
+		var err error
+		for total := 0; err == nil && total < size*b.N; {
+			var n int
+			n, err = answer.Read(buf)
+			total += n
+		}
+		done <- err
+	}()
+	for i := 0; i < b.N; i++ {
+		if _, err := offer.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkChannel16K(b *testing.B) { benchmarkChannel(b, 16<<10) }
+func BenchmarkChannel1M(b *testing.B)  { benchmarkChannel(b, 1<<20) }
@@ -0,0 +1,250 @@
+package conn
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/stderr"
+)
+
+type Command string
+
+const (
+	// CmdConnect asks the remote to take a channel, answered by CmdAck or CmdReset.
+	CmdConnect Command = "connnect"
+	CmdAck     Command = "ack"
+	// CmdDisConnect releases a channel after Size bytes, it is idle once both sides released it.
+	CmdDisConnect Command = "disconnect"
+	// CmdEOF closes the write side after Size bytes.
+	CmdEOF Command = "EOF"
+	// CmdReset aborts a channel with Reason.
+	CmdReset Command = "reset"
+	CmdPing  Command = "ping"
+	CmdPong  Command = "pong"
+)
+
+type DataChannelCommand struct {
+	Cmd    Command
+	Label  string
+	Header string `json:",omitempty"` // the service the conn is connected to
+	Size   int64  `json:",omitempty"` // bytes written before EOF, disconnect or reset
+	Reason string `json:",omitempty"`
+	Seq    uint64 `json:",omitempty"`
+}
+
+// ConnectTimeout is how long Get waits for the remote peer to take a channel.
+var ConnectTimeout = 10 * time.Second
+
+// ReasonBusy resets a connect to a channel the remote peer took for itself at the same time.
+const ReasonBusy = "channel busy"
+
+// maxPending bounds the connects waiting for their channels to open.
+const maxPending = 64
+
+// pendingConnect is a connect of a channel not open yet, it is dropped after ConnectTimeout.
+type pendingConnect struct {
+	DataChannelCommand
+	at time.Time
+}
+
+// ResetError is returned by the reads and writes of a channel reset by the remote peer.
+type ResetError struct {
+	Reason string
+}
+
+func (e *ResetError) Error() string {
+	return "channel reset by peer: " + e.Reason
+}
+
+// serveCommand handles the commands the remote peer sends on dc.
+func (p *Peer) serveCommand(dc *webrtc.DataChannel) {
+	p.ChannelPool.setCommand(dc)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var cmd DataChannelCommand
+		if err := json.Unmarshal(msg.Data, &cmd); err != nil {
+			logrus.Errorf("invalid command %s:%v", msg.Data, err)
+			return
+		}
+		select {
+		case p.cmdChan <- cmd:
+		case <-p.close:
+		}
+	})
+}
+
+func (p *ChannelPool) setCommand(dc *webrtc.DataChannel) {
+	p.Lock()
+	defer p.Unlock()
+	p.cmd = dc
+	var once sync.Once
+	var opened = func() {
+		once.Do(func() { close(p.cmdOpen) })
+	}
+	dc.OnOpen(opened)
+	if dc.ReadyState() == webrtc.DataChannelStateOpen {
+		opened()
+	}
+}
+
+// SendCommand sends cmd to the remote pool on the command channel.
+func (p *ChannelPool) SendCommand(cmd DataChannelCommand) error {
+	select {
+	case <-p.cmdOpen:
+	case <-p.close:
+		return stderr.Wrap(net.ErrClosed)
+	case <-time.After(ConnectTimeout):
+		return stderr.New("command channel not open")
+	}
+	p.RLock()
+	dc := p.cmd
+	p.RUnlock()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return stderr.Wrap(err)
+	}
+	return stderr.Wrap(dc.Send(data))
+}
+
+// channel returns the data channel labeled label.
+func (p *ChannelPool) channel(label string) *Channel {
+	p.RLock()
+	defer p.RUnlock()
+	ch, ok := p.actives[label]
+	if !ok {
+		ch = p.idles[label]
+	}
+	c, _ := ch.(*Channel)
+	return c
+}
+
+// OnCommand handles a command of the remote pool.
+func (p *ChannelPool) OnCommand(cmd DataChannelCommand) {
+	logrus.Debugf("recv command %s %s", cmd.Cmd, cmd.Label)
+	switch cmd.Cmd {
+	case CmdPing:
+		p.reply(DataChannelCommand{Cmd: CmdPong, Seq: cmd.Seq})
+		return
+	case CmdPong:
+		p.onPong(cmd.Seq)
+		return
+	case CmdConnect:
+		p.onConnect(cmd)
+		return
+	}
+	ch := p.channel(cmd.Label)
+	if ch == nil {
+		logrus.Debugf("command %s of unknown channel %s", cmd.Cmd, cmd.Label)
+		return
+	}
+	switch cmd.Cmd {
+	case CmdAck:
+		ch.onAck(nil)
+	case CmdEOF:
+		ch.remoteEOF(cmd.Size)
+	case CmdDisConnect:
+		ch.remoteDisconnect(cmd.Size, nil)
+	case CmdReset:
+		var err = &ResetError{Reason: cmd.Reason}
+		ch.onAck(err)
+		ch.remoteDisconnect(cmd.Size, err)
+	}
+}
+
+func (p *ChannelPool) reply(cmd DataChannelCommand) {
+	if err := p.SendCommand(cmd); err != nil {
+		logrus.Errorf("send command %s %s error:%v", cmd.Cmd, cmd.Label, err)
+	}
+}
+
+// onConnect takes the channel for the remote and hands it to accept.
+func (p *ChannelPool) onConnect(cmd DataChannelCommand) {
+	p.Lock()
+	rwr, ok := p.idles[cmd.Label]
+	if !ok {
+		if _, ok := p.actives[cmd.Label]; !ok {
+			// the channel is not open yet, OnChannelOpen connects it
+			var now = time.Now()
+			for label, c := range p.pending {
+				if now.Sub(c.at) > ConnectTimeout {
+					delete(p.pending, label)
+				}
+			}
+			if len(p.pending) >= maxPending {
+				p.Unlock()
+				p.reply(DataChannelCommand{Cmd: CmdReset, Label: cmd.Label, Reason: "too many pending connects"})
+				return
+			}
+			p.pending[cmd.Label] = pendingConnect{DataChannelCommand: cmd, at: now}
+			p.Unlock()
+			return
+		}
+	}
+	ch, _ := rwr.(*Channel)
+	var reason string
+	switch {
+	case p.accept == nil:
+		reason = "not accepting"
+	case ch == nil || !ch.TakeConn():
+		reason = ReasonBusy
+	default:
+		delete(p.idles, cmd.Label)
+		p.actives[cmd.Label] = ch
+		ch.mu.Lock()
+		ch.header = cmd.Header
+		ch.mu.Unlock()
+	}
+	p.Unlock()
+	if reason != "" {
+		p.reply(DataChannelCommand{Cmd: CmdReset, Label: cmd.Label, Reason: reason})
+		return
+	}
+	p.reply(DataChannelCommand{Cmd: CmdAck, Label: cmd.Label})
+	GoFunc(context.TODO(), func(ctx context.Context) error {
+		select {
+		case p.accept <- ch:
+		case <-p.close:
+		}
+		return nil
+	})
+}
+
+// Ping sends a ping on the command channel and returns the round trip time.
+func (p *ChannelPool) Ping(ctx context.Context) (time.Duration, error) {
+	var seq = p.nextIdx()
+	var pong = make(chan struct{})
+	p.pingMu.Lock()
+	p.pings[seq] = pong
+	p.pingMu.Unlock()
+	defer func() {
+		p.pingMu.Lock()
+		delete(p.pings, seq)
+		p.pingMu.Unlock()
+	}()
+
+	var start = time.Now()
+	if err := p.SendCommand(DataChannelCommand{Cmd: CmdPing, Seq: seq}); err != nil {
+		return 0, err
+	}
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, stderr.Wrap(ctx.Err())
+	case <-p.close:
+		return 0, stderr.New("pool closed")
+	}
+}
+
+func (p *ChannelPool) onPong(seq uint64) {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	if pong, ok := p.pings[seq]; ok {
+		close(pong)
+		delete(p.pings, seq)
+	}
+}
@@ -0,0 +1,34 @@
+package conn
+
+import (
+	"testing"
+
+	"github.com/yixinin/puup/net/mux"
+)
+
+// ChannelPipe connects a channel between two pools and returns both ends.
+func ChannelPipe(tb testing.TB) (ReadWriterReleaser, ReadWriterReleaser) {
+	offer, answer := poolPair(tb)
+	return connPair(tb, offer, answer)
+}
+
+// MuxPipe opens a mux stream over a loopback data channel and returns both ends.
+func MuxPipe(tb testing.TB) (ReadWriterReleaser, ReadWriterReleaser, func()) {
+	offer, answer := channelPair(tb)
+	client := mux.Client(offer, mux.DefaultConfig())
+	server := mux.Server(answer, mux.DefaultConfig())
+	stop := func() {
+		client.Close()
+		server.Close()
+	}
+	a, err := client.Open(string(Proxy))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b, err := server.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &MuxStream{Stream: a, label: NewLabel(Proxy, uint64(a.Id()))},
+		&MuxStream{Stream: b, label: NewLabel(Proxy, uint64(b.Id()))}, stop
+}
@@ -0,0 +1,34 @@
+package conn
+
+import (
+	"strings"
+
+	"github.com/yixinin/puup/stderr"
+)
+
+// FingerprintVerifier checks the DTLS fingerprint announced by the remote peer,
+// so a relayed sdp swapped by the signalling server is rejected.
+type FingerprintVerifier interface {
+	Verify(fingerprint string) error
+}
+
+// ParseFingerprint returns the DTLS fingerprint of sdp,
+// all session and media level fingerprints must be the same.
+func ParseFingerprint(sdp string) (string, error) {
+	var fingerprint string
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=fingerprint:") {
+			continue
+		}
+		fp := strings.TrimPrefix(line, "a=fingerprint:")
+		if fingerprint != "" && !strings.EqualFold(fingerprint, fp) {
+			return "", stderr.New("sdp has different fingerprints")
+		}
+		fingerprint = fp
+	}
+	if fingerprint == "" {
+		return "", stderr.New("sdp has no fingerprint")
+	}
+	return fingerprint, nil
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net"
 	"runtime/debug"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/metrics"
 )
 
 func GoFunc(ctx context.Context, f func(ctx context.Context) error) {
@@ -23,33 +27,83 @@ func GoFunc(ctx context.Context, f func(ctx context.Context) error) {
 	}()
 }
 
+// GoCopy copies both ways, the EOF of one direction is passed on by half closing its writer.
+// Both are closed once both directions end, or one fails or cannot be half closed.
 func GoCopy(src, dst io.ReadWriteCloser) error {
+	var start = time.Now()
+	proxyActive.With().Inc()
 	defer func() {
 		src.Close()
 		dst.Close()
+		proxyActive.With().Dec()
+		proxyDuration.With().Observe(metrics.Since(start))
 	}()
 
-	var ch = make(chan error, 1)
-	GoFunc(context.TODO(), func(ctx context.Context) error {
+	var ch = make(chan error, 2)
+	cp := func(dst io.Writer, src io.Reader) {
 		_, err := io.Copy(dst, src)
-		if errors.Is(err, io.EOF) {
-			return nil
+		if err == nil {
+			err = io.EOF
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+				err = nil
+			}
 		}
-		if err != nil {
-			ch <- err
+		ch <- err
+	}
+	go cp(dst, src)
+	go cp(src, dst)
+	for i := 0; i < 2; i++ {
+		if err := <-ch; err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
 		}
-		return nil
-	})
-	GoFunc(context.TODO(), func(ctx context.Context) error {
-		_, err := io.Copy(src, dst)
-		if errors.Is(err, io.EOF) {
-			return nil
+	}
+	return nil
+}
+
+// CopyDatagram copies messages both ways until one side fails,
+// or no message passes in either direction for idle.
+func CopyDatagram(src, dst io.ReadWriteCloser, idle time.Duration) error {
+	defer func() {
+		src.Close()
+		dst.Close()
+	}()
+
+	var last = time.Now().UnixNano()
+	var ch = make(chan error, 2)
+	cp := func(dst io.Writer, src io.Reader) {
+		var buf = make([]byte, MaxDatagramSize)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				ch <- err
+				return
+			}
+			atomic.StoreInt64(&last, time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				ch <- err
+				return
+			}
 		}
-		if err != nil {
-			ch <- err
+	}
+	go cp(dst, src)
+	go cp(src, dst)
+
+	tk := time.NewTicker(idle / 4)
+	defer tk.Stop()
+	for {
+		select {
+		case err := <-ch:
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		case <-tk.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&last))) > idle {
+				return nil
+			}
 		}
-		return nil
-	})
-	err := <-ch
-	return err
+	}
 }
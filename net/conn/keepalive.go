@@ -3,6 +3,7 @@ package conn
 import (
 	"context"
 	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/pion/webrtc/v3"
@@ -10,22 +11,129 @@ import (
 	"github.com/yixinin/puup/stderr"
 )
 
-func (p *Peer) loopCommand(ctx context.Context, dc *webrtc.DataChannel) error {
-	var ch = make(chan error)
-	defer close(ch)
+// KeepaliveInterval is how often a peer is pinged on the keepalive channel,
+// it is closed after KeepaliveMaxMissed pongs in a row are missed, zero never closes it.
+var (
+	KeepaliveInterval  = 5 * time.Second
+	KeepaliveMaxMissed = 3
+)
 
-	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		var cmd DataChannelCommand
-		err := json.Unmarshal(msg.Data, &cmd)
-		if err != nil {
-			select {
-			case ch <- err:
-			case <-ch:
-			}
+// lossWindow is the number of recent pings the loss rate is computed over.
+const lossWindow = 20
+
+type keepaliveMsg struct {
+	Pong bool `json:",omitempty"`
+	Seq  uint64
+	Time int64 // unix nano of the ping sender
+}
+
+// LinkStats is the link quality measured by keepalive pings.
+type LinkStats struct {
+	RTT    time.Duration // smoothed round trip time
+	Jitter time.Duration // mean deviation of the round trip time
+	Loss   float64       // ratio of the recent pings without pong
+	Sent   uint64
+	Lost   uint64
+}
+
+type linkMonitor struct {
+	sync.Mutex
+	stats  LinkStats
+	seq    uint64
+	acked  uint64 // seq of the latest pong
+	recent []bool // pong received for the recent pings, oldest first
+	missed int    // pings in a row without pong
+}
+
+// ping returns the seq of the next ping, the previous one is lost if it got no pong.
+func (m *linkMonitor) ping() uint64 {
+	m.Lock()
+	defer m.Unlock()
+	if m.seq > 0 && m.acked != m.seq {
+		m.missed++
+		m.stats.Lost++
+		m.record(false)
+	}
+	m.seq++
+	m.stats.Sent++
+	return m.seq
+}
+
+// pong updates the estimates with the round trip time of ping seq.
+func (m *linkMonitor) pong(seq uint64, rtt time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	// late pongs are counted lost already
+	if seq != m.seq || m.acked == seq {
+		return
+	}
+	m.acked = seq
+	m.missed = 0
+	m.record(true)
+	if m.stats.RTT == 0 {
+		m.stats.RTT = rtt
+		m.stats.Jitter = rtt / 2
+		return
+	}
+	// same gains as the tcp retransmission timer, rfc 6298
+	var diff = m.stats.RTT - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	m.stats.Jitter += (diff - m.stats.Jitter) / 4
+	m.stats.RTT += (rtt - m.stats.RTT) / 8
+}
+
+func (m *linkMonitor) record(ok bool) {
+	m.recent = append(m.recent, ok)
+	if len(m.recent) > lossWindow {
+		m.recent = m.recent[1:]
+	}
+	var lost int
+	for _, ok := range m.recent {
+		if !ok {
+			lost++
 		}
-		p.cmdChan <- cmd
-	})
-	return <-ch
+	}
+	m.stats.Loss = float64(lost) / float64(len(m.recent))
+}
+
+// reset forgets the missed pings, e.g. while the connection restarts.
+func (m *linkMonitor) reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.missed = 0
+	m.acked = m.seq
+}
+
+func (m *linkMonitor) dead() bool {
+	m.Lock()
+	defer m.Unlock()
+	return KeepaliveMaxMissed > 0 && m.missed >= KeepaliveMaxMissed
+}
+
+// Link returns the link quality measured by keepalive pings.
+func (p *Peer) Link() LinkStats {
+	p.link.Lock()
+	defer p.link.Unlock()
+	return p.link.stats
+}
+
+func (p *Peer) onKeepalive(dc *webrtc.DataChannel, data []byte) {
+	var msg keepaliveMsg
+	if err := json.Unmarshal(data, &msg); err != nil {
+		logrus.Debugf("invalid keepalive %s:%v", data, err)
+		return
+	}
+	if msg.Pong {
+		p.link.pong(msg.Seq, time.Since(time.Unix(0, msg.Time)))
+		return
+	}
+	msg.Pong = true
+	data, _ = json.Marshal(msg)
+	if err := dc.Send(data); err != nil {
+		logrus.Errorf("send pong error:%v", err)
+	}
 }
 
 func (p *Peer) loopKeepalive(ctx context.Context, dc *webrtc.DataChannel) error {
@@ -35,7 +143,7 @@ func (p *Peer) loopKeepalive(ctx context.Context, dc *webrtc.DataChannel) error
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-
+		p.onKeepalive(dc, msg.Data)
 	})
 	var open = make(chan struct{})
 	dc.OnOpen(func() {
@@ -55,7 +163,7 @@ func (p *Peer) loopKeepalive(ctx context.Context, dc *webrtc.DataChannel) error
 	}
 	t.Stop()
 
-	var tk = time.NewTicker(30 * time.Second)
+	var tk = time.NewTicker(KeepaliveInterval)
 	defer tk.Stop()
 	for {
 		select {
@@ -64,10 +172,21 @@ func (p *Peer) loopKeepalive(ctx context.Context, dc *webrtc.DataChannel) error
 		case <-p.close:
 			return nil
 		case <-tk.C:
-			err := dc.Send([]byte{':', ':'})
-			if err != nil {
-				logrus.Errorf("send keep alive error:%v", err)
-			}
+		}
+		// the reconnect grace decides while ice restarts
+		if p.pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			p.link.reset()
+			continue
+		}
+		seq := p.link.ping()
+		if p.link.dead() {
+			logrus.Infof("peer %s missed %d pongs, close it", p.Id, KeepaliveMaxMissed)
+			p.Close()
+			return nil
+		}
+		data, _ := json.Marshal(keepaliveMsg{Seq: seq, Time: time.Now().UnixNano()})
+		if err := dc.Send(data); err != nil {
+			logrus.Errorf("send keep alive error:%v", err)
 		}
 	}
 }
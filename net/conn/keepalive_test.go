@@ -0,0 +1,36 @@
+package conn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLinkMonitor(t *testing.T) {
+	var m linkMonitor
+	m.pong(m.ping(), 100*time.Millisecond)
+	if m.stats.RTT != 100*time.Millisecond || m.stats.Loss != 0 {
+		t.Fatalf("stats %+v after first pong", m.stats)
+	}
+	m.pong(m.ping(), 180*time.Millisecond)
+	if m.stats.RTT != 110*time.Millisecond || m.stats.Jitter != 57500*time.Microsecond {
+		t.Fatalf("stats %+v, want rtt 110ms jitter 57.5ms", m.stats)
+	}
+
+	// a pong of an older ping does not count
+	seq := m.ping()
+	m.ping()
+	m.pong(seq, time.Millisecond)
+	for i := 0; i < KeepaliveMaxMissed-1; i++ {
+		m.ping()
+	}
+	if !m.dead() {
+		t.Fatalf("not dead after %d missed pongs", m.missed)
+	}
+	if m.stats.Lost != uint64(KeepaliveMaxMissed) || m.stats.Loss != 0.6 {
+		t.Fatalf("stats %+v, want %d lost", m.stats, KeepaliveMaxMissed)
+	}
+	m.reset()
+	if m.dead() {
+		t.Fatal("dead after reset")
+	}
+}
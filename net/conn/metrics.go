@@ -0,0 +1,44 @@
+package conn
+
+import (
+	"sync"
+
+	"github.com/yixinin/puup/metrics"
+)
+
+var (
+	channelBytes = metrics.NewCounterVec("puup_channel_bytes_total",
+		"Bytes received and sent on data channels.", "type", "direction")
+	proxyActive = metrics.NewGaugeVec("puup_proxy_connections",
+		"Proxied connections being copied.")
+	proxyDuration = metrics.NewHistogramVec("puup_proxy_connection_duration_seconds",
+		"Duration of the proxied connections.", metrics.DurationBuckets)
+)
+
+// peers and relayPeers are the peers not closed yet, for the metrics.
+var peers, relayPeers sync.Map
+
+func init() {
+	metrics.NewGaugeFunc("puup_peers", "Peers by connection state.", func(emit func(float64, ...string)) {
+		var states = make(map[string]int)
+		peers.Range(func(key, _ any) bool {
+			states[key.(*Peer).pc.ConnectionState().String()]++
+			return true
+		})
+		relayPeers.Range(func(_, _ any) bool {
+			states["relay"]++
+			return true
+		})
+		for state, n := range states {
+			emit(float64(n), state)
+		}
+	}, "state")
+	metrics.NewGaugeFunc("puup_channels", "Data channels of each peer by state.", func(emit func(float64, ...string)) {
+		peers.Range(func(key, _ any) bool {
+			p := key.(*Peer)
+			emit(float64(p.IdleCount()), p.Id, p.RemoteClientId, "idle")
+			emit(float64(p.ActiveCount()), p.Id, p.RemoteClientId, "active")
+			return true
+		})
+	}, "peer", "remote", "state")
+}
@@ -0,0 +1,142 @@
+package conn
+
+import (
+	"net"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/net/mux"
+	"github.com/yixinin/puup/stderr"
+)
+
+// Multiplex makes the offer side open streams on one mux channel per peer
+// instead of a data channel per connection, the answer side always accepts both.
+var Multiplex = false
+
+// MuxStream is a stream of a mux channel, it is closed on release instead of reused.
+type MuxStream struct {
+	*mux.Stream
+	label        *Label
+	laddr, raddr net.Addr
+}
+
+func (s *MuxStream) Label() *Label {
+	return s.label
+}
+
+func (s *MuxStream) TakeConn() bool {
+	return false
+}
+
+func (s *MuxStream) Release() {
+	s.Stream.Close()
+}
+
+func (s *MuxStream) LocalAddr() net.Addr {
+	return s.laddr
+}
+
+func (s *MuxStream) RemoteAddr() net.Addr {
+	return s.raddr
+}
+
+// muxSession returns the session of the offer side, a new mux channel is created if there is none.
+func (p *ChannelPool) muxSession() (*mux.Session, error) {
+	p.muxMu.Lock()
+	defer p.muxMu.Unlock()
+	if p.mux != nil && !p.mux.IsClosed() {
+		return p.mux, nil
+	}
+	label := NewLabel(Mux, p.nextIdx())
+	ordered := true
+	dc, err := p.pc.CreateDataChannel(label.String(), &webrtc.DataChannelInit{Ordered: &ordered})
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	ch := NewOfferChannel(p.clusterName, p.Id, dc, label, nil)
+	if !ch.TakeConn() {
+		return nil, stderr.New("cannot take conn")
+	}
+	p.mux = mux.Client(ch, mux.DefaultConfig())
+	go closeWith(p.mux, ch)
+	return p.mux, nil
+}
+
+func (p *ChannelPool) openStream(ct ChannelType) (ReadWriterReleaser, error) {
+	sess, err := p.muxSession()
+	if err != nil {
+		return nil, err
+	}
+	st, err := sess.Open(string(ct))
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	label := NewLabel(ct, uint64(st.Id()))
+	return &MuxStream{
+		Stream: st,
+		label:  label,
+		laddr:  NewClientAddr(p.Id, label),
+		raddr:  NewServerAddr(p.clusterName, label),
+	}, nil
+}
+
+// serveMux accepts the streams of a mux channel opened by the offer side.
+func (p *ChannelPool) serveMux(dc *webrtc.DataChannel, label *Label) {
+	ch := NewAnswerChannel(p.clusterName, p.RemoteClientId, dc, label, nil)
+	ch.TakeConn()
+	sess := mux.Server(ch, mux.DefaultConfig())
+	go closeWith(sess, ch)
+	p.muxMu.Lock()
+	p.muxes = append(p.muxes, sess)
+	p.muxMu.Unlock()
+	go func() {
+		for {
+			st, err := sess.Accept()
+			if err != nil {
+				logrus.Debugf("mux %s closed:%v", label, err)
+				return
+			}
+			label := NewLabel(ChannelType(st.Protocol()), uint64(st.Id()))
+			p.accept <- &MuxStream{
+				Stream: st,
+				label:  label,
+				laddr:  NewServerAddr(p.clusterName, label),
+				raddr:  NewClientAddr(p.RemoteClientId, label),
+			}
+		}
+	}()
+}
+
+// closeWith closes the session once its data channel is closed.
+func closeWith(sess *mux.Session, ch *Channel) {
+	select {
+	case <-ch.close:
+		sess.Close()
+	case <-sess.Done():
+	}
+}
+
+// muxStreams counts the open streams of every mux session.
+func (p *ChannelPool) muxStreams() int {
+	p.muxMu.Lock()
+	defer p.muxMu.Unlock()
+	var n int
+	if p.mux != nil {
+		n += p.mux.NumStreams()
+	}
+	for _, sess := range p.muxes {
+		n += sess.NumStreams()
+	}
+	return n
+}
+
+func (p *ChannelPool) closeMux() {
+	p.muxMu.Lock()
+	defer p.muxMu.Unlock()
+	if p.mux != nil {
+		p.mux.Close()
+	}
+	for _, sess := range p.muxes {
+		sess.Close()
+	}
+}
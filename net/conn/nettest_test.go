@@ -0,0 +1,29 @@
+package conn_test
+
+import (
+	"net"
+	"testing"
+
+	pnet "github.com/yixinin/puup/net"
+	"github.com/yixinin/puup/net/conn"
+	"golang.org/x/net/nettest"
+)
+
+func TestConn(t *testing.T) {
+	t.Run("Channel", func(t *testing.T) {
+		nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+			a, b := conn.ChannelPipe(t)
+			c1, c2 = pnet.NewConn(a), pnet.NewConn(b)
+			return c1, c2, func() {
+				c1.Close()
+				c2.Close()
+			}, nil
+		})
+	})
+	t.Run("Mux", func(t *testing.T) {
+		nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+			a, b, stop := conn.MuxPipe(t)
+			return pnet.NewConn(a), pnet.NewConn(b), stop, nil
+		})
+	})
+}
@@ -10,8 +10,20 @@ import (
 	"github.com/yixinin/puup/stderr"
 )
 
+// sessionId is the signalling session of the peer, the peer id of the offer side.
+func (p *Peer) sessionId() string {
+	if p.Type == webrtc.SDPTypeOffer {
+		return p.Id
+	}
+	return p.RemoteId
+}
+
 func (p *Peer) SendOffer(ctx context.Context) error {
-	offer, err := p.pc.CreateOffer(nil)
+	return p.sendOffer(ctx, nil)
+}
+
+func (p *Peer) sendOffer(ctx context.Context, opts *webrtc.OfferOptions) error {
+	offer, err := p.pc.CreateOffer(opts)
 	if err != nil {
 		return stderr.Wrap(err)
 	}
@@ -62,68 +74,123 @@ func (p *Peer) SendAnswer(ctx context.Context) error {
 	return nil
 }
 
-func (p *Peer) WaitAnswer(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
-	defer cancel()
+// loopSignal handles the remote sdp and candidates for the whole peer life,
+// so later ice restarts are negotiated through the same session.
+func (p *Peer) loopSignal(ctx context.Context) error {
+	sdps := p.sig.RemoteSdp(p.sessionId())
+	ices := p.sig.RemoteIceCandidates(p.sessionId())
 	for {
 		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-p.connected:
+		case <-p.close:
 			return nil
-		case sdp, ok := <-p.sig.RemoteSdp(p.RemoteId):
+		case sdp, ok := <-sdps:
 			if !ok {
 				return nil
 			}
-			logrus.Debugf("recv %s sdp, %s < %s", sdp.Type, p.pc.ConnectionState(), webrtc.PeerConnectionStateConnected)
-			if p.pc.ConnectionState() < webrtc.PeerConnectionStateConnected {
-				err := p.pc.SetRemoteDescription(sdp)
-				if err != nil {
-					return stderr.Wrap(err)
+			logrus.Debugf("recv %s sdp, state %s", sdp.Type, p.pc.ConnectionState())
+			if err := p.onRemoteSdp(ctx, sdp); err != nil {
+				select {
+				case p.sigErr <- err:
+				default:
 				}
+				logrus.Errorf("handle %s sdp error:%v", sdp.Type, err)
 			}
-		case ice := <-p.sig.RemoteIceCandidates(p.RemoteId):
-			logrus.Debugf("recv ice, %s < %s", p.pc.ICEConnectionState(), webrtc.ICEConnectionStateConnected)
-			if p.pc.ICEConnectionState() < webrtc.ICEConnectionStateConnected {
-				err := p.pc.AddICECandidate(ice.ToJSON())
-				if err != nil {
-					return stderr.Wrap(err)
-				}
+		case ice, ok := <-ices:
+			if !ok {
+				return nil
 			}
+			p.onRemoteCandidate(ice.ToJSON())
+		}
+	}
+}
+
+func (p *Peer) onRemoteSdp(ctx context.Context, sdp webrtc.SessionDescription) error {
+	switch sdp.Type {
+	case webrtc.SDPTypeOffer:
+		if p.Type != webrtc.SDPTypeAnswer {
+			return nil
+		}
+		if err := p.pc.SetRemoteDescription(sdp); err != nil {
+			return stderr.Wrap(err)
+		}
+		p.flushCandidates()
+		return p.SendAnswer(ctx)
+	case webrtc.SDPTypeAnswer:
+		if p.Type != webrtc.SDPTypeOffer || p.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+			return nil
+		}
+		if err := p.verifyAnswer(sdp); err != nil {
+			// a swapped answer means the signalling is not trusted any more
+			p.Close()
+			return err
+		}
+		if err := p.pc.SetRemoteDescription(sdp); err != nil {
+			return stderr.Wrap(err)
+		}
+		p.flushCandidates()
+	}
+	return nil
+}
+
+// onRemoteCandidate keeps the candidates arrived before the remote description.
+func (p *Peer) onRemoteCandidate(ice webrtc.ICECandidateInit) {
+	p.mu.Lock()
+	if p.pc.RemoteDescription() == nil {
+		p.pending = append(p.pending, ice)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	if err := p.pc.AddICECandidate(ice); err != nil {
+		logrus.Errorf("add ice candidate error:%v", err)
+	}
+}
+
+func (p *Peer) flushCandidates() {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+	for _, ice := range pending {
+		if err := p.pc.AddICECandidate(ice); err != nil {
+			logrus.Errorf("add ice candidate error:%v", err)
 		}
 	}
 }
+
+func (p *Peer) WaitAnswer(ctx context.Context) error {
+	return p.waitConnected(ctx)
+}
+
 func (p *Peer) PollOffer(ctx context.Context) error {
+	return p.waitConnected(ctx)
+}
+
+func (p *Peer) waitConnected(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 	defer cancel()
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-p.connected:
-			return nil
-		case sdp, ok := <-p.sig.RemoteSdp(p.RemoteId):
-			if !ok {
-				return nil
-			}
-			logrus.Debugf("recv %s sdp, %s < %s", sdp.Type, p.pc.ConnectionState(), webrtc.PeerConnectionStateConnected)
-			if p.pc.ConnectionState() < webrtc.PeerConnectionStateConnected {
-				err := p.pc.SetRemoteDescription(sdp)
-				if err != nil {
-					return stderr.Wrap(err)
-				}
-				if err := p.SendAnswer(ctx); err != nil {
-					return err
-				}
-			}
-		case ice := <-p.sig.RemoteIceCandidates(p.RemoteId):
-			logrus.Debugf("recv ice, %s < %s", p.pc.ICEConnectionState(), webrtc.ICEConnectionStateConnected)
-			if p.pc.ICEConnectionState() < webrtc.ICEConnectionStateConnected {
-				err := p.pc.AddICECandidate(ice.ToJSON())
-				if err != nil {
-					return stderr.Wrap(err)
-				}
-			}
-		}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.close:
+		return stderr.New("peer closed")
+	case err := <-p.sigErr:
+		return err
+	case <-p.connected:
+		return nil
+	}
+}
+
+func (p *Peer) verifyAnswer(sdp webrtc.SessionDescription) error {
+	if p.verifier == nil {
+		return nil
+	}
+	fp, err := ParseFingerprint(sdp.SDP)
+	if err != nil {
+		return err
 	}
+	if err := p.verifier.Verify(fp); err != nil {
+		return stderr.Wrap(err)
+	}
+	return nil
 }
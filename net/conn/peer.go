@@ -4,6 +4,8 @@ import (
 	"context"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
@@ -16,19 +18,6 @@ type PeerId string
 type ClientId string
 type ClusterName string
 
-type Command string
-
-const (
-	CmdConnect    Command = "connnect"
-	CmdDisConnect Command = "disconnect"
-	CmdEOF        Command = "EOF"
-)
-
-type DataChannelCommand struct {
-	Cmd   Command
-	Label string
-}
-
 type ReadWriterReleaser interface {
 	io.ReadWriter
 	Label() *Label
@@ -36,19 +25,45 @@ type ReadWriterReleaser interface {
 	Release()
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
 }
 
+// Transport carries the channels to one remote client, a webrtc *Peer or a *RelayPeer.
+type Transport interface {
+	Get(ct ChannelType, labels ...string) (ReadWriterReleaser, error)
+	GetDatagram(protocol string) (ReadWriterReleaser, error)
+	RemoteClient() string
+	ActiveCount() int
+	RTT() time.Duration
+	Done() <-chan struct{}
+	IsClose() bool
+	Close() error
+}
+
+// ReconnectGrace is how long a disconnected peer keeps its channels while restarting ice.
+var ReconnectGrace = 30 * time.Second
+
 type Peer struct {
 	*ChannelPool
 
-	sig Signalinger
-	pc  *webrtc.PeerConnection
+	sig      Signalinger
+	pc       *webrtc.PeerConnection
+	verifier FingerprintVerifier
 
 	cmdChan chan DataChannelCommand
+	link    linkMonitor
+
+	mu         sync.Mutex
+	grace      *time.Timer
+	restarting bool
+	pending    []webrtc.ICECandidateInit
+	sigErr     chan error
 
 	connected chan struct{}
 	open      chan struct{}
 	close     chan struct{}
+	closeOnce sync.Once
 }
 
 func newPeer(pc *webrtc.PeerConnection, rid, rcid string, pt webrtc.SDPType, sig Signalinger) *Peer {
@@ -59,25 +74,34 @@ func newPeer(pc *webrtc.PeerConnection, rid, rcid string, pt webrtc.SDPType, sig
 		pc:  pc,
 
 		cmdChan:   make(chan DataChannelCommand, 1),
+		sigErr:    make(chan error, 1),
 		connected: make(chan struct{}, 1),
 		open:      make(chan struct{}),
 		close:     make(chan struct{}),
 	}
+	peers.Store(p, struct{}{})
 	go p.loop()
 	return p
 }
 
-func NewOfferPeer(sig Signalinger, remoteClientId string) (*Peer, error) {
-	pc, err := webrtc.NewPeerConnection(ice.Config)
+// NewOfferPeer creates a frontend peer, the answer fingerprint is checked by verifier if not nil.
+func NewOfferPeer(sig Signalinger, remoteClientId string, verifier FingerprintVerifier) (*Peer, error) {
+	pc, err := webrtc.NewPeerConnection(ice.GetConfig())
 	if err != nil {
 		return nil, stderr.Wrap(err)
 	}
 
 	p := newPeer(pc, "", remoteClientId, webrtc.SDPTypeOffer, sig)
+	p.verifier = verifier
 	dc, err := pc.CreateDataChannel("keepalive", nil)
 	if err != nil {
 		return nil, err
 	}
+	cmd, err := pc.CreateDataChannel(string(Cmd), nil)
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	p.serveCommand(cmd)
 
 	GoFunc(context.TODO(), func(ctx context.Context) error {
 		return p.loopKeepalive(ctx, dc)
@@ -85,8 +109,14 @@ func NewOfferPeer(sig Signalinger, remoteClientId string) (*Peer, error) {
 
 	return p, nil
 }
-func NewAnswerPeer(sig Signalinger, remoteClientId, remoteId string, accept chan ReadWriterReleaser) (*Peer, error) {
-	pc, err := webrtc.NewPeerConnection(ice.Config)
+
+// NewAnswerPeer creates a backend peer, cert is the long-lived identity of the backend.
+func NewAnswerPeer(sig Signalinger, remoteClientId, remoteId string, accept chan ReadWriterReleaser, cert *webrtc.Certificate) (*Peer, error) {
+	var cfg = ice.GetConfig()
+	if cert != nil {
+		cfg.Certificates = []webrtc.Certificate{*cert}
+	}
+	pc, err := webrtc.NewPeerConnection(cfg)
 	if err != nil {
 		return nil, stderr.Wrap(err)
 	}
@@ -102,12 +132,7 @@ func (p *Peer) loop() {
 		case <-p.close:
 			return
 		case cmd := <-p.cmdChan:
-			switch cmd.Cmd {
-			case CmdConnect:
-			case CmdDisConnect:
-				p.ChannelPool.OnRelease(cmd.Label)
-			case CmdEOF:
-			}
+			p.ChannelPool.OnCommand(cmd)
 		}
 	}
 }
@@ -120,9 +145,7 @@ func (p *Peer) handleChannel(dc *webrtc.DataChannel) {
 		})
 		return
 	case Cmd:
-		GoFunc(context.TODO(), func(ctx context.Context) error {
-			return p.loopCommand(ctx, dc)
-		})
+		p.serveCommand(dc)
 
 	default:
 		if err := p.ChannelPool.OnChannelOpen(dc); err != nil {
@@ -135,21 +158,119 @@ func (p *Peer) OnConnectionStateChange(pcs webrtc.PeerConnectionState) {
 	logrus.Infof("connection state changed :%s", pcs)
 	switch pcs {
 	case webrtc.PeerConnectionStateConnected:
-		p.connected <- struct{}{}
-	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateClosed:
+		p.stopGrace()
+		select {
+		case p.connected <- struct{}{}:
+		default:
+		}
+	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected:
+		if !p.startGrace() {
+			p.Close()
+			return
+		}
+		// only the offer side restarts, the answer side waits for the new offer
+		if p.Type == webrtc.SDPTypeOffer {
+			GoFunc(context.TODO(), p.RestartIce)
+		}
+	case webrtc.PeerConnectionStateClosed:
 		p.Close()
 	}
 }
 
-func (p *Peer) Connect(ctx context.Context) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// startGrace closes the peer if it is not reconnected within ReconnectGrace,
+// it returns false when reconnection is disabled.
+func (p *Peer) startGrace() bool {
+	if ReconnectGrace <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.grace != nil {
+		return true
+	}
+	p.grace = time.AfterFunc(ReconnectGrace, func() {
+		logrus.Infof("peer %s not reconnected in %s, close it", p.Id, ReconnectGrace)
+		p.Close()
+	})
+	return true
+}
+
+func (p *Peer) stopGrace() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.grace != nil {
+		p.grace.Stop()
+		p.grace = nil
+	}
+}
+
+// RestartIce sends ice restart offers until the peer is connected again or closed.
+func (p *Peer) RestartIce(ctx context.Context) error {
+	p.mu.Lock()
+	if p.restarting {
+		p.mu.Unlock()
+		return nil
+	}
+	p.restarting = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.restarting = false
+		p.mu.Unlock()
+	}()
 
+	tk := time.NewTicker(5 * time.Second)
+	defer tk.Stop()
+	for {
+		if p.pc.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			return nil
+		}
+		logrus.Infof("peer %s restart ice", p.Id)
+		if err := p.sendOffer(ctx, &webrtc.OfferOptions{ICERestart: true}); err != nil {
+			logrus.Errorf("send ice restart offer error:%v", err)
+		}
+		select {
+		case <-p.close:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tk.C:
+		}
+	}
+}
+
+func (p *Peer) onICECandidate(c *webrtc.ICECandidate) {
+	if c == nil {
+		return
+	}
+	logrus.Debugf("send ice")
+	var packet = proto.Packet{
+		From: proto.Client{
+			ClientId: p.sig.Id(),
+			PeerId:   p.Id,
+		},
+		To: proto.Client{
+			PeerId:   p.RemoteId,
+			ClientId: p.RemoteClientId,
+		},
+		ICECandidate: c,
+	}
+	err := p.sig.SendPacket(context.TODO(), packet)
+	if err != nil {
+		logrus.Errorf("send candidate error:%v", err)
+	}
+}
+
+func (p *Peer) Connect(ctx context.Context) error {
 	p.pc.OnConnectionStateChange(p.OnConnectionStateChange)
+	p.pc.OnICECandidate(p.onICECandidate)
+	GoFunc(context.TODO(), p.loopSignal)
 	if err := p.SendOffer(ctx); err != nil {
+		p.Close()
 		return err
 	}
 	if err := p.WaitAnswer(ctx); err != nil {
+		p.Close()
 		return err
 	}
 	return nil
@@ -165,30 +286,31 @@ func (p *Peer) Listen(ctx context.Context) error {
 		logrus.Infof("data channel %s created", dc.Label())
 		p.handleChannel(dc)
 	})
-	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c == nil {
-			return
-		}
-		logrus.Debugf("send ice")
-		var packet = proto.Packet{
-			From: proto.Client{
-				ClientId: p.sig.Id(),
-				PeerId:   p.Id,
-			},
-			To: proto.Client{
-				PeerId:   p.RemoteId,
-				ClientId: p.RemoteClientId,
-			},
-			ICECandidate: c,
-		}
-		err := p.sig.SendPacket(ctx, packet)
-		if err != nil {
-			logrus.Errorf("send candidate error:%v", err)
-		}
-	})
+	pc.OnICECandidate(p.onICECandidate)
+	GoFunc(context.TODO(), p.loopSignal)
 	return p.PollOffer(ctx)
 }
 
+// Done is closed when the peer is closed.
+func (p *Peer) Done() <-chan struct{} {
+	return p.close
+}
+
+// RTT returns the keepalive round trip time, or that of the selected candidate pair, zero if unknown.
+func (p *Peer) RTT() time.Duration {
+	if rtt := p.Link().RTT; rtt > 0 {
+		return rtt
+	}
+	for _, s := range p.pc.GetStats() {
+		pair, ok := s.(webrtc.ICECandidatePairStats)
+		if !ok || !pair.Nominated || pair.State != webrtc.StatsICECandidatePairStateSucceeded {
+			continue
+		}
+		return time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+	}
+	return 0
+}
+
 func (p *Peer) IsClose() bool {
 	select {
 	case <-p.close:
@@ -199,9 +321,14 @@ func (p *Peer) IsClose() bool {
 }
 
 func (p *Peer) Close() error {
-	if p.IsClose() {
-		return nil
-	}
-	close(p.close)
-	return p.pc.Close()
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.close)
+		peers.Delete(p)
+		p.stopGrace()
+		p.ChannelPool.Close()
+		p.sig.CloseSession(p.sessionId())
+		err = p.pc.Close()
+	})
+	return err
 }
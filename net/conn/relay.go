@@ -0,0 +1,383 @@
+package conn
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/identity"
+	"github.com/yixinin/puup/net/mux"
+	"github.com/yixinin/puup/proto"
+	"github.com/yixinin/puup/stderr"
+)
+
+// RelayMode is how frontends connect to backends.
+type RelayMode string
+
+const (
+	// RelayAuto connects webrtc and falls back to the relay if ice does not connect within RelayAfter.
+	RelayAuto RelayMode = "auto"
+	RelayOff  RelayMode = "webrtc"
+	RelayOnly RelayMode = "relay"
+)
+
+var (
+	Relay      = RelayAuto
+	RelayAfter = 20 * time.Second
+)
+
+// relayPing keeps the relay websocket alive through proxies and nat.
+const relayPing = 30 * time.Second
+
+// RelayPeer tunnels the streams to one remote client through the signalling server relay,
+// the tunnel is tls with the backend identity certificate, so the server cannot read or alter it.
+type RelayPeer struct {
+	Id             string
+	RemoteClientId string
+	clusterName    string
+
+	sig  Signalinger
+	ws   *websocket.Conn
+	sess *mux.Session
+}
+
+// DialRelay asks the backend remoteClientId to join a relay and tunnels through it,
+// the backend certificate is checked by verifier if not nil.
+func DialRelay(ctx context.Context, sig Signalinger, clusterName, remoteClientId string, verifier FingerprintVerifier) (*RelayPeer, error) {
+	p := &RelayPeer{
+		Id:             uuid.NewString(),
+		RemoteClientId: remoteClientId,
+		clusterName:    clusterName,
+		sig:            sig,
+	}
+	err := sig.SendPacket(ctx, proto.Packet{
+		From:  proto.Client{ClientId: sig.Id(), PeerId: p.Id},
+		To:    proto.Client{ClientId: remoteClientId},
+		Relay: true,
+	})
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	ws, err := sig.DialRelay(ctx, p.Id, remoteClientId)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(newWsConn(ws), &tls.Config{
+		// the certificate is self signed, it is trusted by its fingerprint
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 {
+				return stderr.New("backend sent no certificate")
+			}
+			if verifier == nil {
+				return nil
+			}
+			return verifier.Verify(fingerprintDER(certs[0]))
+		},
+	})
+	if err := conn.HandshakeContext(ctx); err != nil {
+		ws.Close()
+		return nil, stderr.Wrap(err)
+	}
+	p.ws = ws
+	p.sess = mux.Client(conn, mux.DefaultConfig())
+	p.serve()
+	logrus.Infof("relay %s to backend %s connected", p.Id, remoteClientId)
+	return p, nil
+}
+
+// AcceptRelay joins the relay the frontend asked for in cp, the streams it opens are sent to accept.
+func AcceptRelay(ctx context.Context, sig Signalinger, clusterName string, cp ClientPeer, accept chan ReadWriterReleaser, cert *webrtc.Certificate) (*RelayPeer, error) {
+	var err error
+	if cert == nil {
+		if cert, err = identity.GenerateCertificate(); err != nil {
+			return nil, err
+		}
+	}
+	tlsCert, err := tlsCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := sig.DialRelay(ctx, cp.PeerId, cp.ClientId)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Server(newWsConn(ws), &tls.Config{Certificates: []tls.Certificate{tlsCert}})
+	if err := conn.HandshakeContext(ctx); err != nil {
+		ws.Close()
+		return nil, stderr.Wrap(err)
+	}
+	p := &RelayPeer{
+		Id:             cp.PeerId,
+		RemoteClientId: cp.ClientId,
+		clusterName:    clusterName,
+		sig:            sig,
+		ws:             ws,
+		sess:           mux.Server(conn, mux.DefaultConfig()),
+	}
+	p.serve()
+	go func() {
+		for {
+			st, err := p.sess.Accept()
+			if err != nil {
+				logrus.Debugf("relay %s closed:%v", p.Id, err)
+				return
+			}
+			ct, header, _ := strings.Cut(st.Protocol(), "\n")
+			label := NewLabel(ChannelType(ct), uint64(st.Id()))
+			var rwr ReadWriterReleaser = &MuxStream{
+				Stream: st,
+				label:  label,
+				laddr:  NewServerAddr(clusterName, label),
+				raddr:  NewClientAddr(p.RemoteClientId, label),
+			}
+			if label.ChannelType == Datagram {
+				rwr = &relayDatagram{MuxStream: rwr.(*MuxStream), header: header}
+			}
+			select {
+			case accept <- rwr:
+			case <-p.sess.Done():
+				st.Close()
+				return
+			}
+		}
+	}()
+	logrus.Infof("relay %s from frontend %s connected", p.Id, cp.ClientId)
+	return p, nil
+}
+
+// serve pings the websocket until the session is closed.
+func (p *RelayPeer) serve() {
+	relayPeers.Store(p, struct{}{})
+	go func() {
+		tk := time.NewTicker(relayPing)
+		defer tk.Stop()
+		for {
+			select {
+			case <-p.sess.Done():
+				p.Close()
+				return
+			case <-tk.C:
+				if err := p.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+					logrus.Errorf("ping relay %s error:%v", p.Id, err)
+					p.Close()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Get opens a stream of type ct, the labels of webrtc channels are not supported.
+func (p *RelayPeer) Get(ct ChannelType, labels ...string) (ReadWriterReleaser, error) {
+	if len(labels) > 0 {
+		return nil, stderr.New("relay channels have no labels")
+	}
+	return p.open(ct, "")
+}
+
+// GetDatagram opens a stream keeping the datagram boundaries, protocol is passed to the backend on open.
+func (p *RelayPeer) GetDatagram(protocol string) (ReadWriterReleaser, error) {
+	st, err := p.open(Datagram, protocol)
+	if err != nil {
+		return nil, err
+	}
+	return &relayDatagram{MuxStream: st, header: protocol}, nil
+}
+
+func (p *RelayPeer) open(ct ChannelType, header string) (*MuxStream, error) {
+	var protocol = string(ct)
+	if header != "" {
+		protocol += "\n" + header
+	}
+	st, err := p.sess.Open(protocol)
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	label := NewLabel(ct, uint64(st.Id()))
+	return &MuxStream{
+		Stream: st,
+		label:  label,
+		laddr:  NewClientAddr(p.sig.Id(), label),
+		raddr:  NewServerAddr(p.clusterName, label),
+	}, nil
+}
+
+func (p *RelayPeer) RemoteClient() string {
+	return p.RemoteClientId
+}
+
+func (p *RelayPeer) ActiveCount() int {
+	return p.sess.NumStreams()
+}
+
+// RTT is unknown for relays.
+func (p *RelayPeer) RTT() time.Duration {
+	return 0
+}
+
+func (p *RelayPeer) Done() <-chan struct{} {
+	return p.sess.Done()
+}
+
+func (p *RelayPeer) IsClose() bool {
+	return p.sess.IsClosed()
+}
+
+func (p *RelayPeer) Close() error {
+	relayPeers.Delete(p)
+	p.sig.CloseSession(p.Id)
+	p.sess.Close()
+	return p.ws.Close()
+}
+
+// relayDatagram frames each datagram with its length, streams do not keep message boundaries.
+type relayDatagram struct {
+	*MuxStream
+	header string
+
+	rmu sync.Mutex
+	wmu sync.Mutex
+}
+
+func (d *relayDatagram) Protocol() string {
+	return d.header
+}
+
+func (d *relayDatagram) Read(p []byte) (int, error) {
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+	var size [2]byte
+	if _, err := io.ReadFull(d.MuxStream, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n <= len(p) {
+		return io.ReadFull(d.MuxStream, p[:n])
+	}
+	// truncated like a datagram read into a short buffer
+	if _, err := io.ReadFull(d.MuxStream, p); err != nil {
+		return 0, err
+	}
+	_, err := io.CopyN(io.Discard, d.MuxStream, int64(n-len(p)))
+	return len(p), err
+}
+
+func (d *relayDatagram) Write(p []byte) (int, error) {
+	if len(p) > MaxDatagramSize {
+		return 0, stderr.New("datagram too large")
+	}
+	var frame = make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if _, err := d.MuxStream.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// wsConn is a net.Conn over the binary messages of a websocket.
+type wsConn struct {
+	*websocket.Conn
+	r   io.Reader
+	wmu sync.Mutex
+}
+
+func newWsConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{Conn: ws}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+var _ net.Conn = (*wsConn)(nil)
+
+// tlsCertificate converts the webrtc identity certificate for the relay tls.
+func tlsCertificate(cert *webrtc.Certificate) (tls.Certificate, error) {
+	pems, err := cert.PEM()
+	if err != nil {
+		return tls.Certificate{}, stderr.Wrap(err)
+	}
+	block, rest := pem.Decode([]byte(pems))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return tls.Certificate{}, stderr.New("bad certificate pem")
+	}
+	// pion encodes the der in base64 once more
+	der := make([]byte, base64.StdEncoding.DecodedLen(len(block.Bytes)))
+	n, err := base64.StdEncoding.Decode(der, block.Bytes)
+	if err != nil {
+		return tls.Certificate{}, stderr.Wrap(err)
+	}
+	block, _ = pem.Decode(rest)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return tls.Certificate{}, stderr.New("bad private key pem")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return tls.Certificate{}, stderr.Wrap(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der[:n]}, PrivateKey: key}, nil
+}
+
+// fingerprintDER returns the sha-256 fingerprint of a der certificate in sdp form.
+func fingerprintDER(der []byte) string {
+	sum := sha256.Sum256(der)
+	var hex = make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return "sha-256 " + strings.Join(hex, ":")
+}
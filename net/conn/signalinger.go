@@ -3,6 +3,7 @@ package conn
 import (
 	"context"
 
+	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 	"github.com/yixinin/puup/proto"
 )
@@ -10,6 +11,8 @@ import (
 type ClientPeer struct {
 	ClientId string
 	PeerId   string
+	// Relay is set when the frontend asks to connect through the signalling server relay.
+	Relay bool
 }
 type Signalinger interface {
 	Id() string
@@ -18,9 +21,15 @@ type Signalinger interface {
 	RemoteSdp(id string) chan webrtc.SessionDescription
 	RemoteIceCandidates(id string) chan *webrtc.ICECandidate
 	Run(ctx context.Context) error
+	// Serve runs and reconnects until closed.
+	Serve(ctx context.Context) error
 	Close(ctx context.Context) error
 	CloseSession(id string)
 	IsClose() bool
+	// Ready is closed once the signalling handshake succeeded.
+	Ready() chan struct{}
+	// DialRelay opens the relay websocket of peerId to the client target, it returns once the target joined.
+	DialRelay(ctx context.Context, peerId, target string) (*websocket.Conn, error)
 }
 
 type SigStatus string
@@ -8,21 +8,18 @@ type WsBackendSigClient struct {
 	newClient chan ClientPeer
 }
 
-func NewWsBackendSigClient(id, wsURL, clusterName string) *WsBackendSigClient {
+func NewWsBackendSigClient(id, sigAddr, clusterName, secret string) *WsBackendSigClient {
 	c := &WsBackendSigClient{
-		WsSigClient: NewWsSigClient(id, wsURL, clusterName),
+		WsSigClient: NewWsSigClient(id, sigAddr, clusterName, secret),
 		newClient:   make(chan ClientPeer, 1),
 	}
 	c.WsSigClient.OnSession = c.OnSession
 	c.WsSigClient.Type = webrtc.SDPTypeAnswer
 	return c
 }
-func (c *WsBackendSigClient) NewClient() chan ClientPeer {
+func (c *WsBackendSigClient) NewPeer() chan ClientPeer {
 	return c.newClient
 }
-func (c *WsBackendSigClient) OnSession(id, clientId string) {
-	c.newClient <- ClientPeer{
-		ClientId: clientId,
-		PeerId:   id,
-	}
+func (c *WsBackendSigClient) OnSession(cp ClientPeer) {
+	c.newClient <- cp
 }
@@ -6,14 +6,14 @@ type WsFrontendSigClient struct {
 	*WsSigClient
 }
 
-func NewWsFrontendSigClient(id, wsURL, clusterName string) *WsFrontendSigClient {
+func NewWsFrontendSigClient(id, sigAddr, clusterName, token string) *WsFrontendSigClient {
 	c := &WsFrontendSigClient{
-		WsSigClient: NewWsSigClient(id, wsURL, clusterName),
+		WsSigClient: NewWsSigClient(id, sigAddr, clusterName, token),
 	}
 
 	c.Type = webrtc.SDPTypeOffer
 	return c
 }
-func (c *WsFrontendSigClient) NewClient() chan string {
+func (c *WsFrontendSigClient) NewPeer() chan ClientPeer {
 	return nil
 }
@@ -2,7 +2,8 @@ package conn
 
 import (
 	"context"
-	"os"
+	"fmt"
+	"net"
 	"runtime/debug"
 	"sync"
 	"time"
@@ -10,7 +11,9 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/ice"
 	"github.com/yixinin/puup/proto"
+	"github.com/yixinin/puup/stderr"
 )
 
 type WsSigClient struct {
@@ -22,12 +25,16 @@ type WsSigClient struct {
 
 	id          string
 	clusterName string
+	token       string
 	Type        webrtc.SDPType
 
 	sessions map[string]*Session
 
-	OnSession func(id, cid string)
+	OnSession func(cp ClientPeer)
 	isClose   bool
+	ready     chan struct{}
+	closed    chan struct{}
+	wmu       sync.Mutex
 }
 
 type Session struct {
@@ -41,8 +48,8 @@ type Session struct {
 func NewSession(id string) *Session {
 	return &Session{
 		id:  id,
-		sdp: make(chan webrtc.SessionDescription, 1),
-		ice: make(chan *webrtc.ICECandidate, 5),
+		sdp: make(chan webrtc.SessionDescription, 4),
+		ice: make(chan *webrtc.ICECandidate, 64),
 	}
 }
 
@@ -55,6 +62,9 @@ func (s *Session) Close() {
 	}
 	s.Lock()
 	defer s.Unlock()
+	if s.closed {
+		return
+	}
 	s.closed = true
 	close(s.ice)
 	close(s.sdp)
@@ -68,12 +78,15 @@ func (s *Session) IsClose() bool {
 	return s.closed
 }
 
-func NewWsSigClient(id, wsURL, clusterName string) *WsSigClient {
+func NewWsSigClient(id, sigAddr, clusterName, token string) *WsSigClient {
 	return &WsSigClient{
-		wsURL:       wsURL,
+		wsURL:       proto.GetSignallingURL(sigAddr),
 		isClose:     true,
 		id:          id,
 		clusterName: clusterName,
+		token:       token,
+		ready:       make(chan struct{}),
+		closed:      make(chan struct{}),
 		sessions:    make(map[string]*Session, 1),
 	}
 }
@@ -95,18 +108,20 @@ func (c *WsSigClient) CloseSession(id string) {
 }
 
 func (c *WsSigClient) GetSession(id string) *Session {
+	sess, _ := c.getSession(id)
+	return sess
+}
+
+func (c *WsSigClient) getSession(id string) (*Session, bool) {
 	c.Lock()
 	defer c.Unlock()
 	sess, ok := c.sessions[id]
 	if ok {
-		return sess
-	}
-	if c.OnSession != nil {
-		c.OnSession(id, cid)
+		return sess, false
 	}
 	sess = NewSession(id)
 	c.sessions[id] = sess
-	return sess
+	return sess, true
 }
 
 func (s *Session) OnSdp(sdp *webrtc.SessionDescription) {
@@ -114,11 +129,16 @@ func (s *Session) OnSdp(sdp *webrtc.SessionDescription) {
 		return
 	}
 
-	if s.IsClose() {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
 		return
 	}
-
-	s.sdp <- *sdp
+	select {
+	case s.sdp <- *sdp:
+	default:
+		logrus.Errorf("session %s sdp dropped", s.id)
+	}
 }
 
 func (s *Session) OnIceCandidate(ice *webrtc.ICECandidate) {
@@ -126,15 +146,28 @@ func (s *Session) OnIceCandidate(ice *webrtc.ICECandidate) {
 		return
 	}
 
-	if s.IsClose() {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
 		return
 	}
-
-	s.ice <- ice
+	select {
+	case s.ice <- ice:
+	default:
+		logrus.Errorf("session %s candidate dropped", s.id)
+	}
 }
 
 func (c *WsSigClient) SendPacket(ctx context.Context, p proto.Packet) error {
-	return c.conn.WriteJSON(p)
+	c.RLock()
+	conn, closed := c.conn, c.isClose
+	c.RUnlock()
+	if closed || conn == nil {
+		return net.ErrClosed
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return conn.WriteJSON(p)
 }
 func (c *WsSigClient) RemoteSdp(id string) chan webrtc.SessionDescription {
 	return c.GetSession(id).sdp
@@ -143,64 +176,158 @@ func (c *WsSigClient) RemoteIceCandidates(id string) chan *webrtc.ICECandidate {
 	return c.GetSession(id).ice
 }
 
+// Serve runs the signalling client and reconnects after disconnected until closed,
+// sessions survive the reconnection so peers can keep signalling.
+func (c *WsSigClient) Serve(ctx context.Context) error {
+	for {
+		if err := c.Run(ctx); err != nil {
+			logrus.Errorf("sig disconnected:%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.closed:
+			return nil
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
 func (c *WsSigClient) Run(ctx context.Context) error {
-	conn, _, err := websocket.DefaultDialer.Dial(c.wsURL, nil)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.wsURL, nil)
 	if err != nil {
 		return err
 	}
-	c.conn = conn
 	ctx, cancel := context.WithCancel(ctx)
+	c.Lock()
+	c.conn = conn
 	c.cancel = cancel
+	c.Unlock()
 
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.closed:
+		}
+		conn.Close()
+	}()
 	defer func() {
 		if r := recover(); r != nil {
-			logrus.WithField("stacks", string(debug.Stack())).Errorf("sig client paniced:%v", err)
+			logrus.WithField("stacks", string(debug.Stack())).Errorf("sig client paniced:%v", r)
 		}
-		c.isClose = true
-		conn.Close()
 		cancel()
+		c.Lock()
+		c.isClose = true
+		select {
+		case <-c.ready:
+			c.ready = make(chan struct{})
+		default:
+		}
+		c.Unlock()
 	}()
 
 	var header = proto.WsHeader{
-		Type: c.Type,
-		Id:   c.id,
-		Name: c.clusterName,
+		Type:  c.Type,
+		Id:    c.id,
+		Name:  c.clusterName,
+		Token: c.token,
 	}
 	if err := conn.WriteJSON(header); err != nil {
 		return err
 	}
+	var ack proto.WsAck
+	if err := conn.ReadJSON(&ack); err != nil {
+		return err
+	}
+	if ack.Code != proto.WsOk {
+		return stderr.New(fmt.Sprintf("signalling refused, code:%d, msg:%s", ack.Code, ack.Msg))
+	}
+	if len(ack.ICEServers) > 0 {
+		ice.SetProvided(ack.ICEServers)
+	}
 
+	c.Lock()
 	c.isClose = false
-loop:
+	close(c.ready)
+	c.Unlock()
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			var packet proto.Packet
-			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-			err := conn.ReadJSON(&packet)
-			if os.IsTimeout(err) {
-				continue loop
-			}
-			if err != nil {
-				return err
+		var packet proto.Packet
+		err := conn.ReadJSON(&packet)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
 			}
+			return err
+		}
 
-			if packet.To.PeerId == "" {
-				continue loop
-			}
-			sess := c.GetSession(packet.To.PeerId)
-			if sess.IsClose() {
-				continue loop
-			}
-			sess.OnIceCandidate(packet.ICECandidate)
-			sess.OnSdp(packet.Sdp)
+		// sessions are keyed by the peer id of the offer side
+		var sid = packet.To.PeerId
+		if c.Type == webrtc.SDPTypeAnswer {
+			sid = packet.From.PeerId
+		}
+		if sid == "" {
+			continue
 		}
+		sess, isNew := c.getSession(sid)
+		if isNew && c.OnSession != nil {
+			c.OnSession(ClientPeer{ClientId: packet.From.ClientId, PeerId: sid, Relay: packet.Relay})
+		}
+		if sess.IsClose() {
+			continue
+		}
+		sess.OnIceCandidate(packet.ICECandidate)
+		sess.OnSdp(packet.Sdp)
 	}
 }
 
+func (c *WsSigClient) DialRelay(ctx context.Context, peerId, target string) (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, proto.GetRelayURL(c.wsURL), nil)
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	var header = proto.RelayHeader{
+		WsHeader: proto.WsHeader{
+			Type:  c.Type,
+			Id:    c.id,
+			Name:  c.clusterName,
+			Token: c.token,
+		},
+		PeerId: peerId,
+		Target: target,
+	}
+	// the server acks once the other side joined
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Minute)
+	}
+	conn.SetReadDeadline(deadline)
+	var ack proto.WsAck
+	if err = conn.WriteJSON(header); err == nil {
+		err = conn.ReadJSON(&ack)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, stderr.Wrap(err)
+	}
+	if ack.Code != proto.WsOk {
+		conn.Close()
+		return nil, stderr.New(fmt.Sprintf("relay refused, code:%d, msg:%s", ack.Code, ack.Msg))
+	}
+	return conn, nil
+}
+
+// Close stops Serve and the running connection.
 func (c *WsSigClient) Close(ctx context.Context) error {
+	c.Lock()
+	defer c.Unlock()
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
 	if c.cancel != nil {
 		c.cancel()
 	}
@@ -208,5 +335,13 @@ func (c *WsSigClient) Close(ctx context.Context) error {
 }
 
 func (c *WsSigClient) IsClose() bool {
+	c.RLock()
+	defer c.RUnlock()
 	return c.isClose
 }
+
+func (c *WsSigClient) Ready() chan struct{} {
+	c.RLock()
+	defer c.RUnlock()
+	return c.ready
+}
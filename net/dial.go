@@ -12,7 +12,36 @@ func init() {
 	peerClient = NewPeersClient()
 }
 
+// SetVerifier pins the backend fingerprints of serverName for Dial.
+func SetVerifier(serverName string, v conn.FingerprintVerifier) {
+	peerClient.SetVerifier(serverName, v)
+}
+
+// SetClientId sets the frontend client id used with serverName, backends apply their rules by it.
+func SetClientId(serverName, id string) {
+	peerClient.SetClientId(serverName, id)
+}
+
+// SetBalancer sets the backend selection of serverName for Dial.
+func SetBalancer(serverName string, b Balancer) {
+	peerClient.SetBalancer(serverName, b)
+}
+
 // export Dial
-func Dial(sigAddr, serverName string, ct conn.ChannelType) (net.Conn, error) {
-	return peerClient.Dial(sigAddr, serverName, ct)
+func Dial(sigAddr, serverName, token string, ct conn.ChannelType) (net.Conn, error) {
+	return peerClient.Dial(sigAddr, serverName, token, ct)
+}
+
+// DialDatagram dials an unreliable datagram channel, protocol is passed to the backend on open.
+func DialDatagram(sigAddr, serverName, token, key, protocol string) (net.Conn, error) {
+	return peerClient.DialDatagram(sigAddr, serverName, token, key, protocol)
+}
+
+// DialBackend dials the backend client cid, used to reach the backend a channel came from.
+func DialBackend(sigAddr, serverName, token, cid string, ct conn.ChannelType) (net.Conn, error) {
+	return peerClient.DialBackend(sigAddr, serverName, token, cid, ct)
+}
+
+func DialKey(sigAddr, serverName, token, key string, ct conn.ChannelType) (net.Conn, error) {
+	return peerClient.DialKey(sigAddr, serverName, token, key, ct)
 }
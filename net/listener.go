@@ -7,68 +7,98 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/pion/webrtc/v3"
 	"github.com/sirupsen/logrus"
 	"github.com/yixinin/puup/net/conn"
+	"github.com/yixinin/puup/stderr"
 )
 
 type Listener struct {
 	sync.RWMutex
 
-	wsURL       string
 	clusterName string
 	id          string
 
-	sig conn.Signalinger
+	sig  conn.Signalinger
+	cert *webrtc.Certificate
 
 	onClose chan string
 	accept  chan conn.ReadWriterReleaser
+	accepts map[conn.ChannelType]chan conn.ReadWriterReleaser
 
-	peers map[string]*conn.Peer
+	peers map[string]conn.Transport
 
 	isClose bool
 	close   chan struct{}
 }
 
-func NewListener(wsURL, clusterName string) *Listener {
+func NewListener(sigAddr, clusterName, secret string, cert *webrtc.Certificate) *Listener {
 	id := uuid.NewString()
 	lis := &Listener{
 		id:          id,
-		sig:         conn.NewWsBackendSigClient(id, wsURL, clusterName),
+		cert:        cert,
+		sig:         conn.NewWsBackendSigClient(id, sigAddr, clusterName, secret),
 		clusterName: clusterName,
 		onClose:     make(chan string, 1),
 		accept:      make(chan conn.ReadWriterReleaser, 100),
-		peers:       make(map[string]*conn.Peer, 1),
+		accepts:     make(map[conn.ChannelType]chan conn.ReadWriterReleaser),
+		peers:       make(map[string]conn.Transport, 1),
 		close:       make(chan struct{}, 1),
 	}
-	go func() {
-		if err := lis.sig.Run(context.Background()); err != nil {
-			logrus.Errorf("sig disconnected:%v", err)
-		}
-		lis.sig.Close(context.Background())
-	}()
+	for _, ct := range []conn.ChannelType{conn.Web, conn.Proxy, conn.Ssh, conn.File, conn.Datagram} {
+		lis.accepts[ct] = make(chan conn.ReadWriterReleaser, 100)
+	}
+	go lis.sig.Serve(context.Background())
 	go lis.loop()
 	return lis
 }
 
+// Id is the signalling client id of the listener.
+func (l *Listener) Id() string {
+	return l.id
+}
+
+// Accept waits for web channels, so the listener can be served by http.Server.
 func (l *Listener) Accept() (net.Conn, error) {
-	for {
-		select {
-		case <-l.close:
-			return nil, net.ErrClosed
-		case rwr := <-l.accept:
-			conn := NewConn(rwr)
-			return conn, nil
-		}
+	return l.AcceptType(conn.Web)
+}
+
+func (l *Listener) AcceptProxy() (net.Conn, error) {
+	return l.AcceptType(conn.Proxy)
+}
+
+func (l *Listener) AcceptSsh() (net.Conn, error) {
+	return l.AcceptType(conn.Ssh)
+}
+
+func (l *Listener) AcceptFile() (net.Conn, error) {
+	return l.AcceptType(conn.File)
+}
+
+func (l *Listener) AcceptDatagram() (net.Conn, error) {
+	return l.AcceptType(conn.Datagram)
+}
+
+func (l *Listener) AcceptType(ct conn.ChannelType) (net.Conn, error) {
+	ch, ok := l.accepts[ct]
+	if !ok {
+		return nil, stderr.New("cannot accept channel type " + ct.String())
+	}
+	select {
+	case <-l.close:
+		return nil, net.ErrClosed
+	case rwr := <-ch:
+		return NewConn(rwr), nil
 	}
 }
 
-func (l *Listener) AddPeer(key string, p *conn.Peer) {
+func (l *Listener) AddPeer(key string, p conn.Transport) {
 	l.Lock()
 	defer l.Unlock()
 	l.peers[key] = p
 }
 
-func (l *Listener) GetPeer(key string) (*conn.Peer, bool) {
+func (l *Listener) GetPeer(key string) (conn.Transport, bool) {
 	l.RLock()
 	defer l.RUnlock()
 	p, ok := l.peers[key]
@@ -104,30 +134,33 @@ func (l *Listener) Addr() net.Addr {
 }
 
 func (l *Listener) loop() {
-	tk := time.NewTicker(5 * time.Second)
+	defer l.sig.Close(context.Background())
 FOR:
 	for {
 		select {
 		case <-l.close:
 			return
-		case <-tk.C:
-			if l.sig.IsClose() {
-				l.sig = conn.NewWsBackendSigClient(l.id, l.wsURL, l.clusterName)
-				go func() {
-					if err := l.sig.Run(context.TODO()); err != nil {
-						logrus.Errorf("client run error:%v", err)
-					}
-					l.sig.Close(context.Background())
-				}()
+		case rwr := <-l.accept:
+			ch, ok := l.accepts[rwr.Label().ChannelType]
+			if !ok {
+				logrus.Errorf("unknown channel type %s", rwr.Label().ChannelType)
+				rwr.Release()
+				continue FOR
 			}
-		case remoteId := <-l.sig.NewPeer():
+			ch <- rwr
+		case cp := <-l.sig.NewPeer():
+			remoteId := cp.PeerId
 			logrus.Debugf("recv new client: %s", remoteId)
 			if _, ok := l.GetPeer(remoteId); ok {
 				logrus.Debugf("client %s already connected", remoteId)
 				continue FOR
 			}
 
-			p, err := conn.NewAnswerPeer(l.sig, "", remoteId, l.accept)
+			if cp.Relay {
+				go l.acceptRelay(cp)
+				continue FOR
+			}
+			p, err := conn.NewAnswerPeer(l.sig, cp.ClientId, remoteId, l.accept, l.cert)
 			if err != nil {
 				logrus.Debugf("new peer error:%v", err)
 				return
@@ -137,12 +170,27 @@ FOR:
 			go func() {
 				if err := p.Listen(context.TODO()); err != nil {
 					logrus.Errorf("peer connect failed:%v", err)
-					l.DelPeer(remoteId)
-					return
+					p.Close()
 				}
+				<-p.Done()
+				l.DelPeer(remoteId)
 			}()
 		case key := <-l.onClose:
 			l.DelPeer(key)
 		}
 	}
 }
+
+func (l *Listener) acceptRelay(cp conn.ClientPeer) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	p, err := conn.AcceptRelay(ctx, l.sig, l.clusterName, cp, l.accept, l.cert)
+	if err != nil {
+		logrus.Errorf("accept relay from %s error:%v", cp.ClientId, err)
+		l.sig.CloseSession(cp.PeerId)
+		return
+	}
+	l.AddPeer(cp.PeerId, p)
+	<-p.Done()
+	l.DelPeer(cp.PeerId)
+}
@@ -0,0 +1,66 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const version = 1
+
+const (
+	cmdSyn byte = iota // open a stream, the payload is its protocol
+	cmdPsh             // data
+	cmdFin             // no more data from the sender
+	cmdRst             // abort the stream
+	cmdUpd             // the receiver consumed the payload size in bytes
+)
+
+const (
+	headerSize = 8
+	// MaxPayload is the largest payload of a frame.
+	MaxPayload = 16 * 1024
+)
+
+// header is version(1) cmd(1) length(2) stream id(4), big endian.
+type header [headerSize]byte
+
+func (h header) Version() byte {
+	return h[0]
+}
+
+func (h header) Cmd() byte {
+	return h[1]
+}
+
+func (h header) Length() uint16 {
+	return binary.BigEndian.Uint16(h[2:])
+}
+
+func (h header) StreamId() uint32 {
+	return binary.BigEndian.Uint32(h[4:])
+}
+
+func encodeFrame(cmd byte, sid uint32, payload []byte) []byte {
+	var buf = make([]byte, headerSize+len(payload))
+	buf[0] = version
+	buf[1] = cmd
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], sid)
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+func readFrame(r io.Reader) (header, []byte, error) {
+	var h header
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return h, nil, err
+	}
+	if h.Length() == 0 {
+		return h, nil, nil
+	}
+	var payload = make([]byte, h.Length())
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, nil, err
+	}
+	return h, payload, nil
+}
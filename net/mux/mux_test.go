@@ -0,0 +1,102 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func pipe(t *testing.T) (*Session, *Session) {
+	a, b := net.Pipe()
+	cfg := DefaultConfig()
+	cfg.Window = 64 * 1024
+	client, server := Client(a, cfg), Server(b, cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStreams(t *testing.T) {
+	client, server := pipe(t)
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.Open("proxy")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// larger than the window, so the echo needs window updates
+			var data = make([]byte, 300*1024)
+			rand.Read(data)
+			go func() {
+				st.Write(data)
+				st.CloseWrite()
+			}()
+			got, err := io.ReadAll(st)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("stream %d data mismatch", st.Id())
+			}
+			st.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSlowStream(t *testing.T) {
+	client, server := pipe(t)
+	slow, _ := client.Open("slow")
+	fast, _ := client.Open("fast")
+	sslow, _ := server.Accept()
+	sfast, _ := server.Accept()
+	if sslow.Protocol() != "slow" || sfast.Protocol() != "fast" {
+		t.Fatal("protocol mismatch")
+	}
+
+	// fill the window of the slow stream, nobody reads it
+	go slow.Write(make([]byte, 128*1024))
+	var data = make([]byte, 100*1024)
+	go fast.Write(data)
+	if _, err := io.ReadFull(sfast, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := pipe(t)
+	st, _ := client.Open("proxy")
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read after session close")
+	}
+	if _, err := client.Open("proxy"); err == nil {
+		t.Fatal("open after session close")
+	}
+}
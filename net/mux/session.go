@@ -0,0 +1,246 @@
+// Package mux multiplexes streams over one reliable, ordered connection,
+// each stream has its own receive window so a slow reader never stalls the others.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrClosed       = errors.New("mux session closed")
+	ErrStreamReset  = errors.New("mux stream reset")
+	ErrBadVersion   = errors.New("mux version mismatch")
+	ErrWindowExceed = errors.New("mux stream window exceeded")
+)
+
+// DefaultWindow is the bytes a stream may have unread.
+const DefaultWindow = 256 * 1024
+
+type Config struct {
+	Window uint32
+	// Backlog is the number of opened streams waiting for Accept.
+	Backlog int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Window:  DefaultWindow,
+		Backlog: 128,
+	}
+}
+
+type Session struct {
+	sync.Mutex
+	wmu sync.Mutex
+
+	conn io.ReadWriteCloser
+	cfg  Config
+
+	nextId  uint32
+	streams map[uint32]*Stream
+	accepts chan *Stream
+
+	err       error
+	close     chan struct{}
+	closeOnce sync.Once
+}
+
+// Client starts the opening side of conn, its streams have odd ids.
+func Client(conn io.ReadWriteCloser, cfg Config) *Session {
+	return newSession(conn, cfg, 1)
+}
+
+// Server starts the accepting side of conn, its streams have even ids.
+func Server(conn io.ReadWriteCloser, cfg Config) *Session {
+	return newSession(conn, cfg, 2)
+}
+
+func newSession(conn io.ReadWriteCloser, cfg Config, nextId uint32) *Session {
+	if cfg.Window == 0 {
+		cfg.Window = DefaultWindow
+	}
+	if cfg.Backlog <= 0 {
+		cfg.Backlog = 128
+	}
+	s := &Session{
+		conn:    conn,
+		cfg:     cfg,
+		nextId:  nextId,
+		streams: make(map[uint32]*Stream),
+		accepts: make(chan *Stream, cfg.Backlog),
+		close:   make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open starts a stream, protocol is passed to the Accept side.
+func (s *Session) Open(protocol string) (*Stream, error) {
+	if len(protocol) > MaxPayload {
+		return nil, errors.New("mux protocol too long")
+	}
+	s.Lock()
+	if s.IsClosed() {
+		s.Unlock()
+		return nil, ErrClosed
+	}
+	id := s.nextId
+	s.nextId += 2
+	st := newStream(s, id, protocol)
+	s.streams[id] = st
+	s.Unlock()
+
+	if err := s.writeFrame(cmdSyn, id, []byte(protocol)); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for a stream opened by the other side.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.close:
+		return nil, s.Err()
+	}
+}
+
+// NumStreams returns the number of streams not closed yet.
+func (s *Session) NumStreams() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.close:
+		return true
+	default:
+	}
+	return false
+}
+
+// Done is closed with the session.
+func (s *Session) Done() <-chan struct{} {
+	return s.close
+}
+
+// Err is why the session is closed.
+func (s *Session) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.err == nil {
+		return ErrClosed
+	}
+	return s.err
+}
+
+func (s *Session) Close() error {
+	return s.closeWithError(ErrClosed)
+}
+
+func (s *Session) closeWithError(err error) error {
+	var cerr error
+	s.closeOnce.Do(func() {
+		s.Lock()
+		s.err = err
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.Unlock()
+		close(s.close)
+		for _, st := range streams {
+			st.reset(err)
+		}
+		cerr = s.conn.Close()
+	})
+	return cerr
+}
+
+func (s *Session) writeFrame(cmd byte, sid uint32, payload []byte) error {
+	if s.IsClosed() {
+		return s.Err()
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, err := s.conn.Write(encodeFrame(cmd, sid, payload)); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.Lock()
+	defer s.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) recvLoop() {
+	for {
+		h, payload, err := readFrame(s.conn)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if h.Version() != version {
+			s.closeWithError(ErrBadVersion)
+			return
+		}
+		switch h.Cmd() {
+		case cmdSyn:
+			s.onSyn(h.StreamId(), string(payload))
+		case cmdPsh:
+			if st := s.getStream(h.StreamId()); st != nil {
+				if err := st.push(payload); err != nil {
+					st.reset(err)
+					s.removeStream(st.id)
+					s.writeFrame(cmdRst, st.id, nil)
+				}
+			}
+		case cmdFin:
+			if st := s.getStream(h.StreamId()); st != nil {
+				st.remoteFin()
+			}
+		case cmdRst:
+			if st := s.getStream(h.StreamId()); st != nil {
+				st.reset(ErrStreamReset)
+				s.removeStream(st.id)
+			}
+		case cmdUpd:
+			if st := s.getStream(h.StreamId()); st != nil && len(payload) == 4 {
+				st.addCredit(binary.BigEndian.Uint32(payload))
+			}
+		}
+	}
+}
+
+func (s *Session) onSyn(id uint32, protocol string) {
+	s.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.Unlock()
+		return
+	}
+	st := newStream(s, id, protocol)
+	s.streams[id] = st
+	s.Unlock()
+
+	select {
+	case s.accepts <- st:
+	default:
+		// backlog full, refuse the stream
+		s.removeStream(id)
+		s.writeFrame(cmdRst, id, nil)
+	}
+}
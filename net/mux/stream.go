@@ -0,0 +1,248 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/transport/deadline"
+)
+
+// Stream is one bidirectional byte stream of a session.
+type Stream struct {
+	mu sync.Mutex
+
+	id       uint32
+	protocol string
+	sess     *Session
+
+	rbuf     bytes.Buffer
+	consumed uint32 // read but not reported to the sender
+	credit   int64  // bytes we may still send
+	readable chan struct{}
+	writable chan struct{}
+	rdl, wdl *deadline.Deadline
+
+	finRecv    bool
+	finSent    bool
+	readClosed bool
+	err        error
+}
+
+func newStream(s *Session, id uint32, protocol string) *Stream {
+	return &Stream{
+		id:       id,
+		protocol: protocol,
+		sess:     s,
+		credit:   int64(s.cfg.Window),
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+		rdl:      deadline.New(),
+		wdl:      deadline.New(),
+	}
+}
+
+func (st *Stream) Id() uint32 {
+	return st.id
+}
+
+// Protocol is what the stream is opened with.
+func (st *Stream) Protocol() string {
+	return st.protocol
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) push(data []byte) error {
+	st.mu.Lock()
+	if st.readClosed {
+		// nobody reads any more, give the credit back so the sender is not blocked
+		st.mu.Unlock()
+		st.sendUpd(uint32(len(data)))
+		return nil
+	}
+	defer st.mu.Unlock()
+	if uint32(st.rbuf.Len()+len(data)) > st.sess.cfg.Window {
+		return ErrWindowExceed
+	}
+	st.rbuf.Write(data)
+	notify(st.readable)
+	return nil
+}
+
+func (st *Stream) sendUpd(n uint32) {
+	var payload = make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, n)
+	st.sess.writeFrame(cmdUpd, st.id, payload)
+}
+
+func (st *Stream) remoteFin() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.mu.Unlock()
+	notify(st.readable)
+	if done {
+		st.sess.removeStream(st.id)
+	}
+}
+
+func (st *Stream) reset(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+func (st *Stream) addCredit(n uint32) {
+	st.mu.Lock()
+	st.credit += int64(n)
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.rdl.Set(t)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.wdl.Set(t)
+	return nil
+}
+
+func expired(dl *deadline.Deadline) bool {
+	select {
+	case <-dl.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		if expired(st.rdl) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		st.mu.Lock()
+		if st.rbuf.Len() > 0 {
+			n, _ := st.rbuf.Read(p)
+			st.consumed += uint32(n)
+			var upd uint32
+			// report in batches so small reads do not flood the session
+			if st.consumed >= st.sess.cfg.Window/4 || st.rbuf.Len() == 0 {
+				upd = st.consumed
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+			if upd > 0 {
+				st.sendUpd(upd)
+			}
+			return n, nil
+		}
+		err := st.err
+		if st.readClosed {
+			err = io.ErrClosedPipe
+		}
+		fin := st.finRecv
+		st.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if fin {
+			return 0, io.EOF
+		}
+		select {
+		case <-st.readable:
+		case <-st.rdl.Done():
+		case <-st.sess.close:
+			st.reset(st.sess.Err())
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		if expired(st.wdl) {
+			return written, os.ErrDeadlineExceeded
+		}
+		st.mu.Lock()
+		if st.err != nil || st.finSent {
+			err := st.err
+			st.mu.Unlock()
+			if err == nil {
+				err = io.ErrClosedPipe
+			}
+			return written, err
+		}
+		if st.credit <= 0 {
+			st.mu.Unlock()
+			select {
+			case <-st.writable:
+			case <-st.wdl.Done():
+			case <-st.sess.close:
+				st.reset(st.sess.Err())
+			}
+			continue
+		}
+		n := len(p) - written
+		if n > MaxPayload {
+			n = MaxPayload
+		}
+		if int64(n) > st.credit {
+			n = int(st.credit)
+		}
+		st.credit -= int64(n)
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(cmdPsh, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite sends FIN, the other side reads EOF after the data sent.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+	if done {
+		st.sess.removeStream(st.id)
+	}
+	return st.sess.writeFrame(cmdFin, st.id, nil)
+}
+
+// Close sends FIN and stops reading, data arriving later is dropped.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	st.readClosed = true
+	discarded := uint32(st.rbuf.Len()) + st.consumed
+	st.rbuf.Reset()
+	st.consumed = 0
+	st.mu.Unlock()
+	notify(st.readable)
+	if discarded > 0 {
+		st.sendUpd(discarded)
+	}
+	return st.CloseWrite()
+}
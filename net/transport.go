@@ -14,16 +14,18 @@ type Transport struct {
 	client     *PeersClient
 	sigAddr    string
 	serverName string
+	token      string
 }
 
-func NewTransport(sigAddr, name string) (*Transport, error) {
+func NewTransport(sigAddr, name, token string) (*Transport, error) {
 	var wt = &Transport{
 		sigAddr:    sigAddr,
 		serverName: name,
+		token:      token,
 	}
 	wt.client = NewPeersClient()
 
-	err := wt.client.Connect(sigAddr, name)
+	err := wt.client.Connect(sigAddr, name, token)
 	if err != nil {
 		return nil, err
 	}
@@ -31,7 +33,7 @@ func NewTransport(sigAddr, name string) (*Transport, error) {
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	c, err := t.client.Dial(t.sigAddr, t.serverName, conn.Web)
+	c, err := t.client.Dial(t.sigAddr, t.serverName, t.token, conn.Web)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,24 @@
+package proto
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// AdminClient is a backend (answer) or frontend (offer) connected to the signalling server,
+// Node is set for the clients connected to another mesh node.
+type AdminClient struct {
+	Id          string         `json:"id"`
+	Role        webrtc.SDPType `json:"role"`
+	RemoteAddr  string         `json:"remote_addr,omitempty"`
+	ConnectedAt time.Time      `json:"connected_at,omitempty"`
+	Node        string         `json:"node,omitempty"`
+}
+
+type AdminCluster struct {
+	Name      string        `json:"name"`
+	Banned    bool          `json:"banned,omitempty"`
+	Backends  []AdminClient `json:"backends"`
+	Frontends []AdminClient `json:"frontends"`
+}
@@ -0,0 +1,87 @@
+package proto
+
+type FileOp string
+
+const (
+	FileUpload   FileOp = "upload"
+	FileDownload FileOp = "download"
+	FileList     FileOp = "list"
+	FileDelete   FileOp = "delete"
+)
+
+// FileReq is the first frame of a file channel, Etag is the hex sha-256 of the content.
+// A download starts at Offset if Etag is still the content of Path, at 0 otherwise.
+// A list is answered by a ListAck, a delete by a FileAck.
+//
+// With Delta an upload may be sent as a delta to the content the backend has at Path,
+// a download request is followed by the delta.Signature of the local copy.
+type FileReq struct {
+	Op     FileOp `json:"op,omitempty"` // upload if empty
+	Path   string `json:"path"`
+	Size   uint64 `json:"size,omitempty"`
+	Etag   string `json:"etag,omitempty"`
+	Type   uint8  `json:"type,omitempty"` // guessed from the path if zero
+	Offset uint64 `json:"offset,omitempty"`
+	// Mode and ModTime (unix nano) of the uploaded file are kept for downloads.
+	Mode    uint32 `json:"mode,omitempty"`
+	ModTime int64  `json:"mtime,omitempty"`
+	Delta   bool   `json:"delta,omitempty"`
+}
+
+const (
+	FileOk         = 0
+	FileBadRequest = 1
+	FileBusy       = 2 // the same content is being uploaded by another channel
+	FileMismatch   = 3 // the content does not match the etag, the upload starts over
+	FileError      = 4
+	FileDisabled   = 5
+	FileNotFound   = 6
+)
+
+// UploadAck is sent twice: first with the Offset the backend already has, the client sends
+// the bytes after it, then when the content is verified and stored.
+// With Delta the first ack is followed by the delta.Signature of the backend content at Path,
+// and the client sends the delta instead of the bytes.
+// The channel is released after a non-zero code.
+type UploadAck struct {
+	Code   int    `json:"code"`
+	Msg    string `json:"msg,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Etag   string `json:"etag,omitempty"`
+	Offset uint64 `json:"offset"`
+	Delta  bool   `json:"delta,omitempty"`
+}
+
+// DownloadAck is followed by the Size-Offset bytes of the content if Code is zero,
+// or by the delta to the signed local copy with Delta.
+type DownloadAck struct {
+	Code    int    `json:"code"`
+	Msg     string `json:"msg,omitempty"`
+	Size    uint64 `json:"size"`
+	Etag    string `json:"etag,omitempty"`
+	Offset  uint64 `json:"offset"`
+	Mode    uint32 `json:"mode,omitempty"`
+	ModTime int64  `json:"mtime,omitempty"`
+	Delta   bool   `json:"delta,omitempty"`
+}
+
+type FileAck struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg,omitempty"`
+}
+
+// ListAck is followed by Count FileInfo frames.
+type ListAck struct {
+	Code  int    `json:"code"`
+	Msg   string `json:"msg,omitempty"`
+	Count int    `json:"count"`
+}
+
+// FileInfo is a file of a listed directory, Path is relative to it.
+type FileInfo struct {
+	Path    string `json:"path"`
+	Size    uint64 `json:"size"`
+	Etag    string `json:"etag"`
+	Mode    uint32 `json:"mode,omitempty"`
+	ModTime int64  `json:"mtime,omitempty"`
+}
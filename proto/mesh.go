@@ -0,0 +1,34 @@
+package proto
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type MeshType string
+
+const (
+	MeshHello  MeshType = "hello"
+	MeshAdd    MeshType = "add"
+	MeshDel    MeshType = "del"
+	MeshPacket MeshType = "packet"
+)
+
+// MeshMessage is exchanged between signalling nodes,
+// Role is the sdp type of the client, answer for backends and offer for frontends.
+// The hellos carry a Nonce challenge and the Proof, an hmac of the peer's nonce keyed by the mesh secret.
+type MeshMessage struct {
+	Type     MeshType       `json:"type"`
+	Node     string         `json:"node,omitempty"`
+	Nonce    string         `json:"nonce,omitempty"`
+	Proof    string         `json:"proof,omitempty"`
+	Cluster  string         `json:"cluster,omitempty"`
+	Role     webrtc.SDPType `json:"role,omitempty"`
+	ClientId string         `json:"cid,omitempty"`
+	Packet   *Packet        `json:"packet,omitempty"`
+}
+
+func GetMeshURL(sigAddr string) string {
+	return strings.TrimSuffix(GetSignallingURL(sigAddr), "/api/signalling") + "/api/mesh"
+}
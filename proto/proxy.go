@@ -0,0 +1,116 @@
+package proto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+)
+
+type ProxyMode string
+
+const (
+	// ProxyForward dials Port on the backend.
+	ProxyForward ProxyMode = "forward"
+	// ProxyListen makes the backend listen on Port, a ProxyNotice is sent for every accepted connection.
+	ProxyListen ProxyMode = "listen"
+	// ProxyAttach joins the channel with the accepted connection Id.
+	ProxyAttach ProxyMode = "attach"
+)
+
+// ProxyVersion is the version of ProxyHeader, other versions are rejected.
+const ProxyVersion = 1
+
+type AddrType string
+
+const (
+	AddrIPv4   AddrType = "ipv4"
+	AddrIPv6   AddrType = "ipv6"
+	AddrDomain AddrType = "domain"
+)
+
+// ProxyHeader is the first frame of a proxy channel.
+// without Host the backend dials Port on its configured proxy_back addr,
+// otherwise Host:Port if it is allowed.
+type ProxyHeader struct {
+	Version  int       `json:"v"`
+	Mode     ProxyMode `json:"mode,omitempty"`
+	AddrType AddrType  `json:"atyp,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	Port     uint16    `json:"port,omitempty"`
+	Id       string    `json:"id,omitempty"`
+}
+
+// NewProxyHeader makes a forward header to host:port, host may be empty.
+func NewProxyHeader(host string, port uint16) ProxyHeader {
+	var h = ProxyHeader{Version: ProxyVersion, Mode: ProxyForward, Host: host, Port: port}
+	if host != "" {
+		h.AddrType = GetAddrType(host)
+	}
+	return h
+}
+
+func GetAddrType(host string) AddrType {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return AddrDomain
+	case ip.To4() != nil:
+		return AddrIPv4
+	}
+	return AddrIPv6
+}
+
+const (
+	ProxyOk          = 0
+	ProxyDenied      = 1
+	ProxyUnreachable = 2
+	ProxyBadHeader   = 3
+)
+
+// ProxyAck answers the forward and listen headers, the channel is released after a non-zero code.
+type ProxyAck struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg,omitempty"`
+}
+
+// ProxyNotice tells the frontend a connection is accepted on a listening backend port,
+// it is attached by a new channel to the Backend client.
+type ProxyNotice struct {
+	Id      string `json:"id"`
+	Backend string `json:"backend"`
+	Remote  string `json:"remote"`
+}
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// WriteFrame writes v as json with a 2 bytes big endian length prefix.
+func WriteFrame(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > math.MaxUint16 {
+		return ErrFrameTooLarge
+	}
+	var buf = make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(buf, uint16(len(data)))
+	copy(buf[2:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a frame written by WriteFrame into v.
+func ReadFrame(r io.Reader, v any) error {
+	var size = make([]byte, 2)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return err
+	}
+	var data = make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
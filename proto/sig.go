@@ -65,7 +65,17 @@ type FetchAck struct {
 }
 
 type GetClusterReq struct {
-	Name string `form:"name"`
+	Name  string `form:"name"`
+	Token string `form:"token"`
+}
+
+func GetClusterURL(sigAddr, serverName, token string) string {
+	var vals = url.Values{}
+	vals.Add("name", serverName)
+	if token != "" {
+		vals.Add("token", token)
+	}
+	return fmt.Sprintf("%s/api/cluster?%s", sigAddr, vals.Encode())
 }
 
 type GetClusterAck struct {
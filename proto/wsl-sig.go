@@ -1,11 +1,64 @@
 package proto
 
-import "github.com/pion/webrtc/v3"
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
 
 type WsHeader struct {
-	Type webrtc.SDPType `json:"type"`
-	Id   string         `json:"id"`
-	Name string         `json:"name"` // backend cluster name
+	Type  webrtc.SDPType `json:"type"`
+	Id    string         `json:"id"`
+	Name  string         `json:"name"`  // backend cluster name
+	Token string         `json:"token"` // backend secret or frontend token of the cluster
+}
+
+// RelayHeader opens a relay websocket, the offer and answer side with the same PeerId
+// and each other's client id as Target are paired by the server.
+type RelayHeader struct {
+	WsHeader
+	PeerId string `json:"pid"`
+	Target string `json:"target"`
+}
+
+const (
+	WsOk           = 0
+	WsUnauthorized = 401
+	WsNoCluster    = 404
+	WsBadHeader    = 400
+	WsTimeout      = 408
+)
+
+// WsAck is the server reply to WsHeader, the connection is closed after a non-zero code.
+// ICEServers carry short-lived TURN credentials for the client.
+type WsAck struct {
+	Code       int                `json:"code"`
+	Msg        string             `json:"msg,omitempty"`
+	ICEServers []webrtc.ICEServer `json:"ice_servers,omitempty"`
+}
+
+// GetSignallingURL converts a http(s) sig addr to the websocket signalling url.
+func GetSignallingURL(sigAddr string) string {
+	u, err := url.Parse(sigAddr)
+	if err != nil {
+		return sigAddr
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/api/signalling"
+	}
+	return u.String()
+}
+
+// GetRelayURL converts a http(s) sig addr to the websocket relay url.
+func GetRelayURL(sigAddr string) string {
+	return strings.TrimSuffix(GetSignallingURL(sigAddr), "/api/signalling") + "/api/relay"
 }
 
 type Client struct {
@@ -18,4 +71,6 @@ type Packet struct {
 	To           Client                     `json:"to"`
 	Sdp          *webrtc.SessionDescription `json:"sdp,omitempty"`
 	ICECandidate *webrtc.ICECandidate       `json:"ice,omitempty"`
+	// Relay asks the backend to join the relay of From.PeerId instead of connecting webrtc.
+	Relay bool `json:"relay,omitempty"`
 }
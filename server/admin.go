@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/proto"
+)
+
+// AdminAuth aborts the requests without the admin token.
+func (s *Server) AdminAuth(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !tokenEqual(s.cfg.AdminToken, token) {
+		c.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+// Banned reports whether the cluster name is refused.
+func (s *Server) Banned(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bans[name]
+}
+
+func (s *Server) clusters() []proto.AdminCluster {
+	clusters := s.registry.Clusters()
+	for i := range clusters {
+		clusters[i].Banned = s.Banned(clusters[i].Name)
+	}
+	return clusters
+}
+
+func (s *Server) AdminClusters(c *gin.Context) {
+	c.JSON(http.StatusOK, s.clusters())
+}
+
+func (s *Server) AdminCluster(c *gin.Context) {
+	name := c.Param("name")
+	for _, cluster := range s.clusters() {
+		if cluster.Name == name {
+			c.JSON(http.StatusOK, cluster)
+			return
+		}
+	}
+	c.String(http.StatusNotFound, "cluster %s not found", name)
+}
+
+// AdminKick disconnects a client from this node, it may connect again unless the cluster is banned.
+func (s *Server) AdminKick(c *gin.Context) {
+	name, id := c.Param("name"), c.Param("id")
+	if s.registry.Kick(name, id) == 0 {
+		c.String(http.StatusNotFound, "client %s of %s not connected to this node", id, name)
+		return
+	}
+	logrus.Infof("admin kicked client %s of %s", id, name)
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) AdminBans(c *gin.Context) {
+	s.mu.RLock()
+	var names = make([]string, 0, len(s.bans))
+	for name := range s.bans {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+	c.JSON(http.StatusOK, names)
+}
+
+// AdminBan refuses the cluster name and disconnects its clients.
+func (s *Server) AdminBan(c *gin.Context) {
+	name := c.Param("name")
+	s.mu.Lock()
+	s.bans[name] = true
+	s.mu.Unlock()
+	n := s.registry.Kick(name, "")
+	logrus.Infof("admin banned cluster %s, %d clients kicked", name, n)
+	c.Status(http.StatusNoContent)
+}
+
+func (s *Server) AdminUnban(c *gin.Context) {
+	name := c.Param("name")
+	s.mu.Lock()
+	_, ok := s.bans[name]
+	delete(s.bans, name)
+	s.mu.Unlock()
+	if !ok {
+		c.String(http.StatusNotFound, "cluster %s not banned", name)
+		return
+	}
+	logrus.Infof("admin unbanned cluster %s", name)
+	c.Status(http.StatusNoContent)
+}
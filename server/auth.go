@@ -0,0 +1,58 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/yixinin/puup/proto"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNoCluster    = errors.New("cluster has no backend")
+	ErrBanned       = errors.New("cluster banned")
+)
+
+// Authorize checks the credential carried in header against the configured clusters.
+// backends must present the cluster secret, frontends one of the cluster tokens,
+// or the token bound to their client id.
+// with no clusters configured the server stays open.
+func (s *Server) Authorize(header proto.WsHeader) error {
+	if s.Banned(header.Name) {
+		return ErrBanned
+	}
+	if s.cfg == nil || len(s.cfg.Clusters) == 0 {
+		return nil
+	}
+	auth, ok := s.cfg.Clusters[header.Name]
+	if !ok || auth == nil || header.Token == "" {
+		return ErrUnauthorized
+	}
+	switch header.Type {
+	case webrtc.SDPTypeAnswer:
+		if tokenEqual(auth.Secret, header.Token) {
+			return nil
+		}
+	case webrtc.SDPTypeOffer:
+		if token, ok := auth.Clients[header.Id]; ok {
+			if tokenEqual(token, header.Token) {
+				return nil
+			}
+			return ErrUnauthorized
+		}
+		for _, token := range auth.Tokens {
+			if tokenEqual(token, header.Token) {
+				return nil
+			}
+		}
+	}
+	return ErrUnauthorized
+}
+
+func tokenEqual(a, b string) bool {
+	if a == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"net"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -9,9 +11,23 @@ import (
 const NoCluster = "nc"
 
 type Client struct {
-	Id    string
-	Peers map[string]string
-	conn  *websocket.Conn
+	sync.Mutex
+	Id          string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	conn        *websocket.Conn
+}
+
+func NewClient(id string, conn *websocket.Conn) *Client {
+	c := &Client{
+		Id:          id,
+		ConnectedAt: time.Now(),
+		conn:        conn,
+	}
+	if conn != nil {
+		c.RemoteAddr = conn.RemoteAddr().String()
+	}
+	return c
 }
 
 func (c *Client) Close() {
@@ -24,5 +40,7 @@ func (c *Client) Send(v any) error {
 	if c.conn == nil || v == nil {
 		return net.ErrClosed
 	}
+	c.Lock()
+	defer c.Unlock()
 	return c.conn.WriteJSON(v)
 }
@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
 	"github.com/yixinin/puup/proto"
 )
 
@@ -81,8 +82,13 @@ func (s *Server) Cluster(c *gin.Context) {
 	var req proto.GetClusterReq
 	var ack proto.GetClusterAck
 	c.BindQuery(&req)
+	err := s.Authorize(proto.WsHeader{Type: webrtc.SDPTypeOffer, Name: req.Name, Token: req.Token})
+	if err != nil {
+		c.String(http.StatusUnauthorized, err.Error())
+		return
+	}
 	if req.Name != "" {
-		ack.Ids = s.GetBackends(req.Name)
+		ack.Ids = s.registry.GetBackends(req.Name)
 	}
 	c.JSON(http.StatusOK, ack)
 }
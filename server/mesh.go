@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/config"
+	"github.com/yixinin/puup/proto"
+)
+
+const meshHandshakeTimeout = 10 * time.Second
+
+// MeshRedial is how long a node waits to dial a lost node again.
+var MeshRedial = 5 * time.Second
+
+type meshLink struct {
+	sync.Mutex
+	node   string
+	dialed bool // dialed by this node
+	conn   *websocket.Conn
+	done   chan struct{}
+}
+
+// dialer is the node id that dialed the link.
+func (l *meshLink) dialer(self string) string {
+	if l.dialed {
+		return self
+	}
+	return l.node
+}
+
+// duplicateLink refuses a link to a node already linked by the preferred one,
+// done is closed when that one drops.
+type duplicateLink struct {
+	done chan struct{}
+}
+
+func (e *duplicateLink) Error() string {
+	return "duplicate mesh link"
+}
+
+func (l *meshLink) Send(msg proto.MeshMessage) error {
+	l.Lock()
+	defer l.Unlock()
+	return l.conn.WriteJSON(msg)
+}
+
+type remoteClient struct {
+	Node string
+	Role webrtc.SDPType
+}
+
+// MeshRegistry shares the local clients with the other signalling nodes over websocket,
+// packets to clients connected elsewhere are forwarded to their node.
+type MeshRegistry struct {
+	*MemoryRegistry
+
+	cfg *config.Mesh
+
+	mu     sync.RWMutex
+	links  map[string]*meshLink
+	remote map[string]map[string]remoteClient // cluster -> client id -> node
+
+	close chan struct{}
+}
+
+func NewMeshRegistry(cfg *config.Mesh) *MeshRegistry {
+	return &MeshRegistry{
+		MemoryRegistry: NewMemoryRegistry(),
+		cfg:            cfg,
+		links:          make(map[string]*meshLink),
+		remote:         make(map[string]map[string]remoteClient),
+		close:          make(chan struct{}),
+	}
+}
+
+func (r *MeshRegistry) AddBackend(name string, c *Client) {
+	r.MemoryRegistry.AddBackend(name, c)
+	r.broadcast(proto.MeshMessage{Type: proto.MeshAdd, Cluster: name, Role: webrtc.SDPTypeAnswer, ClientId: c.Id})
+}
+
+func (r *MeshRegistry) DelBackend(name, id string) {
+	r.MemoryRegistry.DelBackend(name, id)
+	r.broadcast(proto.MeshMessage{Type: proto.MeshDel, Cluster: name, Role: webrtc.SDPTypeAnswer, ClientId: id})
+}
+
+func (r *MeshRegistry) AddFrontend(name string, c *Client) bool {
+	if len(r.GetBackends(name)) == 0 {
+		return false
+	}
+	r.MemoryRegistry.addFrontend(name, c)
+	r.broadcast(proto.MeshMessage{Type: proto.MeshAdd, Cluster: name, Role: webrtc.SDPTypeOffer, ClientId: c.Id})
+	return true
+}
+
+func (r *MeshRegistry) DelFrontend(name, id string) {
+	r.MemoryRegistry.DelFrontend(name, id)
+	r.broadcast(proto.MeshMessage{Type: proto.MeshDel, Cluster: name, Role: webrtc.SDPTypeOffer, ClientId: id})
+}
+
+func (r *MeshRegistry) GetBackends(name string) []string {
+	ids := r.MemoryRegistry.GetBackends(name)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for id, rc := range r.remote[name] {
+		if rc.Role == webrtc.SDPTypeAnswer {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Clusters also lists the clients connected to the other nodes.
+func (r *MeshRegistry) Clusters() []proto.AdminCluster {
+	clusters := r.MemoryRegistry.Clusters()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for name, m := range r.remote {
+		i := sort.Search(len(clusters), func(i int) bool { return clusters[i].Name >= name })
+		if i == len(clusters) || clusters[i].Name != name {
+			clusters = append(clusters[:i], append([]proto.AdminCluster{{Name: name}}, clusters[i:]...)...)
+		}
+		for id, rc := range m {
+			c := proto.AdminClient{Id: id, Role: rc.Role, Node: rc.Node}
+			if rc.Role == webrtc.SDPTypeAnswer {
+				clusters[i].Backends = append(clusters[i].Backends, c)
+			} else {
+				clusters[i].Frontends = append(clusters[i].Frontends, c)
+			}
+		}
+	}
+	return clusters
+}
+
+func (r *MeshRegistry) Route(name string, typ webrtc.SDPType, packet proto.Packet) error {
+	err := r.MemoryRegistry.Route(name, typ, packet)
+	if !errors.Is(err, ErrNoTarget) {
+		return err
+	}
+	r.mu.RLock()
+	rc, ok := r.remote[name][packet.To.ClientId]
+	var link *meshLink
+	if ok && rc.Role == typ {
+		link = r.links[rc.Node]
+	}
+	r.mu.RUnlock()
+	if link == nil {
+		return ErrNoTarget
+	}
+	return link.Send(proto.MeshMessage{Type: proto.MeshPacket, Cluster: name, Role: typ, Packet: &packet})
+}
+
+func (r *MeshRegistry) Close() error {
+	select {
+	case <-r.close:
+	default:
+		close(r.close)
+	}
+	r.mu.Lock()
+	for _, l := range r.links {
+		l.conn.Close()
+	}
+	r.mu.Unlock()
+	return r.MemoryRegistry.Close()
+}
+
+func (r *MeshRegistry) broadcast(msg proto.MeshMessage) {
+	r.mu.RLock()
+	var links = make([]*meshLink, 0, len(r.links))
+	for _, l := range r.links {
+		links = append(links, l)
+	}
+	r.mu.RUnlock()
+	for _, l := range links {
+		if err := l.Send(msg); err != nil {
+			logrus.Errorf("send mesh %s to %s error:%v", msg.Type, l.node, err)
+		}
+	}
+}
+
+// Run keeps a link to every configured node.
+func (r *MeshRegistry) Run(ctx context.Context) error {
+	for _, addr := range r.cfg.Nodes {
+		go r.dialLoop(ctx, addr)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.close:
+		return nil
+	}
+}
+
+func (r *MeshRegistry) dialLoop(ctx context.Context, addr string) {
+	url := proto.GetMeshURL(addr)
+	for {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+		if err != nil {
+			logrus.Debugf("dial mesh node %s error:%v", url, err)
+		} else if err := r.serve(conn, true); err != nil {
+			// the nodes dialing each other keep one link, it is dialed again once it drops
+			var dup *duplicateLink
+			if errors.As(err, &dup) {
+				select {
+				case <-dup.done:
+				case <-ctx.Done():
+					return
+				case <-r.close:
+					return
+				}
+			} else {
+				logrus.Errorf("mesh node %s disconnected:%v", url, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.close:
+			return
+		case <-time.After(MeshRedial):
+		}
+	}
+}
+
+// HandleConn serves a link dialed by another node until it is closed.
+func (r *MeshRegistry) HandleConn(conn *websocket.Conn) error {
+	return r.serve(conn, false)
+}
+
+func (r *MeshRegistry) serve(conn *websocket.Conn, dialed bool) error {
+	defer conn.Close()
+	link := &meshLink{conn: conn, dialed: dialed, done: make(chan struct{})}
+	node, err := r.handshake(link, dialed)
+	if err != nil {
+		return err
+	}
+	link.node = node
+
+	// of two nodes dialing each other, both keep the link dialed by the smaller id,
+	// otherwise the new link replaces a stale one
+	r.mu.Lock()
+	if old, ok := r.links[link.node]; ok {
+		if r.preferred(old) && !r.preferred(link) {
+			r.mu.Unlock()
+			return &duplicateLink{done: old.done}
+		}
+		old.conn.Close()
+	}
+	r.links[link.node] = link
+	r.mu.Unlock()
+	defer close(link.done)
+	defer r.dropLink(link)
+
+	logrus.Infof("mesh node %s connected", link.node)
+	for _, msg := range r.localClients() {
+		if err := link.Send(msg); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var msg proto.MeshMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		r.onMessage(link.node, msg)
+	}
+}
+
+// handshake proves both nodes know the secret without sending it: the acceptor sends a nonce,
+// the dialer answers with its proof and nonce, the acceptor checks the proof before it sends its own.
+// The proofs are keyed by direction so neither can be reflected back.
+func (r *MeshRegistry) handshake(link *meshLink, dialed bool) (string, error) {
+	if r.cfg.Secret == "" {
+		return "", ErrUnauthorized
+	}
+	link.conn.SetReadDeadline(time.Now().Add(meshHandshakeTimeout))
+	defer link.conn.SetReadDeadline(time.Time{})
+	var nonce = newNonce()
+	var hello proto.MeshMessage
+	if dialed {
+		if err := link.conn.ReadJSON(&hello); err != nil {
+			return "", err
+		}
+		if hello.Type != proto.MeshHello || hello.Nonce == "" {
+			return "", ErrUnauthorized
+		}
+		var peerNonce = hello.Nonce
+		err := link.Send(proto.MeshMessage{Type: proto.MeshHello, Node: r.cfg.NodeId, Nonce: nonce, Proof: meshProof(r.cfg.Secret, "dial", peerNonce)})
+		if err != nil {
+			return "", err
+		}
+		var proof proto.MeshMessage
+		if err := link.conn.ReadJSON(&proof); err != nil {
+			return "", err
+		}
+		if proof.Type != proto.MeshHello || !hmac.Equal([]byte(proof.Proof), []byte(meshProof(r.cfg.Secret, "accept", nonce))) {
+			return "", ErrUnauthorized
+		}
+		hello.Node = proof.Node
+	} else {
+		if err := link.Send(proto.MeshMessage{Type: proto.MeshHello, Nonce: nonce}); err != nil {
+			return "", err
+		}
+		if err := link.conn.ReadJSON(&hello); err != nil {
+			return "", err
+		}
+		if hello.Type != proto.MeshHello || hello.Nonce == "" ||
+			!hmac.Equal([]byte(hello.Proof), []byte(meshProof(r.cfg.Secret, "dial", nonce))) {
+			return "", ErrUnauthorized
+		}
+		err := link.Send(proto.MeshMessage{Type: proto.MeshHello, Node: r.cfg.NodeId, Proof: meshProof(r.cfg.Secret, "accept", hello.Nonce)})
+		if err != nil {
+			return "", err
+		}
+	}
+	if hello.Node == "" || hello.Node == r.cfg.NodeId {
+		return "", errors.New("invalid mesh node id " + hello.Node)
+	}
+	return hello.Node, nil
+}
+
+func meshProof(secret, direction, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(direction + ":" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newNonce() string {
+	var b = make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (r *MeshRegistry) onMessage(node string, msg proto.MeshMessage) {
+	switch msg.Type {
+	case proto.MeshAdd:
+		r.mu.Lock()
+		m, ok := r.remote[msg.Cluster]
+		if !ok {
+			m = make(map[string]remoteClient)
+			r.remote[msg.Cluster] = m
+		}
+		m[msg.ClientId] = remoteClient{Node: node, Role: msg.Role}
+		r.mu.Unlock()
+	case proto.MeshDel:
+		r.mu.Lock()
+		if rc, ok := r.remote[msg.Cluster][msg.ClientId]; ok && rc.Node == node {
+			delete(r.remote[msg.Cluster], msg.ClientId)
+			if len(r.remote[msg.Cluster]) == 0 {
+				delete(r.remote, msg.Cluster)
+			}
+		}
+		r.mu.Unlock()
+	case proto.MeshPacket:
+		if msg.Packet == nil {
+			return
+		}
+		// only deliver locally, packets never hop twice
+		if err := r.MemoryRegistry.Route(msg.Cluster, msg.Role, *msg.Packet); err != nil {
+			logrus.Errorf("route packet from node %s to %s error:%v", node, msg.Packet.To.ClientId, err)
+		}
+	}
+}
+
+func (r *MeshRegistry) preferred(link *meshLink) bool {
+	var smaller = link.node
+	if r.cfg.NodeId < smaller {
+		smaller = r.cfg.NodeId
+	}
+	return link.dialer(r.cfg.NodeId) == smaller
+}
+
+func (r *MeshRegistry) dropLink(link *meshLink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.links[link.node] != link {
+		return
+	}
+	delete(r.links, link.node)
+	for name, m := range r.remote {
+		for id, rc := range m {
+			if rc.Node == link.node {
+				delete(m, id)
+			}
+		}
+		if len(m) == 0 {
+			delete(r.remote, name)
+		}
+	}
+	logrus.Infof("mesh node %s disconnected", link.node)
+}
+
+func (r *MeshRegistry) localClients() []proto.MeshMessage {
+	r.MemoryRegistry.RLock()
+	defer r.MemoryRegistry.RUnlock()
+	var msgs []proto.MeshMessage
+	for name, sess := range r.MemoryRegistry.sessions {
+		for id := range sess.Backends {
+			msgs = append(msgs, proto.MeshMessage{Type: proto.MeshAdd, Cluster: name, Role: webrtc.SDPTypeAnswer, ClientId: id})
+		}
+		for id := range sess.Frontends {
+			msgs = append(msgs, proto.MeshMessage{Type: proto.MeshAdd, Cluster: name, Role: webrtc.SDPTypeOffer, ClientId: id})
+		}
+	}
+	return msgs
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yixinin/puup/config"
+)
+
+func init() {
+	MeshRedial = 50 * time.Millisecond
+}
+
+func TestMeshLinkEachOther(t *testing.T) {
+	var a = NewMeshRegistry(&config.Mesh{NodeId: "a", Secret: "s"})
+	var b = NewMeshRegistry(&config.Mesh{NodeId: "b", Secret: "s"})
+	for _, r := range []*MeshRegistry{a, b} {
+		var r = r
+		var up websocket.Upgrader
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if conn, err := up.Upgrade(w, req, nil); err == nil {
+				go r.HandleConn(conn)
+			}
+		}))
+		t.Cleanup(srv.Close)
+		t.Cleanup(func() { r.Close() })
+		if r == a {
+			b.cfg.Nodes = []string{srv.URL}
+		} else {
+			a.cfg.Nodes = []string{srv.URL}
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	go b.Run(ctx)
+
+	var link = func(r *MeshRegistry, node string) *meshLink {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		if len(r.links) > 1 {
+			t.Fatalf("%d links", len(r.links))
+		}
+		return r.links[node]
+	}
+	var ab, ba *meshLink
+	for start := time.Now(); ab == nil || ba == nil || !ab.dialed || ba.dialed; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("nodes not linked")
+		}
+		ab, ba = link(a, "b"), link(b, "a")
+	}
+	// both keep the link dialed by the smaller id through many redials
+	time.Sleep(20 * MeshRedial)
+	if link(a, "b") != ab || link(b, "a") != ba {
+		t.Fatal("mesh links replaced")
+	}
+}
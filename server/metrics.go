@@ -0,0 +1,23 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/yixinin/puup/metrics"
+)
+
+// servers are the running servers, for the metrics.
+var servers sync.Map
+
+func init() {
+	metrics.NewGaugeFunc("puup_signalling_sessions", "Clients connected to the signalling server by cluster and role.", func(emit func(float64, ...string)) {
+		servers.Range(func(key, _ any) bool {
+			s := key.(*Server)
+			for name, n := range s.registry.Counts() {
+				emit(float64(n.Backends), s.cfg.Addr, name, "backend")
+				emit(float64(n.Frontends), s.cfg.Addr, name, "frontend")
+			}
+			return true
+		})
+	}, "addr", "cluster", "role")
+}
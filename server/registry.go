@@ -0,0 +1,244 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/yixinin/puup/proto"
+)
+
+var ErrNoTarget = errors.New("target client not found")
+
+// Registry keeps the backends and frontends of every cluster and routes packets between them.
+type Registry interface {
+	AddBackend(name string, c *Client)
+	DelBackend(name, id string)
+	// AddFrontend returns false when the cluster has no backend.
+	AddFrontend(name string, c *Client) bool
+	DelFrontend(name, id string)
+	GetBackends(name string) []string
+	// Route sends packet to packet.To.ClientId, typ is the sdp type of the target.
+	Route(name string, typ webrtc.SDPType, packet proto.Packet) error
+	// Counts returns the clients connected to this node by cluster name.
+	Counts() map[string]SessionCount
+	// Clusters lists the clusters and their clients sorted by name.
+	Clusters() []proto.AdminCluster
+	// Kick disconnects the client id of the cluster connected to this node, all of them if id is empty,
+	// it returns the number of clients disconnected.
+	Kick(name, id string) int
+	Close() error
+}
+
+// SessionCount is the number of backends and frontends of a cluster.
+type SessionCount struct {
+	Backends  int
+	Frontends int
+}
+
+// MemoryRegistry is the registry of a single signalling node.
+type MemoryRegistry struct {
+	sync.RWMutex
+	sessions map[string]Session
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		sessions: make(map[string]Session),
+	}
+}
+
+func (r *MemoryRegistry) AddBackend(name string, c *Client) {
+	r.Lock()
+	defer r.Unlock()
+	sess, ok := r.sessions[name]
+	if !ok {
+		sess = Session{
+			ClusterName: name,
+			Backends:    make(map[string]*Client),
+			Frontends:   make(map[string]*Client),
+		}
+		r.sessions[name] = sess
+	}
+	sess.Backends[c.Id] = c
+}
+
+func (r *MemoryRegistry) GetBackends(name string) []string {
+	r.RLock()
+	defer r.RUnlock()
+	sess, ok := r.sessions[name]
+	if !ok {
+		return nil
+	}
+	var ids = make([]string, 0, len(sess.Backends))
+	for k := range sess.Backends {
+		ids = append(ids, k)
+	}
+	return ids
+}
+
+func (r *MemoryRegistry) GetBackend(name string, id string) (*Client, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	sess, ok := r.sessions[name]
+	if !ok {
+		return nil, false
+	}
+	b, ok := sess.Backends[id]
+	return b, ok
+}
+
+func (r *MemoryRegistry) DelBackend(name, id string) {
+	r.Lock()
+	defer r.Unlock()
+	sess, ok := r.sessions[name]
+	if !ok {
+		return
+	}
+	delete(sess.Backends, id)
+	if len(sess.Backends) == 0 && len(sess.Frontends) == 0 {
+		delete(r.sessions, name)
+	}
+}
+
+func (r *MemoryRegistry) AddFrontend(name string, c *Client) bool {
+	r.Lock()
+	defer r.Unlock()
+	sess, ok := r.sessions[name]
+	if !ok || len(sess.Backends) == 0 {
+		return false
+	}
+	sess.Frontends[c.Id] = c
+	return true
+}
+
+// addFrontend registers c even if no local backend is connected.
+func (r *MemoryRegistry) addFrontend(name string, c *Client) {
+	r.Lock()
+	defer r.Unlock()
+	sess, ok := r.sessions[name]
+	if !ok {
+		sess = Session{
+			ClusterName: name,
+			Backends:    make(map[string]*Client),
+			Frontends:   make(map[string]*Client),
+		}
+		r.sessions[name] = sess
+	}
+	sess.Frontends[c.Id] = c
+}
+
+func (r *MemoryRegistry) GetFrontend(name string, id string) (*Client, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	sess, ok := r.sessions[name]
+	if !ok {
+		return nil, false
+	}
+	f, ok := sess.Frontends[id]
+	return f, ok
+}
+
+func (r *MemoryRegistry) DelFrontend(name, id string) {
+	r.Lock()
+	defer r.Unlock()
+	sess, ok := r.sessions[name]
+	if !ok {
+		return
+	}
+	delete(sess.Frontends, id)
+	if len(sess.Backends) == 0 && len(sess.Frontends) == 0 {
+		delete(r.sessions, name)
+	}
+}
+
+func (r *MemoryRegistry) getClient(name string, typ webrtc.SDPType, id string) (*Client, bool) {
+	switch typ {
+	case webrtc.SDPTypeAnswer:
+		return r.GetBackend(name, id)
+	case webrtc.SDPTypeOffer:
+		return r.GetFrontend(name, id)
+	}
+	return nil, false
+}
+
+func (r *MemoryRegistry) Route(name string, typ webrtc.SDPType, packet proto.Packet) error {
+	c, ok := r.getClient(name, typ, packet.To.ClientId)
+	if !ok {
+		return ErrNoTarget
+	}
+	return c.Send(packet)
+}
+
+func (r *MemoryRegistry) Counts() map[string]SessionCount {
+	r.RLock()
+	defer r.RUnlock()
+	var counts = make(map[string]SessionCount, len(r.sessions))
+	for name, sess := range r.sessions {
+		counts[name] = SessionCount{Backends: len(sess.Backends), Frontends: len(sess.Frontends)}
+	}
+	return counts
+}
+
+func (r *MemoryRegistry) Clusters() []proto.AdminCluster {
+	r.RLock()
+	defer r.RUnlock()
+	var clusters = make([]proto.AdminCluster, 0, len(r.sessions))
+	for name, sess := range r.sessions {
+		clusters = append(clusters, proto.AdminCluster{
+			Name:      name,
+			Backends:  adminClients(sess.Backends, webrtc.SDPTypeAnswer),
+			Frontends: adminClients(sess.Frontends, webrtc.SDPTypeOffer),
+		})
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+	return clusters
+}
+
+func adminClients(clients map[string]*Client, role webrtc.SDPType) []proto.AdminClient {
+	var list = make([]proto.AdminClient, 0, len(clients))
+	for _, c := range clients {
+		list = append(list, proto.AdminClient{Id: c.Id, Role: role, RemoteAddr: c.RemoteAddr, ConnectedAt: c.ConnectedAt})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// Kick closes the signalling conns, the clients are deleted when their handlers return.
+func (r *MemoryRegistry) Kick(name, id string) int {
+	r.RLock()
+	defer r.RUnlock()
+	sess, ok := r.sessions[name]
+	if !ok {
+		return 0
+	}
+	var n int
+	for _, clients := range []map[string]*Client{sess.Backends, sess.Frontends} {
+		for cid, c := range clients {
+			if id == "" || cid == id {
+				c.Close()
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (r *MemoryRegistry) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	for _, sess := range r.sessions {
+		for _, c := range sess.Backends {
+			c.Close()
+		}
+		for _, c := range sess.Frontends {
+			c.Close()
+		}
+	}
+	return nil
+}
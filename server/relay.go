@@ -0,0 +1,169 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/metrics"
+	"github.com/yixinin/puup/proto"
+)
+
+// RelayWait is how long a relay websocket waits for the other side.
+var RelayWait = 30 * time.Second
+
+var (
+	relaySessions = metrics.NewGaugeVec("puup_relay_sessions", "Relayed frontend backend pairs.", "cluster")
+	relayBytes    = metrics.NewCounterVec("puup_relay_bytes_total", "Bytes relayed between frontends and backends.", "cluster")
+)
+
+type relayEnd struct {
+	header proto.RelayHeader
+	conn   *websocket.Conn
+	paired chan *relayEnd
+}
+
+// relayHub pairs the relay websockets of the same peer, it only sees the tls records of the two ends.
+type relayHub struct {
+	sync.Mutex
+	waiting map[string]*relayEnd
+}
+
+// pair hands end to the waiting one of its peer, or makes it wait.
+func (h *relayHub) pair(end *relayEnd) (other *relayEnd, ok bool) {
+	var key = end.header.Name + "\n" + end.header.PeerId
+	h.Lock()
+	defer h.Unlock()
+	if h.waiting == nil {
+		h.waiting = make(map[string]*relayEnd)
+	}
+	other, found := h.waiting[key]
+	if !found {
+		h.waiting[key] = end
+		return nil, true
+	}
+	if other.header.Type == end.header.Type || other.header.Id != end.header.Target || other.header.Target != end.header.Id {
+		return nil, false
+	}
+	delete(h.waiting, key)
+	// under the lock, so a cancel failing means the partner is in paired
+	other.paired <- end
+	return other, true
+}
+
+// cancel stops end waiting, it returns false if a partner was already paired with it.
+func (h *relayHub) cancel(end *relayEnd) bool {
+	var key = end.header.Name + "\n" + end.header.PeerId
+	h.Lock()
+	defer h.Unlock()
+	if h.waiting[key] != end {
+		return false
+	}
+	delete(h.waiting, key)
+	return true
+}
+
+func (s *Server) WsRelay(c *gin.Context) {
+	conn, err := s.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		c.String(http.StatusBadRequest, "upgrade failed, error:%v", err)
+		return
+	}
+	go func() {
+		if err := s.HandleRelay(conn); err != nil {
+			logrus.Errorf("relay from %s closed:%v", conn.RemoteAddr(), err)
+		}
+	}()
+}
+
+// HandleRelay waits for the other side of the relay and copies the messages between them.
+func (s *Server) HandleRelay(conn *websocket.Conn) error {
+	var header proto.RelayHeader
+	if err := conn.ReadJSON(&header); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := s.Authorize(header.WsHeader); err != nil {
+		conn.WriteJSON(proto.WsAck{Code: proto.WsUnauthorized, Msg: err.Error()})
+		conn.Close()
+		return err
+	}
+	if header.PeerId == "" || header.Target == "" ||
+		header.Type != webrtc.SDPTypeOffer && header.Type != webrtc.SDPTypeAnswer {
+		conn.WriteJSON(proto.WsAck{Code: proto.WsBadHeader, Msg: "bad relay header"})
+		conn.Close()
+		return ErrUnauthorized
+	}
+
+	end := &relayEnd{header: header, conn: conn, paired: make(chan *relayEnd, 1)}
+	other, ok := s.relays.pair(end)
+	if !ok {
+		conn.WriteJSON(proto.WsAck{Code: proto.WsBadHeader, Msg: "relay peer mismatch"})
+		conn.Close()
+		return ErrUnauthorized
+	}
+	// the first one waits and copies once the other one arrives
+	if other != nil {
+		return nil
+	}
+	var t = time.NewTimer(RelayWait)
+	defer t.Stop()
+	select {
+	case other = <-end.paired:
+	case <-t.C:
+		if s.relays.cancel(end) {
+			conn.WriteJSON(proto.WsAck{Code: proto.WsTimeout, Msg: "relay peer not connected"})
+			conn.Close()
+			return nil
+		}
+		// the other one arrived with the timeout
+		other = <-end.paired
+	}
+	defer conn.Close()
+	defer other.conn.Close()
+	for _, c := range []*websocket.Conn{conn, other.conn} {
+		if err := c.WriteJSON(proto.WsAck{Code: proto.WsOk}); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("relay %s of %s started", header.PeerId, header.Name)
+	relaySessions.With(header.Name).Inc()
+	defer relaySessions.With(header.Name).Dec()
+	var counter = relayBytes.With(header.Name)
+	var done = make(chan error, 2)
+	go func() { done <- copyMessages(other.conn, conn, counter) }()
+	go func() { done <- copyMessages(conn, other.conn, counter) }()
+	err := <-done
+	logrus.Infof("relay %s of %s closed", header.PeerId, header.Name)
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		return nil
+	}
+	return err
+}
+
+func copyMessages(dst, src *websocket.Conn, counter *metrics.Counter) error {
+	for {
+		typ, r, err := src.NextReader()
+		if err != nil {
+			return err
+		}
+		w, err := dst.NextWriter(typ)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(w, r)
+		counter.Add(uint64(n))
+		if err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+}
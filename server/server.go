@@ -2,12 +2,16 @@ package server
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/config"
+	"github.com/yixinin/puup/metrics"
 	"github.com/yixinin/puup/middles"
 )
 
@@ -28,111 +32,52 @@ type SdpPair struct {
 }
 
 type Server struct {
-	sync.RWMutex
 	websocket.Upgrader
 
-	// cluster map[string]*Cluster
+	cfg     *config.Server
+	metrics string
 
-	sessions map[string]Session
-}
+	registry Registry
+	relays   relayHub
 
-func (s *Server) AddBackend(name string, id string, conn *websocket.Conn) {
-	s.Lock()
-	defer s.Unlock()
-	sess, ok := s.sessions[name]
-	if !ok {
-		sess = Session{
-			ClusterName: name,
-			Backends:    make(map[string]*Client),
-			Frontends:   make(map[string]*Client),
-		}
-		s.sessions[name] = sess
-	}
-	sess.Backends[id] = &Client{
-		Id:    id,
-		conn:  conn,
-		Peers: make(map[string]string),
-	}
-}
-func (s *Server) GetBackends(name string) []string {
-	s.RLock()
-	defer s.RUnlock()
-	sess, ok := s.sessions[name]
-	if !ok {
-		return nil
-	}
-	var ids = make([]string, len(sess.Backends))
-	for k := range sess.Backends {
-		ids = append(ids, k)
-	}
-	return ids
+	mu   sync.RWMutex
+	bans map[string]bool
 }
 
-func (s *Server) GetBackend(name string, id string) (*Client, bool) {
-	s.RLock()
-	defer s.RUnlock()
-	sess, ok := s.sessions[name]
-	if !ok {
-		return nil, false
+func NewServer(filename string) (*Server, error) {
+	cfg, err := config.LoadConfig(filename)
+	if err != nil {
+		return nil, err
 	}
-
-	b, ok := sess.Backends[id]
-	return b, ok
-}
-
-func (s *Server) DelBackend(name, id string) {
-	s.Lock()
-	defer s.Unlock()
-	sess, ok := s.sessions[name]
-	if !ok {
-		return
+	if cfg.Server == nil {
+		cfg.Server = &config.Server{}
 	}
-	delete(sess.Backends, id)
-	if len(sess.Backends) == 0 {
-		delete(s.sessions, name)
+	if cfg.Server.Addr == "" {
+		cfg.Server.Addr = ":8080"
 	}
-}
-
-func (s *Server) AddFrontend(name string, id string, conn *websocket.Conn) bool {
-	s.Lock()
-	defer s.Unlock()
-	sess, ok := s.sessions[name]
-	if !ok {
-		return false
+	s := &Server{
+		cfg:     cfg.Server,
+		metrics: cfg.Metrics,
+		bans:    make(map[string]bool, len(cfg.Server.Bans)),
 	}
-	sess.Frontends[id] = &Client{
-		Id:    id,
-		conn:  conn,
-		Peers: make(map[string]string),
+	for _, name := range cfg.Server.Bans {
+		s.bans[name] = true
 	}
-	return true
-}
-
-func (s *Server) GetFrontend(name string, id string) (*Client, bool) {
-	s.RLock()
-	defer s.RUnlock()
-	sess, ok := s.sessions[name]
-	if !ok {
-		return nil, false
+	// hand out credentials of the built-in relay if no turn urls are given
+	if ts := cfg.Server.TurnServer; ts != nil && cfg.Server.Turn != nil && len(cfg.Server.Turn.URLs) == 0 {
+		port := "3478"
+		if _, p, err := net.SplitHostPort(ts.Listen); err == nil {
+			port = p
+		}
+		host := net.JoinHostPort(ts.PublicIP, port)
+		cfg.Server.Turn.URLs = []string{"stun:" + host, "turn:" + host + "?transport=udp", "turn:" + host + "?transport=tcp"}
 	}
-	f, ok := sess.Frontends[id]
-	return f, ok
-}
-
-func (s *Server) DelFrontend(name, id string) {
-	s.Lock()
-	defer s.Unlock()
-	sess, ok := s.sessions[name]
-	if !ok {
-		return
-	}
-	delete(sess.Frontends, id)
-}
-
-func NewServer() *Server {
-	return &Server{
-		sessions: make(map[string]Session),
+	if cfg.Server.Mesh != nil {
+		s.registry = NewMeshRegistry(cfg.Server.Mesh)
+	} else {
+		s.registry = NewMemoryRegistry()
 	}
+	return s, nil
 }
 
 func (s *Server) Run(ctx context.Context) error {
@@ -148,7 +93,46 @@ func (s *Server) Run(ctx context.Context) error {
 	// g.HEAD("/offline", s.Offline)
 	g.GET("/cluster", s.Cluster)
 
+	if s.cfg.AdminToken != "" {
+		e.GET("/metrics", s.AdminAuth, gin.WrapH(metrics.Default))
+		admin := g.Group("/admin", s.AdminAuth)
+		admin.GET("/clusters", s.AdminClusters)
+		admin.GET("/clusters/:name", s.AdminCluster)
+		admin.DELETE("/clusters/:name/clients/:id", s.AdminKick)
+		admin.GET("/bans", s.AdminBans)
+		admin.PUT("/bans/:name", s.AdminBan)
+		admin.DELETE("/bans/:name", s.AdminUnban)
+	}
+
 	g.Any("/signalling", s.WsSignalling)
+	g.GET("/relay", s.WsRelay)
+
+	if mesh, ok := s.registry.(*MeshRegistry); ok {
+		g.GET("/mesh", s.WsMesh)
+		go func() {
+			if err := mesh.Run(ctx); err != nil {
+				logrus.Errorf("mesh stopped:%v", err)
+			}
+		}()
+	}
+	defer s.registry.Close()
+	if s.metrics != "" {
+		go func() {
+			if err := metrics.Serve(s.metrics); err != nil {
+				logrus.Errorf("metrics stopped:%v", err)
+			}
+		}()
+	}
+	servers.Store(s, struct{}{})
+	defer servers.Delete(s)
+
+	if s.cfg.TurnServer != nil {
+		ts, err := s.StartTurn()
+		if err != nil {
+			return err
+		}
+		defer ts.Close()
+	}
 
-	return e.Run(":8080")
+	return e.Run(s.cfg.Addr)
 }
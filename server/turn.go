@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+	"github.com/yixinin/puup/stderr"
+)
+
+const defaultTurnTTL = 24 * time.Hour
+
+// TurnCredentials returns the ice servers with a REST-API style credential for client id,
+// the username is "<expire unix>:<id>" and the password base64(hmac-sha1(secret, username)).
+func (s *Server) TurnCredentials(id string) []webrtc.ICEServer {
+	if s.cfg == nil || s.cfg.Turn == nil || s.cfg.Turn.Secret == "" || len(s.cfg.Turn.URLs) == 0 {
+		return nil
+	}
+	ttl := s.cfg.Turn.TTL
+	if ttl <= 0 {
+		ttl = defaultTurnTTL
+	}
+	username := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + ":" + id
+	return []webrtc.ICEServer{{
+		URLs:           s.cfg.Turn.URLs,
+		Username:       username,
+		Credential:     turnPassword(s.cfg.Turn.Secret, username),
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}}
+}
+
+func turnPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+var ErrAllocationLimit = errors.New("turn allocation limit reached")
+
+// StartTurn runs the built-in STUN/TURN relay configured by turn_server.
+func (s *Server) StartTurn() (*turn.Server, error) {
+	cfg := s.cfg.TurnServer
+	addr := cfg.Listen
+	if addr == "" {
+		addr = ":3478"
+	}
+	ip := net.ParseIP(cfg.PublicIP)
+	if ip == nil {
+		return nil, errors.New("turn_server public_ip is invalid: " + cfg.PublicIP)
+	}
+	var gen turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{
+		RelayAddress: ip,
+		Address:      "0.0.0.0",
+	}
+	if cfg.MinPort != 0 || cfg.MaxPort != 0 {
+		gen = &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: ip,
+			Address:      "0.0.0.0",
+			MinPort:      cfg.MinPort,
+			MaxPort:      cfg.MaxPort,
+		}
+	}
+	if cfg.MaxAllocations > 0 {
+		gen = &limitedGenerator{RelayAddressGenerator: gen, max: int64(cfg.MaxAllocations)}
+	}
+
+	udp, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, stderr.Wrap(err)
+	}
+	tcp, err := net.Listen("tcp4", addr)
+	if err != nil {
+		udp.Close()
+		return nil, stderr.Wrap(err)
+	}
+	ts, err := turn.NewServer(turn.ServerConfig{
+		Realm:       cfg.Realm,
+		AuthHandler: s.turnAuth,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udp, RelayAddressGenerator: gen},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcp, RelayAddressGenerator: gen},
+		},
+	})
+	if err != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, stderr.Wrap(err)
+	}
+	logrus.Infof("turn server listen on %s, relay ip %s", addr, ip)
+	return ts, nil
+}
+
+// turnAuth accepts the static users and the credentials made by TurnCredentials.
+func (s *Server) turnAuth(username, realm string, _ net.Addr) ([]byte, bool) {
+	if pass, ok := s.cfg.TurnServer.Users[username]; ok {
+		return turn.GenerateAuthKey(username, realm, pass), true
+	}
+	if s.cfg.Turn == nil || s.cfg.Turn.Secret == "" {
+		return nil, false
+	}
+	expire, _, _ := strings.Cut(username, ":")
+	t, err := strconv.ParseInt(expire, 10, 64)
+	if err != nil || t < time.Now().Unix() {
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, turnPassword(s.cfg.Turn.Secret, username)), true
+}
+
+// limitedGenerator caps the number of live relay allocations.
+type limitedGenerator struct {
+	turn.RelayAddressGenerator
+	max    int64
+	active int64
+}
+
+func (g *limitedGenerator) acquire() bool {
+	if atomic.AddInt64(&g.active, 1) > g.max {
+		atomic.AddInt64(&g.active, -1)
+		return false
+	}
+	return true
+}
+
+func (g *limitedGenerator) release() {
+	atomic.AddInt64(&g.active, -1)
+}
+
+func (g *limitedGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if !g.acquire() {
+		return nil, nil, ErrAllocationLimit
+	}
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		g.release()
+		return nil, nil, err
+	}
+	return &limitedPacketConn{PacketConn: conn, release: g.release}, addr, nil
+}
+
+func (g *limitedGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	if !g.acquire() {
+		return nil, nil, ErrAllocationLimit
+	}
+	conn, addr, err := g.RelayAddressGenerator.AllocateConn(network, requestedPort)
+	if err != nil {
+		g.release()
+		return nil, nil, err
+	}
+	return &limitedConn{Conn: conn, release: g.release}, addr, nil
+}
+
+type limitedPacketConn struct {
+	net.PacketConn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedPacketConn) Close() error {
+	c.once.Do(c.release)
+	return c.PacketConn.Close()
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
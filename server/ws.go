@@ -18,6 +18,7 @@ func (s *Server) WsSignalling(c *gin.Context) {
 	conn, err := s.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		c.String(http.StatusBadRequest, "upgrade failed, error:%v", err)
+		return
 	}
 	go s.HandleWs(c.Request.Context(), conn)
 }
@@ -42,26 +43,39 @@ func (s *Server) HandleWs(ctx context.Context, conn *websocket.Conn) (err error)
 	if err != nil {
 		return err
 	}
+	if err = s.Authorize(header); err != nil {
+		conn.WriteJSON(proto.WsAck{Code: proto.WsUnauthorized, Msg: err.Error()})
+		return err
+	}
 
+	var client = NewClient(header.Id, conn)
+	var target webrtc.SDPType
 	defer func() {
 		switch header.Type {
 		case webrtc.SDPTypeAnswer:
-			s.DelBackend(header.Name, header.Id)
+			s.registry.DelBackend(header.Name, header.Id)
 		case webrtc.SDPTypeOffer:
-			s.DelFrontend(header.Name, header.Id)
+			s.registry.DelFrontend(header.Name, header.Id)
 		}
 	}()
 
 	switch header.Type {
 	case webrtc.SDPTypeAnswer:
-		s.AddBackend(header.Name, header.Id, conn)
+		target = webrtc.SDPTypeOffer
+		s.registry.AddBackend(header.Name, client)
 	case webrtc.SDPTypeOffer:
-		if !s.AddFrontend(header.Name, header.Id, conn) {
-			return errors.New("cluster has no backend")
+		target = webrtc.SDPTypeAnswer
+		if !s.registry.AddFrontend(header.Name, client) {
+			client.Send(proto.WsAck{Code: proto.WsNoCluster, Msg: ErrNoCluster.Error()})
+			return ErrNoCluster
 		}
 	default:
+		client.Send(proto.WsAck{Code: proto.WsBadHeader, Msg: "unknown header type"})
 		return errors.New("unknown header type " + header.Type.String())
 	}
+	if err = client.Send(proto.WsAck{Code: proto.WsOk, ICEServers: s.TurnCredentials(header.Id)}); err != nil {
+		return err
+	}
 
 	for {
 		var packet proto.Packet
@@ -73,22 +87,32 @@ func (s *Server) HandleWs(ctx context.Context, conn *websocket.Conn) (err error)
 			return err
 		}
 
-		var client *Client
-		switch header.Type {
-		case webrtc.SDPTypeAnswer:
-			client, _ = s.GetFrontend(header.Name, packet.From.ClientId)
-		case webrtc.SDPTypeOffer:
-			client, _ = s.GetBackend(header.Name, packet.From.ClientId)
-		}
-		if client == nil {
-			logrus.Errorf("cannot find target:%s", packet.From.ClientId)
-			continue
+		// the sender is the authorized client, never trust the packet
+		packet.From.ClientId = header.Id
+		if err := s.registry.Route(header.Name, target, packet); err != nil {
+			logrus.Errorf("route packet from %s to %s error:%v", header.Id, packet.To.ClientId, err)
 		}
+	}
+}
 
-		packet.To.ClientId = client.Peers[packet.From.PeerId]
-
-		if err := client.Send(packet); err != nil {
-			return err
-		}
+func (s *Server) WsMesh(c *gin.Context) {
+	mesh, ok := s.registry.(*MeshRegistry)
+	if !ok {
+		c.String(http.StatusNotFound, "mesh disabled")
+		return
 	}
+	conn, err := s.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		c.String(http.StatusBadRequest, "upgrade failed, error:%v", err)
+		return
+	}
+	go func() {
+		err := mesh.HandleConn(conn)
+		var dup *duplicateLink
+		if errors.As(err, &dup) {
+			logrus.Debugf("mesh conn from %s closed:%v", conn.RemoteAddr(), err)
+		} else if err != nil {
+			logrus.Errorf("mesh conn from %s closed:%v", conn.RemoteAddr(), err)
+		}
+	}()
 }